@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
+	"unsafe"
 
 	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ipam"
@@ -19,8 +22,36 @@ import (
 	"github.com/mozhuli/ovn-stackube/pkg/common"
 	"github.com/mozhuli/ovn-stackube/pkg/exec"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// defaultMTU leaves room for the Geneve header on a 1500 bytes network.
+const defaultMTU = 1400
+
+// The ways pod interfaces are attached, the Mode of NetConf.
+const (
+	// modeVeth gives the pod a configured veth pair end in its netns.
+	modeVeth = "veth"
+	// modeTap plugs a tap device of the host for the guest of hypervisor
+	// based runtimes.  The guest configures its address itself.
+	modeTap = "tap"
+	// modeMacvtap plugs the host end of a veth pair whose pod end carries a
+	// macvtap device for the guest, the way hypervisor runtimes that only
+	// see the pod's netns expect it.
+	modeMacvtap = "macvtap"
+	// modeDPDK plugs a vhost-user port of a userspace datapath, whose
+	// socket the workload serves from a directory of the pod.
+	modeDPDK = "dpdk"
+)
+
+// defaultVhostUserDir is where the directories of the vhost-user sockets of
+// the pods are created by default.
+const defaultVhostUserDir = "/var/run/ovn-stackube/vhostuser"
+
+// legacyVersions are the CNI versions whose results have no interfaces.  The
+// runtimes asking for a later version get a currentResult.
+var legacyVersions = map[string]bool{"": true, "0.1.0": true, "0.2.0": true}
+
 // NetConf stores the common network config for ovn CNI plugin
 type NetConf struct {
 	Bridge string `json:"bridge"`
@@ -30,9 +61,83 @@ type NetConf struct {
 		Type   string `json:"type"`
 		Subnet string `json:"subnet"`
 	} `json:"ipam,omitempty"`
-	IPMasq    bool   `json:"ipMasq"`
-	IsGateway bool   `json:"isGateway"`
-	LogLevel  string `json:"log_level"`
+	IPMasq      bool   `json:"ipMasq"`
+	IsGateway   bool   `json:"isGateway"`
+	MTU         int    `json:"mtu"`
+	HairpinMode bool   `json:"hairpinMode"`
+	LogLevel    string `json:"log_level"`
+	// Metadata is the --metadata-mode of the controller.  In "localport"
+	// mode the metadata address is routed on-link to the switch's localport.
+	Metadata string `json:"metadata"`
+	// Mode is how the pod interfaces are attached, "veth" by default.
+	Mode string `json:"mode"`
+	// VhostUserDir holds a directory of vhost-user sockets per pod in
+	// "dpdk" mode.
+	VhostUserDir string `json:"vhostuser_dir"`
+	// CNIVersion is the version of the result.  Hypervisor based runtimes
+	// need 0.3.0 or later to learn the interfaces of the guest.
+	CNIVersion string `json:"cniVersion"`
+}
+
+// guestInterface is an interface of a currentResult.  setupPodInterface
+// returns the ones handed to the guest of a hypervisor based runtime.
+type guestInterface struct {
+	Name string `json:"name"`
+	Mac  string `json:"mac,omitempty"`
+	// Sandbox is the netns path of the interface, "" in the host netns.
+	Sandbox string `json:"sandbox,omitempty"`
+	// Socket is the vhost-user socket of the interface in "dpdk" mode,
+	// named as in CNI 1.1.0.
+	Socket string `json:"socketPath,omitempty"`
+}
+
+// ipConfig is an address of a currentResult.
+type ipConfig struct {
+	Version string `json:"version"`
+	// Interface is the index of the interface in the result.
+	Interface int         `json:"interface"`
+	Address   types.IPNet `json:"address"`
+	Gateway   net.IP      `json:"gateway,omitempty"`
+}
+
+// currentResult is a CNI 0.3.0 and later result, which the vendored CNI
+// library does not have.  The guest of a tap, macvtap or vhost-user port
+// uses the interface its address is on: a tap device has no sandbox and a
+// vhost-user port has a socket.
+type currentResult struct {
+	CNIVersion string            `json:"cniVersion"`
+	Interfaces []*guestInterface `json:"interfaces,omitempty"`
+	IPs        []*ipConfig       `json:"ips,omitempty"`
+	Routes     []types.Route     `json:"routes,omitempty"`
+}
+
+// addInterface adds a pod interface to r with ip on guest, or on the veth
+// end ifName in netns when guest is nil.  The host end of a veth pair,
+// hostIfName, comes first.
+func (r *currentResult) addInterface(netns ns.NetNS, ifName, hostIfName, macAddress string, guest *guestInterface, ip *types.IPConfig) {
+	if guest == nil || guest.Sandbox != "" {
+		host := &guestInterface{Name: hostIfName}
+		if link, err := netlink.LinkByName(hostIfName); err == nil {
+			host.Mac = link.Attrs().HardwareAddr.String()
+		}
+		r.Interfaces = append(r.Interfaces, host)
+	}
+	if guest == nil {
+		guest = &guestInterface{Name: ifName, Mac: macAddress, Sandbox: netns.Path()}
+	}
+	r.Interfaces = append(r.Interfaces, guest)
+	r.IPs = append(r.IPs, &ipConfig{Version: "4", Interface: len(r.Interfaces) - 1, Address: types.IPNet(ip.IP), Gateway: ip.Gateway})
+	r.Routes = append(r.Routes, ip.Routes...)
+}
+
+// Print prints r the way types.Result prints itself.
+func (r *currentResult) Print() error {
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
 }
 
 func init() {
@@ -42,22 +147,26 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func setupInterface(containerId string, netns ns.NetNS, ifName string, macAddress string) (string, error) {
+// setupInterface creates a veth pair with ifName in the container and
+// hostIfName in the host netns.  ifName gets macAddress unless it is "".
+func setupInterface(conf *NetConf, netns ns.NetNS, ifName, hostIfName, macAddress string) error {
 	var hostVethName string
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, contVeth, err := ip.SetupVeth(ifName, mtu, hostNS)
-		if err != nil {
-			return err
-		}
-		hw, err := net.ParseMAC(macAddress)
+		hostVeth, contVeth, err := ip.SetupVeth(ifName, conf.MTU, hostNS)
 		if err != nil {
 			return err
 		}
-		err = netlink.LinkSetHardwareAddr(contVeth, hw)
-		if err != nil {
-			return err
+		if macAddress != "" {
+			hw, err := net.ParseMAC(macAddress)
+			if err != nil {
+				return err
+			}
+			err = netlink.LinkSetHardwareAddr(contVeth, hw)
+			if err != nil {
+				return err
+			}
 		}
 
 		hostVethName = hostVeth.Attrs().Name
@@ -65,34 +174,367 @@ func setupInterface(containerId string, netns ns.NetNS, ifName string, macAddres
 		return nil
 	})
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	// need to lookup hostVeth again as its index has changed during ns move
 	hostVeth, err := netlink.LinkByName(hostVethName)
 	if err != nil {
-		return "", fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
 	}
 
 	// set hairpin mode
-	if err = netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
-		return "", fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVethName, err)
+	if err = netlink.LinkSetHairpin(hostVeth, conf.HairpinMode); err != nil {
+		return fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVethName, err)
+	}
+	return netlink.LinkSetName(hostVeth, hostIfName)
+}
+
+// addTap creates the persistent tap device name the way "ip tuntap" does,
+// which the vendored netlink can not.
+func addTap(name string) error {
+	tun, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tun.Close()
+	// struct ifreq with ifr_flags.
+	var req struct {
+		Name  [unix.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte
+	}
+	copy(req.Name[:], name)
+	req.Flags = unix.IFF_TAP | unix.IFF_NO_PI
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, tun.Fd(), unix.TUNSETIFF, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, tun.Fd(), unix.TUNSETPERSIST, 1); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setupTap creates the tap device hostIfName in the host netns.
+func setupTap(conf *NetConf, hostIfName string) error {
+	return exec.Apply("create tap "+hostIfName, func() error {
+		if err := addTap(hostIfName); err != nil {
+			return fmt.Errorf("failed to create tap %v: %v", hostIfName, err)
+		}
+		link, err := netlink.LinkByName(hostIfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", hostIfName, err)
+		}
+		if err := netlink.LinkSetMTU(link, conf.MTU); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+}
+
+// macvtapLowerName returns the name of the pod end of the veth pair a
+// macvtap ifName sits on.
+func macvtapLowerName(ifName string) string {
+	name := "l" + ifName
+	if len(name) > 15 {
+		name = name[:15]
 	}
-	if err = netlink.LinkSetName(hostVeth, containerId[:15]); err != nil {
+	return name
+}
+
+// setupMacvtap creates a veth pair with hostIfName in the host netns, and
+// the macvtap ifName with macAddress on its end in the container.
+func setupMacvtap(conf *NetConf, netns ns.NetNS, ifName, hostIfName, macAddress string) error {
+	lower := macvtapLowerName(ifName)
+	if err := setupInterface(conf, netns, lower, hostIfName, ""); err != nil {
+		return err
+	}
+	hw, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return err
+	}
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(lower)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", lower, err)
+		}
+		macvtap := &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{
+			Name:        ifName,
+			ParentIndex: link.Attrs().Index,
+			MTU:         conf.MTU,
+			TxQLen:      -1,
+		}}}
+		if err := netlink.LinkAdd(macvtap); err != nil {
+			return fmt.Errorf("failed to create macvtap %v: %v", ifName, err)
+		}
+		if err := netlink.LinkSetHardwareAddr(macvtap, hw); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(macvtap)
+	})
+}
+
+// vhostUserDir returns the directory of the vhost-user sockets of the pod of
+// a sandbox.
+func vhostUserDir(conf *NetConf, containerID string) string {
+	dir := conf.VhostUserDir
+	if dir == "" {
+		dir = defaultVhostUserDir
+	}
+	return filepath.Join(dir, containerID)
+}
+
+// setupVhostUser checks that br-int has a userspace datapath and creates
+// the directory of the vhost-user socket of ifName.  It returns the socket.
+func setupVhostUser(conf *NetConf, containerID, ifName string) (string, error) {
+	re, err := exec.RunCommand("ovs-vsctl", "get", "bridge", "br-int", "datapath_type")
+	if err != nil {
 		return "", err
 	}
+	if len(re) == 0 || strings.Trim(re[0], "\"") != "netdev" {
+		return "", fmt.Errorf("br-int is not a netdev bridge")
+	}
+	dir := vhostUserDir(conf, containerID)
+	if err := exec.Apply("mkdir -p "+dir, func() error {
+		return os.MkdirAll(dir, 0755)
+	}); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ifName+".sock"), nil
+}
+
+// setupPodInterface attaches the pod interface ifName the way conf.Mode
+// says.  It returns the interface handed to the guest, nil for a veth that
+// is configured in the netns.
+func setupPodInterface(conf *NetConf, netns ns.NetNS, containerID, ifName, hostIfName, macAddress string) (*guestInterface, error) {
+	switch conf.Mode {
+	case modeDPDK:
+		socket, err := setupVhostUser(conf, containerID, ifName)
+		if err != nil {
+			return nil, err
+		}
+		return &guestInterface{Name: ifName, Mac: macAddress, Socket: socket}, nil
+	case modeTap:
+		if err := setupTap(conf, hostIfName); err != nil {
+			return nil, err
+		}
+		return &guestInterface{Name: hostIfName, Mac: macAddress}, nil
+	case modeMacvtap:
+		if err := setupMacvtap(conf, netns, ifName, hostIfName, macAddress); err != nil {
+			return nil, err
+		}
+		return &guestInterface{Name: ifName, Mac: macAddress, Sandbox: netns.Path()}, nil
+	default:
+		return nil, setupInterface(conf, netns, ifName, hostIfName, macAddress)
+	}
+}
 
-	return containerId[:15], nil
+// plugInterface adds the host end of a pod interface to br-int as the
+// logical switch port ifaceID.  containerID tags the port for cmdDel.  A
+// guest with a socket gets a vhost-user port connecting to it instead.
+func plugInterface(conf *NetConf, guest *guestInterface, hostIfName, ifaceID, macAddress, ipAddress, containerID string) error {
+	args := []string{"add-port", "br-int", hostIfName, "--", "set", "interface", hostIfName,
+		"external_ids:attached_mac=" + macAddress, "external_ids:iface-id=" + ifaceID, "external_ids:ip_address=" + ipAddress,
+		"external_ids:sandbox=" + containerID}
+	if guest != nil && guest.Socket != "" {
+		args = append(args, "type=dpdkvhostuserclient", "options:vhost-server-path="+guest.Socket,
+			"mtu_request="+strconv.Itoa(conf.MTU))
+	}
+	_, err := exec.RunCommand("ovs-vsctl", args...)
+	if err != nil {
+		return fmt.Errorf("Unable to plug interface into OVN bridge: %v", err)
+	}
+	return nil
+}
 
+// unplugInterface removes the host end of a pod interface from br-int.  The
+// tap devices, which outlive their users, are deleted as well.
+func unplugInterface(conf *NetConf, hostIfName string) error {
+	if _, err := exec.RunCommand("ovs-vsctl", "--if-exists", "del-port", hostIfName); err != nil {
+		return err
+	}
+	if conf.Mode != modeTap {
+		return nil
+	}
+	link, err := netlink.LinkByName(hostIfName)
+	if err != nil {
+		return nil
+	}
+	return exec.Apply("delete tap "+hostIfName, func() error {
+		return netlink.LinkDel(link)
+	})
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	conf := NetConf{}
+// removePodInterface undoes setupPodInterface and plugInterface of the pod
+// interface ifName with the host end hostIfName, as far as they got.  It
+// rolls back a failed cmdAdd, so errors are only reported.
+func removePodInterface(conf *NetConf, netns ns.NetNS, ifName, hostIfName string) {
+	if _, err := exec.RunCommand("ovs-vsctl", "--if-exists", "del-port", hostIfName); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to remove port %v: %v\n", hostIfName, err)
+	}
+	// Deleting either end of a veth pair deletes both and the macvtap on it.
+	// The host end may not have been renamed yet, so the pod end is deleted
+	// as well.
+	podIfName := ifName
+	if conf.Mode == modeMacvtap {
+		podIfName = macvtapLowerName(ifName)
+	}
+	err := exec.Apply("delete "+hostIfName, func() error {
+		if link, err := netlink.LinkByName(hostIfName); err == nil {
+			if err := netlink.LinkDel(link); err != nil {
+				return err
+			}
+		}
+		if conf.Mode == modeTap || conf.Mode == modeDPDK {
+			return nil
+		}
+		return netns.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(podIfName)
+			if err != nil {
+				return nil
+			}
+			return netlink.LinkDel(link)
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to delete %v: %v\n", hostIfName, err)
+	}
+}
+
+// attachmentHostIfName returns the host end name of the n-th additional
+// interface, at most 15 characters like containerId[:15] of the primary.
+func attachmentHostIfName(containerId string, n int) string {
+	return fmt.Sprintf("%s_%d", containerId[:12], n)
+}
+
+// setupAttachment creates and configures an additional interface of the
+// pod and adds it to current.  It only routes the subnets of the
+// attachment, never the default.  It returns the interface handed to the
+// guest, if any.
+func setupAttachment(conf *NetConf, netns ns.NetNS, containerId string, n int, attachment *common.PodAttachment, current *currentResult) (*guestInterface, error) {
+	ipc, ipnet, err := net.ParseCIDR(attachment.IPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip address of %v: %v", attachment.Interface, err)
+	}
+	ipnet.IP = ipc
+	ipg, _, err := net.ParseCIDR(attachment.GatewayIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway ip of %v: %v", attachment.Interface, err)
+	}
+	result := &types.Result{IP4: &types.IPConfig{IP: *ipnet, Gateway: ipg}}
+	for _, route := range attachment.Routes {
+		_, dst, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route of %v: %v", attachment.Interface, err)
+		}
+		result.IP4.Routes = append(result.IP4.Routes, types.Route{Dst: *dst, GW: ipg})
+	}
+
+	hostIfName := attachmentHostIfName(containerId, n)
+	guest, err := setupPodInterface(conf, netns, containerId, attachment.Interface, hostIfName, attachment.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	if guest == nil {
+		if err := netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(attachment.Interface, result)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := plugInterface(conf, guest, hostIfName, attachment.PortName, attachment.MacAddress, attachment.IPAddress, containerId); err != nil {
+		return nil, err
+	}
+	current.addInterface(netns, attachment.Interface, hostIfName, attachment.MacAddress, guest, result.IP4)
+	return guest, nil
+}
+
+// staticAddressMismatch returns why network does not hold the static
+// address and MAC the pod requests, or "".
+func staticAddressMismatch(pod *common.Pod, network *common.PodNetwork) string {
+	if value, ok := pod.Metadata.Annotations[common.IPAddressAnnotation]; ok {
+		requested := net.ParseIP(value)
+		ip, _, err := net.ParseCIDR(network.IPAddress)
+		if requested == nil || err != nil || !requested.Equal(ip) {
+			return fmt.Sprintf("ip address %v instead of the requested %v", network.IPAddress, value)
+		}
+	}
+	if value, ok := pod.Metadata.Annotations[common.MacAddressAnnotation]; ok {
+		requested, err := net.ParseMAC(value)
+		mac, err2 := net.ParseMAC(network.MacAddress)
+		if err != nil || err2 != nil || requested.String() != mac.String() {
+			return fmt.Sprintf("mac address %v instead of the requested %v", network.MacAddress, value)
+		}
+	}
+	return ""
+}
+
+// getPodNetwork waits for the controller to record the addressing of the
+// pod and returns it with the pod's additional interfaces.  The addressing
+// has to hold the static address the pod requests, if any.
+func getPodNetwork(k8sApiServer, namespace, podName string) (*common.PodNetwork, []common.PodAttachment, error) {
+	var pod *common.Pod
+	var network *common.PodNetwork
+	var err error
+	mismatch := ""
+	for counter := 30; counter > 0; counter-- {
+		pod, err = common.GetPod(k8sApiServer, namespace, podName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get pod annotation: %v", err)
+		}
+		if value, ok := pod.Metadata.Annotations[common.PodNetworkAnnotation]; ok {
+			network = &common.PodNetwork{}
+			if err := json.Unmarshal([]byte(value), network); err != nil {
+				return nil, nil, fmt.Errorf("invalid %v annotation: %v", common.PodNetworkAnnotation, err)
+			}
+			// The controller may not have caught up with a new request yet.
+			if mismatch = staticAddressMismatch(pod, network); mismatch == "" {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if network == nil {
+		return nil, nil, fmt.Errorf("pod %v/%v has no %v annotation", namespace, podName, common.PodNetworkAnnotation)
+	}
+	if mismatch != "" {
+		return nil, nil, fmt.Errorf("pod %v/%v was given %v", namespace, podName, mismatch)
+	}
+
+	// The additional interfaces are only waited for when requested.
+	if _, requested := pod.Metadata.Annotations[common.NetworksAnnotation]; requested {
+		for counter := 30; counter > 0; counter-- {
+			if _, ok := pod.Metadata.Annotations[common.AttachmentsAnnotation]; ok {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+			pod, err = common.GetPod(k8sApiServer, namespace, podName)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to get pod annotation: %v", err)
+			}
+		}
+	}
+	var attachments []common.PodAttachment
+	if value, ok := pod.Metadata.Annotations[common.AttachmentsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &attachments); err != nil {
+			return nil, nil, fmt.Errorf("invalid %v annotation: %v", common.AttachmentsAnnotation, err)
+		}
+	}
+	return network, attachments, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	conf := NetConf{MTU: defaultMTU}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
+	switch conf.Mode {
+	case "", modeVeth, modeTap, modeMacvtap, modeDPDK:
+	default:
+		return fmt.Errorf("unknown mode %q", conf.Mode)
+	}
 
-	re, err := exec.RunCommand("--if-exists", "get", "Open_vSwitch", ".", "external_ids:k8s-api-server")
+	re, err := exec.RunCommand("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "external_ids:k8s-api-server")
 	if err != nil || re == nil {
 		if err != nil {
 			return err
@@ -106,7 +548,10 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	cniArgsMap := make(map[string]string)
 	for _, cniArg := range strings.Split(args.Args, ";") {
-		cniArgsMap[strings.Split(cniArg, "=")[0]] = strings.Split(cniArg, "=")[1]
+		kv := strings.SplitN(cniArg, "=", 2)
+		if len(kv) == 2 {
+			cniArgsMap[kv[0]] = kv[1]
+		}
 	}
 	namespace, ok := cniArgsMap["K8S_POD_NAMESPACE"]
 	if !ok {
@@ -121,40 +566,33 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("there is no key K8S_POD_INFRA_CONTAINER_ID")
 	}
 
-	counter := 30
-	var annotations map[string]interface{}
-	for ; counter > 0; counter-- {
-		annotations, err := common.GetPodAnnotations(k8sApiServer, namespace, podName)
-		if err != nil {
-			return fmt.Errorf("failed to get pod annotation: %v", err)
-		}
-		if annotations != nil {
-			if ovn, ok := annotations["ovn"]; ok {
-				break
-			}
-		}
-		time.Sleep(100 * time.Millisecond)
+	ovn, attachments, err := getPodNetwork(k8sApiServer, namespace, podName)
+	if err != nil {
+		return err
 	}
-	ovn := annotations["ovn"].(map[string]string)
-	macAddress, ok := ovn["mac_address"]
-	if !ok {
+	macAddress := ovn.MacAddress
+	if macAddress == "" {
 		return fmt.Errorf("missing key macAddress")
 	}
-	ipAddress, ok := ovn["ip_address"]
-	if !ok {
+	ipAddress := ovn.IPAddress
+	if ipAddress == "" {
 		return fmt.Errorf("missing key ipAddress")
 	}
-	gatewayIp, ok := ovn["gateway_ip"]
-	if !ok {
+	gatewayIp := ovn.GatewayIP
+	if gatewayIp == "" {
 		return fmt.Errorf("missing key gatewayIp")
 	}
-	var result *types.Result
-	ipc, ipnet, _ := net.ParseCIDR(ipAddress)
+	ipc, ipnet, err := net.ParseCIDR(ipAddress)
+	if err != nil {
+		return fmt.Errorf("invalid ipAddress %v: %v", ipAddress, err)
+	}
 	ipg, _, err := net.ParseCIDR(gatewayIp)
+	if err != nil {
+		return fmt.Errorf("invalid gatewayIp %v: %v", gatewayIp, err)
+	}
 
 	ipnet.IP = ipc
-	result.IP4.IP = *ipnet
-	result.IP4.Gateway = ipg
+	result := &types.Result{IP4: &types.IPConfig{IP: *ipnet, Gateway: ipg}}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -162,49 +600,108 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	vethOutside, err := setupInterface(containerId, netns, args.IfName, macAddress)
+	// What was set up is removed again when a later step fails, so that the
+	// runtime's retry starts clean.
+	type podInterface struct{ ifName, hostIfName string }
+	var made []podInterface
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(made) - 1; i >= 0; i-- {
+			removePodInterface(&conf, netns, made[i].ifName, made[i].hostIfName)
+		}
+		if conf.Mode == modeDPDK {
+			if _, err := exec.RunCommand("rm", "-rf", vhostUserDir(&conf, containerId)); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to remove the vhost-user sockets: %v\n", err)
+			}
+		}
+	}()
+
+	vethOutside := containerId[:15]
+	made = append(made, podInterface{args.IfName, vethOutside})
+	guest, err := setupPodInterface(&conf, netns, containerId, args.IfName, vethOutside, macAddress)
+	if err != nil {
+		return err
+	}
+	// Only the primary interface carries the default route.  The guest of a
+	// tap, macvtap or vhost-user port configures its interface itself.
+	_, defaultNet, err := net.ParseCIDR("0.0.0.0/0")
 	if err != nil {
 		return err
 	}
+	result.IP4.Routes = append(
+		result.IP4.Routes,
+		types.Route{Dst: *defaultNet, GW: result.IP4.Gateway},
+	)
 	if err := netns.Do(func(_ ns.NetNS) error {
-		// set the default gateway if requested
-		if n.IsDefaultGW {
-			_, defaultNet, err := net.ParseCIDR("0.0.0.0/0")
-			if err != nil {
-				return err
-			}
-
-			for _, route := range result.IP4.Routes {
-				if defaultNet.String() == route.Dst.String() {
-					if route.GW != nil && !route.GW.Equal(result.IP4.Gateway) {
-						return fmt.Errorf(
-							"isDefaultGateway ineffective because IPAM sets default route via %q",
-							route.GW,
-						)
-					}
-				}
-			}
-
-			result.IP4.Routes = append(
-				result.IP4.Routes,
-				types.Route{Dst: *defaultNet, GW: result.IP4.Gateway},
-			)
-
-			// TODO: IPV6
+		if guest != nil {
+			return nil
 		}
+		// TODO: IPV6
 
-		return ipam.ConfigureIface(args.IfName, result)
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+		if conf.Metadata != common.MetadataModeLocalport {
+			return nil
+		}
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return err
+		}
+		return netlink.RouteAdd(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       &net.IPNet{IP: net.ParseIP(common.MetadataIP), Mask: net.CIDRMask(32, 32)},
+		})
 	}); err != nil {
 		return err
 	}
 
-	ifaceId := namespace + "_" + podName
+	ifaceId := ovn.IfaceID
+	if ifaceId == "" {
+		ifaceId = namespace + "_" + podName
+	}
+	if err := plugInterface(&conf, guest, vethOutside, ifaceId, macAddress, ipAddress, containerId); err != nil {
+		return err
+	}
 
-	_, err = exec.RunCommand("ovs-vsctl", "add-port", "br-int", vethOutside, "--", "set", "interface", vethOutside, "external_ids:attached_mac="+macAddress, "external_ids:iface-id="+ifaceId, "external_ids:ip_address="+ipAddress)
-	if err != nil {
-		return fmt.Errorf("Unable to plug interface into OVN bridge: %v", err)
+	current := &currentResult{CNIVersion: conf.CNIVersion}
+	current.addInterface(netns, args.IfName, vethOutside, macAddress, guest, result.IP4)
+	var vhostUser []common.VhostUserInterface
+	if guest != nil {
+		if guest.Socket != "" {
+			vhostUser = append(vhostUser, common.VhostUserInterface{Interface: args.IfName, Socket: guest.Socket, MacAddress: macAddress, IPAddress: ipAddress})
+		}
 	}
-	return nil
+	for i := range attachments {
+		attachment := &attachments[i]
+		made = append(made, podInterface{attachment.Interface, attachmentHostIfName(containerId, i+1)})
+		guest, err := setupAttachment(&conf, netns, containerId, i+1, attachment, current)
+		if err != nil {
+			return fmt.Errorf("failed to set up %v: %v", attachment.Interface, err)
+		}
+		if guest != nil && guest.Socket != "" {
+			vhostUser = append(vhostUser, common.VhostUserInterface{Interface: attachment.Interface, Socket: guest.Socket, MacAddress: attachment.MacAddress, IPAddress: attachment.IPAddress})
+		}
+	}
+	if len(vhostUser) > 0 {
+		// The workload finds the sockets to serve through the annotation.
+		value, err := json.Marshal(vhostUser)
+		if err != nil {
+			return err
+		}
+		if err := exec.Apply("annotate pod "+namespace+"/"+podName+" with its vhost-user sockets", func() error {
+			return common.PatchPodAnnotations(k8sApiServer, namespace, podName, map[string]string{common.VhostUserAnnotation: string(value)})
+		}); err != nil {
+			return fmt.Errorf("failed to annotate pod: %v", err)
+		}
+	}
+	if legacyVersions[conf.CNIVersion] {
+		return result.Print()
+	}
+	return current.Print()
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -216,6 +713,14 @@ func cmdDel(args *skel.CmdArgs) error {
 	if args.Netns != "" {
 		fmt.Fprintf(os.Stderr, "Calico CNI deleting device in netns %s\n", args.Netns)
 		err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			switch conf.Mode {
+			case modeTap, modeDPDK:
+				// Nothing of the pod is in its netns.
+				return nil
+			case modeMacvtap:
+				// Deleting the veth deletes the macvtap on it.
+				return ip.DelLinkByName(macvtapLowerName(args.IfName))
+			}
 			_, err := ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_V4)
 			return err
 		})
@@ -224,10 +729,29 @@ func cmdDel(args *skel.CmdArgs) error {
 			return err
 		}
 	}
-	_, err := exec.RunCommand("ovs-vsctl", "del-port", args.ContainerID[:15])
+	if err := unplugInterface(&conf, args.ContainerID[:15]); err != nil {
+		return err
+	}
+	// The additional interfaces are found through the sandbox they were
+	// plugged for.
+	re, err := exec.RunCommand("ovs-vsctl", "--data=bare", "--no-heading", "--columns=name", "find", "interface", "external_ids:sandbox="+args.ContainerID)
 	if err != nil {
 		return err
 	}
+	for _, port := range re {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+		if err := unplugInterface(&conf, port); err != nil {
+			return err
+		}
+	}
+	if conf.Mode == modeDPDK {
+		if _, err := exec.RunCommand("rm", "-rf", vhostUserDir(&conf, args.ContainerID)); err != nil {
+			return err
+		}
+	}
 	_, err = exec.RunCommand("rm", "-f", "/var/run/netns/"+args.ContainerID[:15])
 	if err != nil {
 		return err
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
 	"github.com/mozhuli/ovn-stackube/pkg/ovnctl/cmd"
 	"github.com/spf13/cobra"
 )
@@ -11,14 +12,24 @@ func Run() error {
 		Short: "run ovnctl",
 		Long:  `run ovnctl to init master, minion, gateway`,
 	}
+	rootCmd.PersistentFlags().BoolVar(&exec.DryRun, "dry-run", false, "Print the commands and file writes that would change the system instead of running them.  Queries still read the real system, without the printed changes, so steps that depend on earlier ones may be planned differently than a real run does them.")
+	rootCmd.PersistentFlags().BoolVar(&exec.Trace, "trace", false, "Log every executed command with its duration.")
 
 	masterCmd := cmd.InitMaster()
 	minionCmd := cmd.InitMinion()
 	gatewayCmd := cmd.InitGateway()
+	deleteGatewayCmd := cmd.DeleteGateway()
+	bridgeCmd := cmd.InitBridge()
+	controllerCmd := cmd.InitController()
+	metadataProxyCmd := cmd.InitMetadataProxy()
 
 	rootCmd.AddCommand(masterCmd)
 	rootCmd.AddCommand(minionCmd)
 	rootCmd.AddCommand(gatewayCmd)
+	rootCmd.AddCommand(deleteGatewayCmd)
+	rootCmd.AddCommand(bridgeCmd)
+	rootCmd.AddCommand(controllerCmd)
+	rootCmd.AddCommand(metadataProxyCmd)
 
 	return rootCmd.Execute()
 }
@@ -1,31 +1,31 @@
 package common
 
 import (
+	"crypto/rand"
 	"fmt"
-	"math/big"
-	"math/rand"
 	"net"
 )
 
-func GenerateMac() string {
-	prefix := "00:00:00"
-	mac := fmt.Sprintf("%s:%02X:%02X:%02X", prefix, rand.Intn(255), rand.Intn(255), rand.Intn(255))
-	return mac
-}
+// macPrefix is the first byte of generated MAC addresses.  It has the
+// locally administered bit set and the multicast bit cleared.
+const macPrefix = 0x0a
 
-// NextIP returns IP incremented by 1
-func NextIP(ip net.IP) net.IP {
-	i := ipToInt(ip)
-	return intToIP(i.Add(i, big.NewInt(1)))
+// GenerateMac returns a random locally administered unicast MAC address.
+func GenerateMac() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	return net.HardwareAddr(append([]byte{macPrefix}, buf...)).String(), nil
 }
 
-func ipToInt(ip net.IP) *big.Int {
+// IPToMac derives a locally administered unicast MAC address from ip, so
+// the same address always gets the same MAC.  The last four bytes of the
+// MAC are the last four bytes of ip.
+func IPToMac(ip net.IP) string {
 	if v := ip.To4(); v != nil {
-		return big.NewInt(0).SetBytes(v)
+		ip = v
 	}
-	return big.NewInt(0).SetBytes(ip.To16())
-}
-
-func intToIP(i *big.Int) net.IP {
-	return net.IP(i.Bytes())
+	suffix := ip[len(ip)-4:]
+	return net.HardwareAddr(append([]byte{macPrefix, 0x58}, suffix...)).String()
 }
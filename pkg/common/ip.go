@@ -0,0 +1,240 @@
+package common
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+)
+
+// maxAllocatorSize is the largest number of addresses an IPAllocator tracks,
+// those of an IPv4 /8, so that an IPv6 subnet does not need a bitmap of 2^64
+// bits.  NewIPAllocator refuses larger subnets.
+const maxAllocatorSize = 1 << 24
+
+// NextIP returns IP incremented by 1
+func NextIP(ip net.IP) net.IP {
+	return AddIP(ip, 1)
+}
+
+// PrevIP returns IP decremented by 1
+func PrevIP(ip net.IP) net.IP {
+	return AddIP(ip, -1)
+}
+
+// AddIP returns ip moved by offset addresses.  The result keeps the length
+// of ip's family and wraps around at the ends of the address space.
+func AddIP(ip net.IP, offset int64) net.IP {
+	i := ipToInt(ip)
+	return intToIP(i.Add(i, big.NewInt(offset)), ipLen(ip))
+}
+
+// IPOffset returns the number of addresses between the start of subnet and
+// ip.  IPv6 offsets do not fit an int64.
+func IPOffset(subnet *net.IPNet, ip net.IP) *big.Int {
+	i := ipToInt(ip)
+	return i.Sub(i, ipToInt(subnet.IP))
+}
+
+// NetworkIP returns the first address of subnet.
+func NetworkIP(subnet *net.IPNet) net.IP {
+	return subnet.IP.Mask(subnet.Mask)
+}
+
+// BroadcastIP returns the last address of subnet.
+func BroadcastIP(subnet *net.IPNet) net.IP {
+	network := NetworkIP(subnet)
+	mask := subnet.Mask
+	if len(mask) == net.IPv6len && len(network) == net.IPv4len {
+		mask = mask[12:]
+	}
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+// FirstIP returns the first usable address of subnet.  The network address
+// is skipped unless the subnet is too small to have one.
+func FirstIP(subnet *net.IPNet) net.IP {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return NetworkIP(subnet)
+	}
+	return NextIP(NetworkIP(subnet))
+}
+
+// LastIP returns the last usable address of subnet.  For IPv4 the broadcast
+// address is skipped unless the subnet is too small to have one.
+func LastIP(subnet *net.IPNet) net.IP {
+	ones, bits := subnet.Mask.Size()
+	if bits != 8*net.IPv4len || bits-ones < 2 {
+		return BroadcastIP(subnet)
+	}
+	return PrevIP(BroadcastIP(subnet))
+}
+
+// SubnetSize returns the number of addresses in subnet.
+func SubnetSize(subnet *net.IPNet) *big.Int {
+	ones, bits := subnet.Mask.Size()
+	return big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// Overlap reports whether the subnets a and b share any address.
+func Overlap(a, b *net.IPNet) bool {
+	return a.Contains(NetworkIP(b)) || b.Contains(NetworkIP(a))
+}
+
+// SplitSubnet splits subnet into all its subnets of the given prefix length.
+func SplitSubnet(subnet *net.IPNet, prefix int) ([]*net.IPNet, error) {
+	ones, bits := subnet.Mask.Size()
+	if prefix < ones || prefix > bits {
+		return nil, fmt.Errorf("can not split %v into /%d subnets", subnet, prefix)
+	}
+	if prefix-ones > 16 {
+		return nil, fmt.Errorf("splitting %v into /%d subnets gives too many subnets", subnet, prefix)
+	}
+	count := 1 << uint(prefix-ones)
+	step := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-prefix))
+	start := ipToInt(NetworkIP(subnet))
+	subnets := make([]*net.IPNet, 0, count)
+	for i := 0; i < count; i++ {
+		subnets = append(subnets, &net.IPNet{
+			IP:   intToIP(start, len(subnet.Mask)),
+			Mask: net.CIDRMask(prefix, bits),
+		})
+		start = big.NewInt(0).Add(start, step)
+	}
+	return subnets, nil
+}
+
+// ParseIPNet parses s as a CIDR and returns the subnet with the address of
+// s kept, e.g. "10.0.0.1/24" gives 10.0.0.1 with a /24 mask.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if v := ip.To4(); v != nil {
+		ip = v
+	}
+	subnet.IP = ip
+	return subnet, nil
+}
+
+func ipLen(ip net.IP) int {
+	if ip.To4() != nil {
+		return net.IPv4len
+	}
+	return net.IPv6len
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v := ip.To4(); v != nil {
+		return big.NewInt(0).SetBytes(v)
+	}
+	return big.NewInt(0).SetBytes(ip.To16())
+}
+
+// intToIP converts i to an IP of length bytes, keeping the leading zero
+// bytes that big.Int.Bytes drops.
+func intToIP(i *big.Int, length int) net.IP {
+	modulus := big.NewInt(0).Lsh(big.NewInt(1), uint(8*length))
+	i = big.NewInt(0).Mod(i, modulus)
+	ip := make(net.IP, length)
+	b := i.Bytes()
+	copy(ip[length-len(b):], b)
+	return ip
+}
+
+// IPAllocator hands out addresses of a subnet, tracking the used ones in a
+// bitmap.  It works for both IPv4 and IPv6 subnets of up to 2^24 addresses.
+type IPAllocator struct {
+	subnet *net.IPNet
+	base   net.IP
+	size   int64
+	used   *big.Int
+}
+
+// NewIPAllocator returns an allocator for the usable addresses of subnet.  It
+// fails for subnets of more than 2^24 addresses rather than handing out only
+// part of them.
+func NewIPAllocator(subnet *net.IPNet) (*IPAllocator, error) {
+	first := FirstIP(subnet)
+	size := big.NewInt(0).Sub(ipToInt(LastIP(subnet)), ipToInt(first))
+	size.Add(size, big.NewInt(1))
+	if size.Cmp(big.NewInt(maxAllocatorSize)) > 0 {
+		return nil, fmt.Errorf("subnet %v has more than %d addresses to allocate", subnet, maxAllocatorSize)
+	}
+	return &IPAllocator{
+		subnet: subnet,
+		base:   first,
+		size:   size.Int64(),
+		used:   big.NewInt(0),
+	}, nil
+}
+
+// Subnet returns the subnet the allocator hands out addresses from.
+func (a *IPAllocator) Subnet() *net.IPNet {
+	return a.subnet
+}
+
+func (a *IPAllocator) index(ip net.IP) (int, error) {
+	if !a.subnet.Contains(ip) {
+		return 0, fmt.Errorf("ip %v is not in subnet %v", ip, a.subnet)
+	}
+	i := big.NewInt(0).Sub(ipToInt(ip), ipToInt(a.base))
+	if i.Sign() < 0 || i.Cmp(big.NewInt(a.size)) >= 0 {
+		return 0, fmt.Errorf("ip %v is not in the allocatable range of %v", ip, a.subnet)
+	}
+	return int(i.Int64()), nil
+}
+
+// Allocate returns the lowest free address and marks it used.
+func (a *IPAllocator) Allocate() (net.IP, error) {
+	for i := 0; i < int(a.size); i++ {
+		if a.used.Bit(i) == 0 {
+			a.used.SetBit(a.used, i, 1)
+			return AddIP(a.base, int64(i)), nil
+		}
+	}
+	return nil, fmt.Errorf("no free ip address left in %v", a.subnet)
+}
+
+// AllocateIP marks ip used.  It fails if ip is outside the subnet or already
+// used.
+func (a *IPAllocator) AllocateIP(ip net.IP) error {
+	i, err := a.index(ip)
+	if err != nil {
+		return err
+	}
+	if a.used.Bit(i) == 1 {
+		return fmt.Errorf("ip %v is already allocated", ip)
+	}
+	a.used.SetBit(a.used, i, 1)
+	return nil
+}
+
+// Release marks ip free again.  Releasing a free or foreign address is a
+// no-op.
+func (a *IPAllocator) Release(ip net.IP) {
+	if i, err := a.index(ip); err == nil {
+		a.used.SetBit(a.used, i, 0)
+	}
+}
+
+// Has reports whether ip is allocated.
+func (a *IPAllocator) Has(ip net.IP) bool {
+	i, err := a.index(ip)
+	return err == nil && a.used.Bit(i) == 1
+}
+
+// Free returns the number of free addresses.
+func (a *IPAllocator) Free() int {
+	used := 0
+	for _, word := range a.used.Bits() {
+		used += bits.OnesCount(uint(word))
+	}
+	return int(a.size) - used
+}
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("failed parse %v: %v", s, err)
+	}
+	return subnet
+}
+
+func TestAddIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		offset int64
+		want   string
+	}{
+		{"10.0.0.1", 1, "10.0.0.2"},
+		{"10.0.0.255", 1, "10.0.1.0"},
+		{"10.0.1.0", -1, "10.0.0.255"},
+		{"0.0.0.1", 1, "0.0.0.2"},
+		{"0.0.0.0", 256, "0.0.1.0"},
+		{"255.255.255.255", 1, "0.0.0.0"},
+		{"0.0.0.0", -1, "255.255.255.255"},
+		{"fd00::1", 1, "fd00::2"},
+		{"fd00::ffff", 1, "fd00::1:0"},
+		{"::1", 1, "::2"},
+		{"::", -1, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", 1, "::"},
+	}
+	for _, test := range tests {
+		got := AddIP(net.ParseIP(test.ip), test.offset)
+		if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("AddIP(%v, %d) = %v, want %v", test.ip, test.offset, got, test.want)
+		}
+		if want := ipLen(net.ParseIP(test.ip)); len(got) != want {
+			t.Errorf("AddIP(%v, %d) has length %d, want %d", test.ip, test.offset, len(got), want)
+		}
+	}
+}
+
+func TestNextPrevIP(t *testing.T) {
+	tests := []struct {
+		ip, next, prev string
+	}{
+		{"10.0.0.0", "10.0.0.1", "9.255.255.255"},
+		{"0.0.0.0", "0.0.0.1", "255.255.255.255"},
+		{"255.255.255.255", "0.0.0.0", "255.255.255.254"},
+		{"::", "::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"::ff", "::100", "::fe"},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if got := NextIP(ip); !got.Equal(net.ParseIP(test.next)) {
+			t.Errorf("NextIP(%v) = %v, want %v", test.ip, got, test.next)
+		}
+		if got := PrevIP(ip); !got.Equal(net.ParseIP(test.prev)) {
+			t.Errorf("PrevIP(%v) = %v, want %v", test.ip, got, test.prev)
+		}
+	}
+}
+
+func TestFirstLastIP(t *testing.T) {
+	tests := []struct {
+		subnet, first, last string
+	}{
+		{"10.0.0.0/24", "10.0.0.1", "10.0.0.254"},
+		{"10.0.0.0/30", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.0/31", "10.0.0.0", "10.0.0.1"},
+		{"10.0.0.7/32", "10.0.0.7", "10.0.0.7"},
+		{"fd00::/64", "fd00::1", "fd00::ffff:ffff:ffff:ffff"},
+		{"fd00::/127", "fd00::", "fd00::1"},
+		{"fd00::5/128", "fd00::5", "fd00::5"},
+	}
+	for _, test := range tests {
+		subnet := mustParseCIDR(t, test.subnet)
+		if got := FirstIP(subnet); !got.Equal(net.ParseIP(test.first)) {
+			t.Errorf("FirstIP(%v) = %v, want %v", test.subnet, got, test.first)
+		}
+		if got := LastIP(subnet); !got.Equal(net.ParseIP(test.last)) {
+			t.Errorf("LastIP(%v) = %v, want %v", test.subnet, got, test.last)
+		}
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"10.0.0.0/16", "10.0.5.0/24", true},
+		{"10.0.5.0/24", "10.0.0.0/16", true},
+		{"10.0.0.0/24", "10.0.0.0/24", true},
+		{"10.0.0.0/24", "10.0.1.0/24", false},
+		{"10.0.0.0/25", "10.0.0.128/25", false},
+		{"10.0.0.1/32", "10.0.0.0/31", true},
+		{"fd00::/64", "fd00::/48", true},
+		{"fd00::/64", "fd00:0:0:1::/64", false},
+	}
+	for _, test := range tests {
+		if got := Overlap(mustParseCIDR(t, test.a), mustParseCIDR(t, test.b)); got != test.want {
+			t.Errorf("Overlap(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSplitSubnet(t *testing.T) {
+	tests := []struct {
+		subnet string
+		prefix int
+		want   []string
+	}{
+		{"10.0.0.0/24", 24, []string{"10.0.0.0/24"}},
+		{"10.0.0.0/24", 26, []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/26"}},
+		{"10.0.0.0/31", 32, []string{"10.0.0.0/32", "10.0.0.1/32"}},
+		{"0.0.0.0/0", 1, []string{"0.0.0.0/1", "128.0.0.0/1"}},
+		{"fd00::/63", 64, []string{"fd00::/64", "fd00:0:0:1::/64"}},
+		{"10.0.0.0/24", 23, nil},
+		{"10.0.0.0/24", 33, nil},
+		{"10.0.0.0/8", 25, nil},
+	}
+	for _, test := range tests {
+		subnets, err := SplitSubnet(mustParseCIDR(t, test.subnet), test.prefix)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("SplitSubnet(%v, %d) succeeded, want an error", test.subnet, test.prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SplitSubnet(%v, %d) failed: %v", test.subnet, test.prefix, err)
+			continue
+		}
+		if len(subnets) != len(test.want) {
+			t.Errorf("SplitSubnet(%v, %d) = %v, want %v", test.subnet, test.prefix, subnets, test.want)
+			continue
+		}
+		for i, subnet := range subnets {
+			if subnet.String() != test.want[i] {
+				t.Errorf("SplitSubnet(%v, %d)[%d] = %v, want %v", test.subnet, test.prefix, i, subnet, test.want[i])
+			}
+		}
+	}
+}
+
+func TestIPAllocator(t *testing.T) {
+	allocator, err := NewIPAllocator(mustParseCIDR(t, "10.0.0.0/29"))
+	if err != nil {
+		t.Fatalf("NewIPAllocator(10.0.0.0/29) failed: %v", err)
+	}
+	if free := allocator.Free(); free != 6 {
+		t.Fatalf("Free() = %d, want 6", free)
+	}
+	for _, ip := range []string{"10.0.0.0", "10.0.0.7", "10.0.1.1"} {
+		if err := allocator.AllocateIP(net.ParseIP(ip)); err == nil {
+			t.Errorf("AllocateIP(%v) succeeded outside the allocatable range", ip)
+		}
+	}
+	if err := allocator.AllocateIP(net.ParseIP("10.0.0.2")); err != nil {
+		t.Fatalf("AllocateIP(10.0.0.2) failed: %v", err)
+	}
+	if err := allocator.AllocateIP(net.ParseIP("10.0.0.2")); err == nil {
+		t.Errorf("AllocateIP(10.0.0.2) succeeded twice")
+	}
+
+	var got []string
+	for {
+		ip, err := allocator.Allocate()
+		if err != nil {
+			break
+		}
+		got = append(got, ip.String())
+	}
+	want := []string{"10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}
+	if len(got) != len(want) {
+		t.Fatalf("Allocate() gave %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Allocate() gave %v, want %v", got, want)
+			break
+		}
+	}
+	if free := allocator.Free(); free != 0 {
+		t.Errorf("Free() = %d, want 0", free)
+	}
+
+	allocator.Release(net.ParseIP("10.0.0.4"))
+	allocator.Release(net.ParseIP("10.0.0.4"))
+	allocator.Release(net.ParseIP("192.168.0.1"))
+	if allocator.Has(net.ParseIP("10.0.0.4")) || allocator.Free() != 1 {
+		t.Errorf("Release(10.0.0.4) left %d free addresses, want 1", allocator.Free())
+	}
+	if ip, err := allocator.Allocate(); err != nil || !ip.Equal(net.ParseIP("10.0.0.4")) {
+		t.Errorf("Allocate() = %v, %v after Release, want 10.0.0.4", ip, err)
+	}
+}
+
+func TestIPAllocatorCap(t *testing.T) {
+	tests := []struct {
+		subnet string
+		free   int
+		last   string
+		fails  bool
+	}{
+		{"10.0.0.0/8", maxAllocatorSize - 2, "10.255.255.254", false},
+		{"10.0.0.0/7", 0, "", true},
+		{"fd00::/104", maxAllocatorSize - 1, "fd00::ff:ffff", false},
+		{"fd00::/103", 0, "", true},
+		{"fd00::/64", 0, "", true},
+	}
+	for _, test := range tests {
+		allocator, err := NewIPAllocator(mustParseCIDR(t, test.subnet))
+		if test.fails {
+			if err == nil {
+				t.Errorf("NewIPAllocator(%v) succeeded beyond the cap", test.subnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewIPAllocator(%v) failed: %v", test.subnet, err)
+			continue
+		}
+		if free := allocator.Free(); free != test.free {
+			t.Errorf("NewIPAllocator(%v).Free() = %d, want %d", test.subnet, free, test.free)
+		}
+		if err := allocator.AllocateIP(net.ParseIP(test.last)); err != nil {
+			t.Errorf("NewIPAllocator(%v).AllocateIP(%v) failed: %v", test.subnet, test.last, err)
+		}
+		if free := allocator.Free(); free != test.free-1 {
+			t.Errorf("NewIPAllocator(%v).Free() = %d after AllocateIP, want %d", test.subnet, free, test.free-1)
+		}
+		if err := allocator.AllocateIP(NextIP(net.ParseIP(test.last))); err == nil {
+			t.Errorf("NewIPAllocator(%v).AllocateIP(%v) succeeded beyond the last address", test.subnet, NextIP(net.ParseIP(test.last)))
+		}
+	}
+}
+
+func TestIPOffset(t *testing.T) {
+	tests := []struct {
+		subnet string
+		ip     string
+		want   string
+	}{
+		{"10.0.0.0/8", "10.0.1.2", "258"},
+		{"10.0.0.0/8", "10.255.255.255", "16777215"},
+		{"::/0", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "340282366920938463463374607431768211455"},
+	}
+	for _, test := range tests {
+		if got := IPOffset(mustParseCIDR(t, test.subnet), net.ParseIP(test.ip)); got.String() != test.want {
+			t.Errorf("IPOffset(%v, %v) = %v, want %v", test.subnet, test.ip, got, test.want)
+		}
+	}
+}
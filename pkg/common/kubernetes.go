@@ -1,14 +1,272 @@
 package common
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 var CA_CERTIFICATE = "/etc/openvswitch/k8s-ca.crt"
 
+// ObjectMeta is the part of a Kubernetes object's metadata used here.
+type ObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	UID         string            `json:"uid,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Pod is the part of a Kubernetes pod used here.
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// Namespace is the part of a Kubernetes namespace used here.
+type Namespace struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+// Service is the part of a Kubernetes service used here.
+type Service struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		ClusterIP string `json:"clusterIP"`
+	} `json:"spec"`
+}
+
+// NodeCondition is a condition of a Kubernetes node.
+type NodeCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// Node is the part of a Kubernetes node used here.
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Status   struct {
+		Conditions []NodeCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+// Ready reports whether the node's Ready condition is true.
+func (n *Node) Ready() bool {
+	for _, condition := range n.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
+
+// StatusError is returned for API requests that did not succeed.
+type StatusError struct {
+	Method string
+	URL    string
+	Status string
+	Code   int
+	Body   []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %v returned %v: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// IsNotFound reports whether err is a 404 from the API server.
+func IsNotFound(err error) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func getJSON(url string, v interface{}) error {
+	//TODO support https
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fail read data from response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Method: "GET", URL: url, Status: resp.Status, Code: resp.StatusCode, Body: body}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("fail Unmarshal json from %v: %v", url, err)
+	}
+	return nil
+}
+
+// patchJSON applies patch to the object at url as a JSON merge patch.
+func patchJSON(url string, patch interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Method: "PATCH", URL: url, Status: resp.Status, Code: resp.StatusCode, Body: body}
+	}
+	return nil
+}
+
+// postJSON creates the object v in the collection at url.
+func postJSON(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Method: "POST", URL: url, Status: resp.Status, Code: resp.StatusCode, Body: body}
+	}
+	return nil
+}
+
+// ListPods returns the pods of all namespaces.
+func ListPods(server string) ([]Pod, error) {
+	var list struct {
+		Items []Pod `json:"items"`
+	}
+	if err := getJSON(server+"/api/v1/pods", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// GetPod returns the pod name of namespace.
+func GetPod(server, namespace, name string) (*Pod, error) {
+	pod := &Pod{}
+	if err := getJSON(server+"/api/v1/namespaces/"+namespace+"/pods/"+name, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// ListNamespaces returns all the namespaces.
+func ListNamespaces(server string) ([]Namespace, error) {
+	var list struct {
+		Items []Namespace `json:"items"`
+	}
+	if err := getJSON(server+"/api/v1/namespaces", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// ListNodes returns all the nodes.
+func ListNodes(server string) ([]Node, error) {
+	var list struct {
+		Items []Node `json:"items"`
+	}
+	if err := getJSON(server+"/api/v1/nodes", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// ListServices returns the services of all namespaces.
+func ListServices(server string) ([]Service, error) {
+	var list struct {
+		Items []Service `json:"items"`
+	}
+	if err := getJSON(server+"/api/v1/services", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// PatchPodAnnotations merges annotations into the annotations of a pod.  An
+// empty value removes the annotation.
+func PatchPodAnnotations(server, namespace, pod string, annotations map[string]string) error {
+	values := make(map[string]interface{}, len(annotations))
+	for k, v := range annotations {
+		if v == "" {
+			values[k] = nil
+		} else {
+			values[k] = v
+		}
+	}
+	url := server + "/api/v1/namespaces/" + namespace + "/pods/" + pod
+	return patchJSON(url, map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": values},
+	})
+}
+
+// ObjectReference points an event to the object it is about.
+type ObjectReference struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+}
+
+// Event is a Kubernetes event.
+type Event struct {
+	Metadata       ObjectMeta      `json:"metadata"`
+	InvolvedObject ObjectReference `json:"involvedObject"`
+	Reason         string          `json:"reason"`
+	Message        string          `json:"message"`
+	// Type is "Normal" or "Warning".
+	Type   string `json:"type"`
+	Source struct {
+		Component string `json:"component"`
+	} `json:"source"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	Count          int       `json:"count"`
+}
+
+// RecordEvent creates a Warning event about object from component.
+func RecordEvent(server, component string, object ObjectReference, reason, message string) error {
+	event := &Event{
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           "Warning",
+		FirstTimestamp: time.Now(),
+		LastTimestamp:  time.Now(),
+		Count:          1,
+	}
+	// The events of cluster scoped objects, such as Networks, go to the
+	// default namespace.
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	event.Metadata.Namespace = namespace
+	event.Metadata.Name = fmt.Sprintf("%v.%x", object.Name, time.Now().UnixNano())
+	event.Source.Component = component
+	return postJSON(server+"/api/v1/namespaces/"+namespace+"/events", event)
+}
+
 func GetPodAnnotations(server, namespace, pod string) (map[string]interface{}, error) {
 	//TODO support https
 	//caCertificate, apiToken := getApiParams()
@@ -31,13 +289,11 @@ func GetPodAnnotations(server, namespace, pod string) (map[string]interface{}, e
 	var podinfo map[string]interface{}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Errorf("fail read data from response: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("fail read data from response: %v", err)
 	}
 	err = json.Unmarshal(body, &podinfo)
 	if err != nil {
-		fmt.Errorf("fail Unmarshal json to podinfo: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("fail Unmarshal json to podinfo: %v", err)
 	}
 	metadata := podinfo["metadata"].(map[string]interface{})
 	annotations := metadata["annotations"].(map[string]interface{})
@@ -0,0 +1,25 @@
+package common
+
+// MetadataIP is the address of the OpenStack metadata service.
+const MetadataIP = "169.254.169.254"
+
+// The ways pods reach MetadataIP.
+const (
+	// MetadataModeManagementPort reroutes the metadata traffic of a node's
+	// pods to the node through its management port k8s-<node>.  Only the
+	// pods on the cluster router's switches are served.
+	MetadataModeManagementPort = "management-port"
+	// MetadataModeLocalport gives every tenant switch a localport that
+	// answers for MetadataIP on each node.  The CNI plugin routes MetadataIP
+	// on-link for it.
+	MetadataModeLocalport = "localport"
+)
+
+// MetadataKey marks the OVN rows that bring pods to the metadata service.
+// Its value is the logical switch they serve.
+const MetadataKey = "k8s-metadata"
+
+// MetadataPortName returns the name of the metadata localport of a switch.
+func MetadataPortName(logicalSwitch string) string {
+	return "metadata-" + logicalSwitch
+}
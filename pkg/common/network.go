@@ -0,0 +1,65 @@
+package common
+
+// NetworkAPIPath is the API path of the Network custom resources.
+const NetworkAPIPath = "/apis/ovn.stackube/v1/networks"
+
+// NetworkAPIVersion is the API version of Network resources.
+const NetworkAPIVersion = "ovn.stackube/v1"
+
+// Network is a network declared through the Network custom resource.
+type Network struct {
+	Metadata ObjectMeta    `json:"metadata"`
+	Spec     NetworkSpec   `json:"spec"`
+	Status   NetworkStatus `json:"status,omitempty"`
+}
+
+// NetworkSpec is the network the user asks for.
+type NetworkSpec struct {
+	// CIDR is the subnet of the network.
+	CIDR string `json:"cidr"`
+	// Gateway is the router address, the first usable one of CIDR when
+	// empty.
+	Gateway string `json:"gateway,omitempty"`
+	// DNS are the name servers of the network.
+	DNS []string `json:"dns,omitempty"`
+	// Tenant attaches the network to the tenant's router instead of the
+	// cluster router.
+	Tenant string `json:"tenant,omitempty"`
+	// VLAN connects the network to the provider network with this tag.
+	// 0 keeps it an overlay network.
+	VLAN int `json:"vlan,omitempty"`
+}
+
+// NetworkStatus reports the OVN objects of a network and its address usage.
+type NetworkStatus struct {
+	// Phase is "Ready" or "Failed".
+	Phase         string `json:"phase,omitempty"`
+	Message       string `json:"message,omitempty"`
+	LogicalSwitch string `json:"logicalSwitch,omitempty"`
+	LogicalRouter string `json:"logicalRouter,omitempty"`
+	RouterPort    string `json:"routerPort,omitempty"`
+	LocalnetPort  string `json:"localnetPort,omitempty"`
+	// Allocated and Free count the pod addresses of the network.
+	Allocated int `json:"allocated"`
+	Free      int `json:"free"`
+}
+
+// ListNetworks returns all the networks.  Without the Network custom
+// resource definition there are none.
+func ListNetworks(server string) ([]Network, error) {
+	var list struct {
+		Items []Network `json:"items"`
+	}
+	if err := getJSON(server+NetworkAPIPath, &list); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// UpdateNetworkStatus replaces the status of the network name.
+func UpdateNetworkStatus(server, name string, status *NetworkStatus) error {
+	return patchJSON(server+NetworkAPIPath+"/"+name+"/status", map[string]interface{}{"status": status})
+}
@@ -0,0 +1,67 @@
+package common
+
+// PodNetworkAnnotation holds the addressing of a pod's primary interface,
+// which the CNI plugin configures.
+const PodNetworkAnnotation = "ovn"
+
+// PodNetwork is the value of PodNetworkAnnotation.  Addresses are in
+// IP/MASK form.
+type PodNetwork struct {
+	IPAddress  string `json:"ip_address"`
+	MacAddress string `json:"mac_address"`
+	GatewayIP  string `json:"gateway_ip"`
+	// IfaceID is the logical switch port the pod is bound to,
+	// <namespace>_<name> when empty.
+	IfaceID string `json:"iface_id,omitempty"`
+}
+
+// NetworksAnnotation requests additional interfaces on Network resources
+// for a pod, either as a comma separated list of network names or as a
+// JSON list of NetworkSelection.
+const NetworksAnnotation = "ovn.stackube/networks"
+
+// NetworkSelection is an element of NetworksAnnotation.
+type NetworkSelection struct {
+	Name string `json:"name"`
+	// Interface is the name of the interface in the pod, "net<n>" for the
+	// n-th selection when empty.
+	Interface string `json:"interface,omitempty"`
+}
+
+// AttachmentsAnnotation holds the additional interfaces of a pod, as a JSON
+// list of PodAttachment.
+const AttachmentsAnnotation = "ovn.stackube/attachments"
+
+// PodAttachment is an additional interface of a pod.  Unlike the primary
+// one it does not carry the default route.
+type PodAttachment struct {
+	Network    string `json:"network"`
+	Interface  string `json:"interface"`
+	PortName   string `json:"port_name"`
+	IPAddress  string `json:"ip_address"`
+	MacAddress string `json:"mac_address"`
+	GatewayIP  string `json:"gateway_ip"`
+	// Routes are the subnets reached through GatewayIP.
+	Routes []string `json:"routes,omitempty"`
+}
+
+// VhostUserAnnotation holds the vhost-user interfaces of a pod on a node
+// with a userspace datapath, as a JSON list of VhostUserInterface.  The CNI
+// plugin sets it for the workload, which serves the sockets.
+const VhostUserAnnotation = "ovn.stackube/vhostuser"
+
+// VhostUserInterface is a vhost-user interface of a pod.
+type VhostUserInterface struct {
+	Interface  string `json:"interface"`
+	Socket     string `json:"socket"`
+	MacAddress string `json:"mac_address"`
+	IPAddress  string `json:"ip_address"`
+}
+
+// IPAddressAnnotation requests a fixed address for a pod's primary
+// interface.  It is only assigned if it is free on the switch of the pod's
+// node; otherwise the pod gets no network and an event says why.
+const IPAddressAnnotation = "ovn.stackube/ip-address"
+
+// MacAddressAnnotation requests a fixed MAC for a pod's primary interface.
+const MacAddressAnnotation = "ovn.stackube/mac-address"
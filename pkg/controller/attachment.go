@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// AttachmentReconciler gives pods the additional interfaces they request
+// with common.NetworksAnnotation: a port with an address on the switch of
+// each Network, recorded in common.AttachmentsAnnotation for the CNI
+// plugin.  A pod gets all of its attachments or none: if one of them can
+// not be made, an event is recorded on the pod and its annotation is left
+// alone.
+type AttachmentReconciler struct {
+	Server string
+
+	// rejected maps the uids of the pods whose attachments failed to the
+	// message of the event recorded for them.
+	rejected map[string]string
+}
+
+func (r *AttachmentReconciler) Name() string {
+	return "attachment"
+}
+
+// maxInterfaceName is the longest interface name the kernel accepts.
+const maxInterfaceName = 15
+
+// parseNetworkSelections parses the value of common.NetworksAnnotation and
+// names the interfaces that are not named.  Every network may be selected
+// once, and the interfaces must have valid names other than the pod's
+// primary interface.
+func parseNetworkSelections(value string) ([]common.NetworkSelection, error) {
+	var selections []common.NetworkSelection
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &selections); err != nil {
+			return nil, fmt.Errorf("invalid network list: %v", err)
+		}
+	} else {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				selections = append(selections, common.NetworkSelection{Name: name})
+			}
+		}
+	}
+	networks := make(map[string]bool)
+	interfaces := make(map[string]bool)
+	for i := range selections {
+		if selections[i].Name == "" {
+			return nil, fmt.Errorf("network %d has no name", i+1)
+		}
+		if networks[selections[i].Name] {
+			return nil, fmt.Errorf("network %v is selected twice", selections[i].Name)
+		}
+		networks[selections[i].Name] = true
+		if selections[i].Interface == "" {
+			selections[i].Interface = fmt.Sprintf("net%d", i+1)
+		}
+		switch iface := selections[i].Interface; {
+		case iface == "eth0":
+			return nil, fmt.Errorf("interface %v is the primary interface of the pod", iface)
+		case len(iface) > maxInterfaceName:
+			return nil, fmt.Errorf("interface name %v is longer than %d characters", iface, maxInterfaceName)
+		case strings.ContainsAny(iface, "/ \t\n") || iface == "." || iface == "..":
+			return nil, fmt.Errorf("invalid interface name %q", iface)
+		case interfaces[iface]:
+			return nil, fmt.Errorf("interface %v is used twice", iface)
+		}
+		interfaces[selections[i].Interface] = true
+	}
+	return selections, nil
+}
+
+// rejectAttachments records an event on pod saying why its attachments
+// were not made, once per message.
+func (r *AttachmentReconciler) rejectAttachments(rejected map[string]string, pod *common.Pod, message string) {
+	rejected[pod.Metadata.UID] = message
+	if r.rejected[pod.Metadata.UID] == message {
+		return
+	}
+	log.Printf("pod %v: %v", podKey(pod), message)
+	object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on pod %v: %v", podKey(pod), message), func() error {
+		return common.RecordEvent(r.Server, component, object, "NetworkAttachmentFailed", message)
+	})
+	if err != nil {
+		log.Printf("pod %v: failed to record event: %v", podKey(pod), err)
+		delete(rejected, pod.Metadata.UID)
+	}
+}
+
+// attachmentPortName returns the name of the port of pod on network.
+func attachmentPortName(pod *common.Pod, network string) string {
+	return podPortName(pod) + "_" + network
+}
+
+// networkRoutes returns the subnets of the other switches on the router of
+// sw, which an attachment to sw reaches through its gateway.
+func networkRoutes(switches map[string]*logicalSwitch, sw *logicalSwitch) []string {
+	var routes []string
+	for _, other := range switches {
+		if other != sw && other.subnet != nil && other.externalIDs["router"] == sw.externalIDs["router"] {
+			routes = append(routes, other.subnet.String())
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+func (r *AttachmentReconciler) Reconcile(cluster *Cluster) error {
+	switches, err := listLogicalSwitches(networkKey)
+	if err != nil {
+		return err
+	}
+	ports, err := listSwitchPorts(networkKey)
+	if err != nil {
+		return err
+	}
+
+	txn := &ovn.Transaction{}
+	allocators := make(map[string]*common.IPAllocator)
+	annotations := make(map[*common.Pod]string)
+	wanted := make(map[string]bool)
+	rejected := make(map[string]string)
+	for i := range cluster.Pods {
+		pod := &cluster.Pods[i]
+		value := pod.Metadata.Annotations[common.NetworksAnnotation]
+		if value == "" || !podActive(pod) {
+			if _, ok := pod.Metadata.Annotations[common.AttachmentsAnnotation]; ok {
+				annotations[pod] = ""
+			}
+			continue
+		}
+		// The ports of the pod are kept while it is rejected, the commands
+		// creating new ones are only added once all attachments are made.
+		var owned []string
+		for name, port := range ports {
+			if port.externalIDs["pod"] == podKey(pod) {
+				owned = append(owned, name)
+			}
+		}
+		selections, err := parseNetworkSelections(value)
+		if err != nil {
+			r.rejectAttachments(rejected, pod, err.Error())
+			for _, name := range owned {
+				wanted[name] = true
+			}
+			continue
+		}
+		var commands [][]string
+		var allocated []net.IP
+		var allocatedFrom []*common.IPAllocator
+		failure := ""
+		attachments := []common.PodAttachment{}
+		for _, selection := range selections {
+			sw, ok := switches[networkSwitchName(selection.Name)]
+			var gateway net.IP
+			if ok {
+				gateway = net.ParseIP(sw.externalIDs["gateway"])
+			}
+			if !ok || sw.subnet == nil || gateway == nil {
+				failure = fmt.Sprintf("network %v does not exist", selection.Name)
+				break
+			}
+			allocator, ok := allocators[sw.name]
+			if !ok {
+				var err error
+				if allocator, err = newSwitchAllocator(sw, ports, gateway); err != nil {
+					failure = err.Error()
+					break
+				}
+				allocators[sw.name] = allocator
+			}
+
+			portName := attachmentPortName(pod, selection.Name)
+			ones, _ := sw.subnet.Mask.Size()
+			attachment := common.PodAttachment{
+				Network:   selection.Name,
+				Interface: selection.Interface,
+				PortName:  portName,
+				GatewayIP: fmt.Sprintf("%s/%d", gateway, ones),
+				Routes:    networkRoutes(switches, sw),
+			}
+			port, ok := ports[portName]
+			if ok && sw.ports[port.uuid] && port.ip != nil && sw.subnet.Contains(port.ip) {
+				attachment.IPAddress = fmt.Sprintf("%s/%d", port.ip, ones)
+				attachment.MacAddress = port.mac
+				if port.externalIDs["interface"] != selection.Interface {
+					commands = append(commands, []string{"set", "logical_switch_port", portName, "external_ids:interface=" + selection.Interface})
+				}
+				restampTenant(txn, cluster, "logical_switch_port", port.uuid, port.externalIDs, pod.Metadata.Namespace)
+				attachments = append(attachments, attachment)
+				continue
+			}
+			ip, err := allocator.Allocate()
+			if err != nil {
+				failure = fmt.Sprintf("network %v: %v", selection.Name, err)
+				break
+			}
+			allocated = append(allocated, ip)
+			allocatedFrom = append(allocatedFrom, allocator)
+			if ok {
+				// The network was rebuilt with another subnet.
+				commands = append(commands, []string{"--if-exists", "lsp-del", portName})
+			}
+			mac := common.IPToMac(ip)
+			addresses := mac + " " + ip.String()
+			commands = append(commands, []string{"lsp-add", sw.name, portName},
+				[]string{"lsp-set-addresses", portName, addresses},
+				[]string{"lsp-set-port-security", portName, addresses})
+			args := []string{"set", "logical_switch_port", portName, "external_ids:" + networkKey + "=" + selection.Name,
+				"external_ids:pod=\"" + podKey(pod) + "\"", "external_ids:interface=" + selection.Interface}
+			commands = append(commands, append(args, tenantExternalIDs(cluster, pod.Metadata.Namespace)...))
+			attachment.IPAddress = fmt.Sprintf("%s/%d", ip, ones)
+			attachment.MacAddress = mac
+			attachments = append(attachments, attachment)
+		}
+		if failure != "" {
+			for i, ip := range allocated {
+				allocatedFrom[i].Release(ip)
+			}
+			r.rejectAttachments(rejected, pod, failure)
+			for _, name := range owned {
+				wanted[name] = true
+			}
+			continue
+		}
+		for _, command := range commands {
+			txn.Add(command...)
+		}
+		for _, attachment := range attachments {
+			wanted[attachment.PortName] = true
+		}
+		data, err := json.Marshal(attachments)
+		if err != nil {
+			return err
+		}
+		annotations[pod] = string(data)
+	}
+
+	// Remove the ports of attachments that are no longer requested.
+	for name, port := range ports {
+		if key, ok := port.externalIDs["pod"]; ok && !wanted[name] && !cluster.frozen(key) {
+			txn.Add("--if-exists", "lsp-del", name)
+		}
+	}
+	r.rejected = rejected
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	for pod, value := range annotations {
+		if err := annotatePod(r.Server, pod, common.AttachmentsAnnotation, value); err != nil {
+			log.Printf("pod %v: failed to record its attachments: %v", podKey(pod), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+)
+
+func TestParseNetworkSelections(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []common.NetworkSelection
+		fails bool
+	}{
+		{"a", []common.NetworkSelection{{Name: "a", Interface: "net1"}}, false},
+		{" a, b ,", []common.NetworkSelection{{Name: "a", Interface: "net1"}, {Name: "b", Interface: "net2"}}, false},
+		{`[{"name":"a","interface":"data"},{"name":"b"}]`, []common.NetworkSelection{{Name: "a", Interface: "data"}, {Name: "b", Interface: "net2"}}, false},
+		{`[{"name":"a","interface":"net2"},{"name":"b"}]`, nil, true},
+		{"a,a", nil, true},
+		{`[{"name":"a","interface":"x"},{"name":"a","interface":"y"}]`, nil, true},
+		{`[{"name":"a","interface":"eth0"}]`, nil, true},
+		{`[{"name":"a","interface":"interface-name-16"}]`, nil, true},
+		{`[{"name":"a","interface":"interfacename15"}]`, []common.NetworkSelection{{Name: "a", Interface: "interfacename15"}}, false},
+		{`[{"name":"a","interface":"a/b"}]`, nil, true},
+		{`[{"interface":"x"}]`, nil, true},
+		{`[{"name":"a"`, nil, true},
+	}
+	for _, test := range tests {
+		selections, err := parseNetworkSelections(test.value)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseNetworkSelections(%q) = %v, want an error", test.value, selections)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(selections, test.want) {
+			t.Errorf("parseNetworkSelections(%q) = %v, %v, want %v", test.value, selections, err, test.want)
+		}
+	}
+}
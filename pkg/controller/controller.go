@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/keystone"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// component is the source of the events the controller records.
+const component = "ovn-controller"
+
+// Cluster is a snapshot of the Kubernetes objects the reconcilers work on.
+type Cluster struct {
+	Pods       []common.Pod
+	Namespaces map[string]*common.Namespace
+	Nodes      map[string]*common.Node
+	Networks   []common.Network
+	Services   []common.Service
+	// TenantIDs maps the tenants named by namespaces and Networks to
+	// their IDs.
+	TenantIDs map[string]string
+	// UnknownTenants maps the tenants that could not be resolved to the
+	// reason.
+	UnknownTenants map[string]string
+	// FrozenNamespaces are the namespaces whose tenant is unknown.  Their
+	// pods are left out of Pods, but the objects made for them before are
+	// kept as they are rather than removed.
+	FrozenNamespaces map[string]bool
+	// FrozenPods are the uids of the pods of FrozenNamespaces.
+	FrozenPods map[string]bool
+	// FrozenTenants are the IDs recorded on the OVN objects of
+	// FrozenNamespaces and of the Networks whose tenant is unknown.  The
+	// objects of these tenants are kept as well.
+	FrozenTenants map[string]bool
+}
+
+// frozen reports whether the objects of the pod with key, "namespace/name",
+// are to be kept as they are.
+func (c *Cluster) frozen(key string) bool {
+	return c.FrozenNamespaces[strings.SplitN(key, "/", 2)[0]]
+}
+
+// Reconciler makes one aspect of the OVN northbound database match the
+// cluster.  Reconcile is called with a fresh snapshot on every resync, so
+// it has to be idempotent.
+type Reconciler interface {
+	Name() string
+	Reconcile(cluster *Cluster) error
+}
+
+// Controller periodically lists the cluster from the Kubernetes API server
+// and runs its reconcilers on it.
+type Controller struct {
+	server      string
+	interval    time.Duration
+	reconcilers []Reconciler
+	resolver    keystone.Resolver
+	// rejected maps the uids of the pods rejected for their tenant to
+	// the reason, so that each gets one event per reason.
+	rejected map[string]string
+}
+
+// New returns a controller that resyncs from server every interval.
+func New(server string, interval time.Duration) *Controller {
+	return &Controller{server: server, interval: interval}
+}
+
+// SetTenantResolver makes the controller resolve tenants to their IDs with
+// resolver.  Without one a tenant's name is its ID.
+func (c *Controller) SetTenantResolver(resolver keystone.Resolver) {
+	c.resolver = resolver
+}
+
+// Register adds r to the reconcilers run on every resync, in order.
+func (c *Controller) Register(r Reconciler) {
+	c.reconcilers = append(c.reconcilers, r)
+}
+
+// snapshot lists the objects the reconcilers need.
+func (c *Controller) snapshot() (*Cluster, error) {
+	pods, err := common.ListPods(c.server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	namespaces, err := common.ListNamespaces(c.server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+	nodes, err := common.ListNodes(c.server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	networks, err := common.ListNetworks(c.server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+	services, err := common.ListServices(c.server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %v", err)
+	}
+	cluster := &Cluster{
+		Pods:             pods,
+		Networks:         networks,
+		Services:         services,
+		Namespaces:       make(map[string]*common.Namespace),
+		Nodes:            make(map[string]*common.Node),
+		TenantIDs:        make(map[string]string),
+		UnknownTenants:   make(map[string]string),
+		FrozenNamespaces: make(map[string]bool),
+		FrozenPods:       make(map[string]bool),
+		FrozenTenants:    make(map[string]bool),
+	}
+	for i := range namespaces {
+		cluster.Namespaces[namespaces[i].Metadata.Name] = &namespaces[i]
+	}
+	for i := range nodes {
+		cluster.Nodes[nodes[i].Metadata.Name] = &nodes[i]
+	}
+	if err := c.resolveTenants(cluster); err != nil {
+		return nil, err
+	}
+	if err := frozenTenants(cluster); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// frozenTenants fills cluster.FrozenTenants from the tenant IDs of the
+// switch ports of the pods of frozen namespaces and of the switches of
+// Networks whose tenant is unknown.  A tenant that is no longer known
+// keeps its ID on the objects made for it, but not its name.
+func frozenTenants(cluster *Cluster) error {
+	frozenNetworks := make(map[string]bool)
+	for _, network := range cluster.Networks {
+		if _, unknown := cluster.UnknownTenants[network.Spec.Tenant]; unknown {
+			frozenNetworks[network.Metadata.Name] = true
+		}
+	}
+	if len(cluster.FrozenNamespaces) == 0 && len(frozenNetworks) == 0 {
+		return nil
+	}
+	for _, table := range []string{"logical_switch_port", "logical_switch"} {
+		rows, err := ovn.ListRows(table, []string{"external_ids"})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			externalIDs := ovn.ParseMap(row["external_ids"])
+			tenant, ok := externalIDs[tenantKey]
+			if !ok {
+				continue
+			}
+			if pod, ok := externalIDs["pod"]; ok && cluster.frozen(pod) {
+				cluster.FrozenTenants[tenant] = true
+			}
+			if network, ok := externalIDs[networkKey]; ok && frozenNetworks[network] {
+				cluster.FrozenTenants[tenant] = true
+			}
+		}
+	}
+	return nil
+}
+
+// resolveTenants fills the tenant IDs of cluster.  The pods of namespaces
+// whose tenant is unknown are rejected: they are left out of the snapshot,
+// so that no OVN object is created for them, and get an event telling why.
+// Their namespaces are frozen, so that the objects that were made for them
+// while the tenant was known are kept.  Other failures fail the snapshot,
+// rather than have the reconcilers remove the objects of every tenant pod.
+func (c *Controller) resolveTenants(cluster *Cluster) error {
+	var tenants []string
+	for _, ns := range cluster.Namespaces {
+		if tenant := ns.Metadata.Annotations[TenantAnnotation]; tenant != "" {
+			tenants = append(tenants, tenant)
+		}
+	}
+	for _, network := range cluster.Networks {
+		if network.Spec.Tenant != "" {
+			tenants = append(tenants, network.Spec.Tenant)
+		}
+	}
+	for _, tenant := range tenants {
+		if c.resolver == nil {
+			cluster.TenantIDs[tenant] = tenant
+			continue
+		}
+		id, err := c.resolver.TenantID(tenant)
+		if err == keystone.ErrNotFound {
+			cluster.UnknownTenants[tenant] = fmt.Sprintf("tenant %q is not known to the identity service", tenant)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resolve tenant %q: %v", tenant, err)
+		}
+		cluster.TenantIDs[tenant] = id
+	}
+
+	for name, ns := range cluster.Namespaces {
+		if _, unknown := cluster.UnknownTenants[ns.Metadata.Annotations[TenantAnnotation]]; unknown {
+			cluster.FrozenNamespaces[name] = true
+		}
+	}
+	pods := cluster.Pods[:0]
+	rejected := make(map[string]string)
+	for _, pod := range cluster.Pods {
+		ns, ok := cluster.Namespaces[pod.Metadata.Namespace]
+		reason, unknown := "", false
+		if ok {
+			reason, unknown = cluster.UnknownTenants[ns.Metadata.Annotations[TenantAnnotation]]
+		}
+		if !unknown {
+			pods = append(pods, pod)
+			continue
+		}
+		cluster.FrozenPods[pod.Metadata.UID] = true
+		message := fmt.Sprintf("no network for pod of namespace %v: %v", pod.Metadata.Namespace, reason)
+		rejected[pod.Metadata.UID] = message
+		if c.rejected[pod.Metadata.UID] == message {
+			continue
+		}
+		log.Printf("pod %v/%v: %v", pod.Metadata.Namespace, pod.Metadata.Name, message)
+		object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+		err := exec.Apply(fmt.Sprintf("record event on pod %v/%v: %v", pod.Metadata.Namespace, pod.Metadata.Name, message), func() error {
+			return common.RecordEvent(c.server, component, object, "TenantNotFound", message)
+		})
+		if err != nil {
+			log.Printf("pod %v/%v: failed to record event: %v", pod.Metadata.Namespace, pod.Metadata.Name, err)
+			delete(rejected, pod.Metadata.UID)
+		}
+	}
+	cluster.Pods = pods
+	c.rejected = rejected
+	return nil
+}
+
+// RunOnce takes one snapshot and runs every reconciler on it.  A failing
+// reconciler does not stop the others; the first error is returned.
+func (c *Controller) RunOnce() error {
+	cluster, err := c.snapshot()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, r := range c.reconcilers {
+		if err := r.Reconcile(cluster); err != nil {
+			log.Printf("%v: %v", r.Name(), err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%v: %v", r.Name(), err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// Run resyncs until stop is closed.
+func (c *Controller) Run(stop <-chan struct{}) {
+	for {
+		if err := c.RunOnce(); err != nil {
+			log.Printf("resync failed: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// fakeNB stands in for ovn-nbctl.  It answers the queries of the
+// reconcilers from tables, rows of column values in bare format, and
+// records the commands of the transactions they commit.
+type fakeNB struct {
+	tables   map[string][]map[string]string
+	commands []string
+	real     func(cmd string, args ...string) ([]string, error)
+}
+
+// runFakeNB makes the commands of the reconcilers run against a fakeNB with
+// tables until stop is called.  The other changes they make, such as events
+// and annotations, are only printed meanwhile.
+func runFakeNB(tables map[string][]map[string]string) *fakeNB {
+	f := &fakeNB{tables: tables, real: exec.RunCommand}
+	exec.RunCommand = f.run
+	exec.DryRun = true
+	return f
+}
+
+// stop makes the commands run for real again.
+func (f *fakeNB) stop() {
+	exec.RunCommand = f.real
+	exec.DryRun = false
+}
+
+func (f *fakeNB) run(cmd string, args ...string) ([]string, error) {
+	if cmd != "ovn-nbctl" {
+		return nil, fmt.Errorf("unexpected command %v", exec.FormatCommand(cmd, args...))
+	}
+	if len(args) > 0 && args[0] == "--" {
+		// A transaction.
+		for _, command := range strings.Split(strings.Join(args[1:], " "), " -- ") {
+			f.commands = append(f.commands, command)
+		}
+		return []string{""}, nil
+	}
+	var columns []string
+	table := ""
+	var conditions []string
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--columns=") {
+			columns = strings.Split(strings.TrimPrefix(arg, "--columns="), ",")
+		}
+		if (arg == "list" || arg == "find") && i+1 < len(args) {
+			table = args[i+1]
+			conditions = args[i+2:]
+			break
+		}
+	}
+	if table == "" {
+		return nil, fmt.Errorf("unexpected command %v", exec.FormatCommand(cmd, args...))
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, row := range f.tables[table] {
+		if !rowMatches(row, conditions) {
+			continue
+		}
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = row[column]
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return strings.Split(strings.TrimSpace(buf.String()), "\n"), nil
+}
+
+// rowMatches reports whether row meets conditions such as "name=join" or
+// "external_ids:key=value".
+func rowMatches(row map[string]string, conditions []string) bool {
+	for _, condition := range conditions {
+		kv := strings.SplitN(condition, "=", 2)
+		if len(kv) != 2 {
+			return false
+		}
+		column := strings.SplitN(kv[0], ":", 2)
+		if len(column) == 2 {
+			if ovn.ParseMap(row[column[0]])[column[1]] != kv[1] {
+				return false
+			}
+		} else if row[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// has reports whether a committed command starts with prefix.
+func (f *fakeNB) has(prefix string) bool {
+	for _, command := range f.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// expect fails the test case name for each of want not committed and each
+// of unwanted that was.  Both are command prefixes.
+func (f *fakeNB) expect(t *testing.T, name string, want, unwanted []string) {
+	for _, prefix := range want {
+		if !f.has(prefix) {
+			t.Errorf("%v: missing command %q in %q", name, prefix, f.commands)
+		}
+	}
+	for _, prefix := range unwanted {
+		if f.has(prefix) {
+			t.Errorf("%v: unexpected command %q in %q", name, prefix, f.commands)
+		}
+	}
+}
+
+// testPod returns a running pod of namespace on node.
+func testPod(namespace, name, node, ip string, annotations map[string]string) common.Pod {
+	var pod common.Pod
+	pod.Metadata.Namespace = namespace
+	pod.Metadata.Name = name
+	pod.Metadata.UID = namespace + "-" + name
+	pod.Metadata.Annotations = annotations
+	pod.Spec.NodeName = node
+	pod.Status.PodIP = ip
+	pod.Status.Phase = "Running"
+	return pod
+}
+
+// testNode returns a node that is ready or not.
+func testNode(ready bool) *common.Node {
+	node := &common.Node{}
+	status := "False"
+	if ready {
+		status = "True"
+	}
+	node.Status.Conditions = append(node.Status.Conditions, common.NodeCondition{Type: "Ready", Status: status})
+	return node
+}
+
+// testNamespace returns a namespace of the tenant t1 or of the default
+// network.
+func testNamespace(tenant bool) *common.Namespace {
+	ns := &common.Namespace{}
+	if tenant {
+		ns.Metadata.Annotations = map[string]string{TenantAnnotation: "t1"}
+	}
+	return ns
+}
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// dhcpKey marks the DHCP_Options rows of DHCPReconciler.  Its value is the
+// switch they serve.
+const dhcpKey = "k8s-dhcp"
+
+// dnsKey marks the DNS row holding the records of the services.
+const dnsKey = "k8s-dns"
+
+// DHCPReconciler lets pods that configure themselves, like the VMs of
+// hypervisor runtimes, do so through OVN's native DHCP and DNS.  Each node
+// switch, of the cluster or of a tenant, gets a DHCP_Options row that its
+// pod ports use, and all of them the DNS records of the services.  When
+// disabled the rows created before are removed.
+type DHCPReconciler struct {
+	Enabled   bool
+	LeaseTime int
+	// MTU is advertised when not 0.
+	MTU        int
+	DNSServers []string
+	// Domain is the cluster domain service names are in.
+	Domain string
+}
+
+func (r *DHCPReconciler) Name() string {
+	return "dhcp"
+}
+
+// ovsdbMap formats m as an OVSDB map value.
+func ovsdbMap(m map[string]string) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, strconv.Quote(k)+"="+strconv.Quote(m[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sameMap reports whether a and b hold the same pairs.
+func sameMap(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// dhcpSwitch is a switch whose pods get DHCP.
+type dhcpSwitch struct {
+	subnet     *net.IPNet
+	options    map[string]string
+	ports      map[string]bool
+	dnsRecords map[string]bool
+}
+
+// dhcpOptions returns the DHCP options of a switch with the router gateway
+// and routerMAC.
+func (r *DHCPReconciler) dhcpOptions(gateway net.IP, routerMAC string) map[string]string {
+	options := map[string]string{
+		"lease_time": strconv.Itoa(r.LeaseTime),
+		"router":     gateway.String(),
+		"server_id":  gateway.String(),
+		"server_mac": routerMAC,
+	}
+	if r.MTU != 0 {
+		options["mtu"] = strconv.Itoa(r.MTU)
+	}
+	if len(r.DNSServers) > 0 {
+		options["dns_server"] = "{" + strings.Join(r.DNSServers, ",") + "}"
+	}
+	return options
+}
+
+// serviceRecords returns the DNS records of the services of cluster.
+func (r *DHCPReconciler) serviceRecords(cluster *Cluster) map[string]string {
+	records := make(map[string]string)
+	for _, svc := range cluster.Services {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil {
+			// Headless services have no address of their own.
+			continue
+		}
+		name := svc.Metadata.Name + "." + svc.Metadata.Namespace
+		records[name] = ip.String()
+		records[name+".svc"] = ip.String()
+		records[name+".svc."+r.Domain] = ip.String()
+	}
+	return records
+}
+
+// dhcpSwitches returns the node switches among switchRows, by name.
+func (r *DHCPReconciler) dhcpSwitches(cluster *Cluster, switchRows []map[string]string, ports map[string]map[string]string) map[string]*dhcpSwitch {
+	switches := make(map[string]*dhcpSwitch)
+	for _, row := range switchRows {
+		name := row["name"]
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		_, subnet, err := net.ParseCIDR(ovn.ParseMap(row["other_config"])["subnet"])
+		if err != nil {
+			continue
+		}
+		var gateway net.IP
+		if _, ok := cluster.Nodes[name]; ok {
+			// The switches of the nodes are named after them.
+			gateway, _, _ = net.ParseCIDR(externalIDs["gateway_ip"])
+		} else if _, ok := externalIDs[nodeKey]; ok && externalIDs[tenantKey] != "" {
+			gateway = gatewayIPNet(subnet).IP
+		}
+		router := strings.Fields(ports["stor-"+name]["addresses"])
+		if gateway == nil || len(router) == 0 {
+			continue
+		}
+		sw := &dhcpSwitch{
+			subnet:     subnet,
+			options:    r.dhcpOptions(gateway, router[0]),
+			ports:      make(map[string]bool),
+			dnsRecords: make(map[string]bool),
+		}
+		for _, uuid := range ovn.ParseSet(row["ports"]) {
+			sw.ports[uuid] = true
+		}
+		for _, uuid := range ovn.ParseSet(row["dns_records"]) {
+			sw.dnsRecords[uuid] = true
+		}
+		switches[name] = sw
+	}
+	return switches
+}
+
+func (r *DHCPReconciler) Reconcile(cluster *Cluster) error {
+	switchRows, err := ovn.ListRows("logical_switch", []string{"name", "other_config", "ports", "dns_records", "external_ids"})
+	if err != nil {
+		return err
+	}
+	portRows, err := ovn.ListRows("logical_switch_port", []string{"_uuid", "name", "type", "addresses", "dhcpv4_options"})
+	if err != nil {
+		return err
+	}
+	optionRows, err := ovn.ListRows("dhcp_options", []string{"_uuid", "cidr", "options", "external_ids"})
+	if err != nil {
+		return err
+	}
+	dnsRows, err := ovn.ListRows("dns", []string{"_uuid", "records", "external_ids"})
+	if err != nil {
+		return err
+	}
+	ports := make(map[string]map[string]string)
+	for _, row := range portRows {
+		ports[row["name"]] = row
+	}
+	switches := make(map[string]*dhcpSwitch)
+	if r.Enabled {
+		switches = r.dhcpSwitches(cluster, switchRows, ports)
+	}
+
+	txn := &ovn.Transaction{}
+	// The DHCP options of each switch, a row UUID or a reference to the
+	// row created in txn.
+	refs := make(map[string]string)
+	for _, row := range optionRows {
+		name, ok := ovn.ParseMap(row["external_ids"])[dhcpKey]
+		if !ok {
+			continue
+		}
+		sw, wanted := switches[name]
+		if !wanted || refs[name] != "" {
+			txn.Add("destroy", "dhcp_options", row["_uuid"])
+			continue
+		}
+		if row["cidr"] != sw.subnet.String() || !sameMap(ovn.ParseMap(row["options"]), sw.options) {
+			txn.Add("set", "dhcp_options", row["_uuid"], "cidr="+sw.subnet.String(), "options="+ovsdbMap(sw.options))
+		}
+		refs[name] = row["_uuid"]
+	}
+	n := 0
+	for name, sw := range switches {
+		if refs[name] != "" {
+			continue
+		}
+		refs[name] = fmt.Sprintf("@dhcp%d", n)
+		n++
+		txn.Add("--id="+refs[name], "create", "dhcp_options", "cidr="+sw.subnet.String(), "options="+ovsdbMap(sw.options),
+			"external_ids:"+dhcpKey+"=\""+name+"\"")
+	}
+
+	// The pod ports: the ones without a type but the management port.
+	for name, sw := range switches {
+		for _, port := range portRows {
+			if !sw.ports[port["_uuid"]] || port["type"] != "" || port["name"] == "k8s-"+name ||
+				len(strings.Fields(port["addresses"])) < 2 || port["dhcpv4_options"] == refs[name] {
+				continue
+			}
+			txn.Add("set", "logical_switch_port", port["_uuid"], "dhcpv4_options="+refs[name])
+		}
+	}
+
+	records := r.serviceRecords(cluster)
+	dns := ""
+	for _, row := range dnsRows {
+		if _, ok := ovn.ParseMap(row["external_ids"])[dnsKey]; !ok {
+			continue
+		}
+		if !r.Enabled || dns != "" {
+			txn.Add("destroy", "dns", row["_uuid"])
+			continue
+		}
+		dns = row["_uuid"]
+		if !sameMap(ovn.ParseMap(row["records"]), records) {
+			txn.Add("set", "dns", dns, "records="+ovsdbMap(records))
+		}
+	}
+	if r.Enabled && dns == "" {
+		dns = "@dns"
+		txn.Add("--id="+dns, "create", "dns", "records="+ovsdbMap(records), "external_ids:"+dnsKey+"=services")
+	}
+	for name, sw := range switches {
+		if !sw.dnsRecords[dns] {
+			txn.Add("add", "logical_switch", name, "dns_records", dns)
+		}
+	}
+	return txn.Commit()
+}
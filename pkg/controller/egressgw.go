@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// EgressGatewaysAnnotation pins the traffic of a namespace's pods to the
+// gateways of the listed nodes, e.g. "node1,node2".  It does not apply to
+// pods with an egress IP.
+const EgressGatewaysAnnotation = "ovn.stackube/egress-gateways"
+
+// egressGatewayKey marks the static routes managed by
+// EgressGatewayReconciler.  Its value is the namespace of the pod.
+const egressGatewayKey = "k8s-egress-gateway"
+
+// EgressGatewayReconciler maintains source based routes on the cluster
+// router that send the traffic of pods in annotated namespaces to one of
+// the namespace's gateways.  A pod sticks to the same gateway as long as the
+// set of healthy gateways does not change.  Routes of pods that went away
+// or whose namespace lost the annotation are removed.
+//
+// A pod has a single source based route.  An egress IP is more specific than
+// a set of gateways, so pods with an egress IP (EgressIPAnnotation) are left
+// to EgressIPReconciler, which routes them to the owner of the IP.
+//
+// The pods of tenants are left out: their traffic reaches the cluster
+// router SNATed to their tenant router's join address and their addresses
+// may be used by other tenants too.  An event is recorded on those in
+// annotated namespaces.
+type EgressGatewayReconciler struct {
+	Server string
+
+	// rejected maps the uids of the pods refused their egress gateways to
+	// the message of the event recorded for them.
+	rejected map[string]string
+}
+
+func (r *EgressGatewayReconciler) Name() string {
+	return "egress-gateway"
+}
+
+// rejectEgressGateways records an event on pod saying why its traffic is
+// not pinned to its namespace's gateways, once per message.
+func (r *EgressGatewayReconciler) rejectEgressGateways(rejected map[string]string, pod *common.Pod, message string) {
+	rejected[pod.Metadata.UID] = message
+	if r.rejected[pod.Metadata.UID] == message {
+		return
+	}
+	log.Printf("pod %v: %v", podKey(pod), message)
+	object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on pod %v: %v", podKey(pod), message), func() error {
+		return common.RecordEvent(r.Server, component, object, "EgressGatewaysRejected", message)
+	})
+	if err != nil {
+		log.Printf("pod %v: failed to record event: %v", podKey(pod), err)
+		delete(rejected, pod.Metadata.UID)
+	}
+}
+
+// pickGateway spreads pods over candidates by hashing their ip.
+func pickGateway(candidates []*gateway, podIP string) *gateway {
+	h := fnv.New32a()
+	h.Write([]byte(podIP))
+	return candidates[int(h.Sum32()%uint32(len(candidates)))]
+}
+
+func (r *EgressGatewayReconciler) Reconcile(cluster *Cluster) error {
+	gateways, err := listGateways()
+	if err != nil {
+		return err
+	}
+	router, routes, err := listStaticRoutes(egressGatewayKey)
+	if err != nil {
+		return err
+	}
+
+	// The healthy gateways each annotated namespace may use.
+	candidates := make(map[string][]*gateway)
+	for name, ns := range cluster.Namespaces {
+		value := ns.Metadata.Annotations[EgressGatewaysAnnotation]
+		if value == "" {
+			continue
+		}
+		for _, node := range strings.Split(value, ",") {
+			node = strings.TrimSpace(node)
+			gw, ok := gateways["GR_"+strings.TrimPrefix(node, "GR_")]
+			if !ok {
+				log.Printf("namespace %v: unknown egress gateway %q", name, node)
+				continue
+			}
+			if gw.healthy(cluster) && gw.joinIP != nil {
+				candidates[name] = append(candidates[name], gw)
+			}
+		}
+		if len(candidates[name]) == 0 {
+			log.Printf("namespace %v: no healthy egress gateway", name)
+		}
+	}
+
+	// The next hop of each pod, keyed by its /32 prefix.
+	desired := make(map[string]string)
+	namespaceOf := make(map[string]string)
+	rejected := make(map[string]string)
+	for i := range cluster.Pods {
+		pod := &cluster.Pods[i]
+		if pod.Status.PodIP == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		ns, ok := cluster.Namespaces[pod.Metadata.Namespace]
+		if !ok || ns.Metadata.Annotations[EgressGatewaysAnnotation] == "" || hasEgressIP(cluster, pod) {
+			continue
+		}
+		if namespaceTenant(cluster, pod.Metadata.Namespace) != "" {
+			r.rejectEgressGateways(rejected, pod, "egress gateways are not applied to the pods of tenants")
+			continue
+		}
+		gws := candidates[pod.Metadata.Namespace]
+		if len(gws) == 0 {
+			continue
+		}
+		prefix := pod.Status.PodIP + "/32"
+		desired[prefix] = pickGateway(gws, pod.Status.PodIP).joinIP.String()
+		namespaceOf[prefix] = pod.Metadata.Namespace
+	}
+	r.rejected = rejected
+
+	txn := &ovn.Transaction{}
+	for _, route := range routes {
+		if cluster.FrozenNamespaces[route.externalIDs[egressGatewayKey]] {
+			continue
+		}
+		if nexthop, ok := desired[route.ipPrefix]; ok && nexthop == route.nexthop && route.policy == "src-ip" {
+			restampTenant(txn, cluster, "logical_router_static_route", route.uuid, route.externalIDs, namespaceOf[route.ipPrefix])
+			delete(desired, route.ipPrefix)
+			continue
+		}
+		txn.Add("remove", "logical_router", router, "static_routes", route.uuid)
+	}
+	id := 0
+	for prefix, nexthop := range desired {
+		id++
+		ref := fmt.Sprintf("@route%d", id)
+		args := []string{"--id=" + ref, "create", "logical_router_static_route", "ip_prefix=\"" + prefix + "\"", "nexthop=\"" + nexthop + "\"",
+			"policy=src-ip", "external_ids:" + egressGatewayKey + "=" + namespaceOf[prefix]}
+		txn.Add(append(args, tenantExternalIDs(cluster, namespaceOf[prefix])...)...)
+		txn.Add("add", "logical_router", router, "static_routes", ref)
+	}
+	return txn.Commit()
+}
@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// EgressIPAnnotation assigns a dedicated egress IP to the pods of a
+// namespace, or to a single pod when set on the pod.
+const EgressIPAnnotation = "ovn.stackube/egress-ip"
+
+// egressIPKey marks the NAT rows and static routes managed by
+// EgressIPReconciler.  Its value is the egress IP.
+const egressIPKey = "k8s-egress-ip"
+
+// EgressIPReconciler SNATs the traffic of pods with an egress IP to that IP
+// instead of the gateway's physical ip.  Each egress IP is owned by one
+// healthy gateway whose external subnet contains it; the owner answers for
+// the IP on its external port and holds per-pod SNAT rules for it.  A
+// source based route per pod on the cluster router sends the pod's traffic
+// to the owner.  When the owner's node is no longer ready, the IP moves to
+// another gateway.
+//
+// The pods of tenants are left out: their traffic reaches the gateways
+// SNATed to their tenant router's join address and their addresses may be
+// used by other tenants too.  An event is recorded on those that ask for an
+// egress IP.
+type EgressIPReconciler struct {
+	Server string
+
+	// rejected maps the uids of the pods refused an egress IP to the
+	// message of the event recorded for them.
+	rejected map[string]string
+}
+
+func (r *EgressIPReconciler) Name() string {
+	return "egress-ip"
+}
+
+// rejectEgressIP records an event on pod saying why it has no egress IP,
+// once per message.
+func (r *EgressIPReconciler) rejectEgressIP(rejected map[string]string, pod *common.Pod, message string) {
+	rejected[pod.Metadata.UID] = message
+	if r.rejected[pod.Metadata.UID] == message {
+		return
+	}
+	log.Printf("pod %v: %v", podKey(pod), message)
+	object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on pod %v: %v", podKey(pod), message), func() error {
+		return common.RecordEvent(r.Server, component, object, "EgressIPRejected", message)
+	})
+	if err != nil {
+		log.Printf("pod %v: failed to record event: %v", podKey(pod), err)
+		delete(rejected, pod.Metadata.UID)
+	}
+}
+
+// podEgressIP returns the egress IP requested for pod, or "".
+func podEgressIP(cluster *Cluster, pod *common.Pod) string {
+	if ip, ok := pod.Metadata.Annotations[EgressIPAnnotation]; ok {
+		return ip
+	}
+	if ns, ok := cluster.Namespaces[pod.Metadata.Namespace]; ok {
+		return ns.Metadata.Annotations[EgressIPAnnotation]
+	}
+	return ""
+}
+
+// hasEgressIP reports whether pod has a valid egress IP.  Such pods are
+// routed by EgressIPReconciler only, see EgressGatewayReconciler.
+func hasEgressIP(cluster *Cluster, pod *common.Pod) bool {
+	return net.ParseIP(podEgressIP(cluster, pod)) != nil
+}
+
+// canHostEgressIP reports whether gw is healthy, reachable from the cluster
+// router and has ip on its external subnet.
+func canHostEgressIP(cluster *Cluster, gw *gateway, ip net.IP) bool {
+	return gw.healthy(cluster) && gw.joinIP != nil && gw.external != nil && gw.external.Contains(ip)
+}
+
+// chooseEgressGateway keeps ip on its current gateway while that one is
+// healthy and otherwise picks the first healthy gateway that can host ip.
+func chooseEgressGateway(cluster *Cluster, gateways map[string]*gateway, ip net.IP, current *gateway) *gateway {
+	if current != nil && canHostEgressIP(cluster, current, ip) {
+		return current
+	}
+	for _, gw := range sortedGateways(gateways) {
+		if canHostEgressIP(cluster, gw, ip) {
+			return gw
+		}
+	}
+	return nil
+}
+
+func (r *EgressIPReconciler) Reconcile(cluster *Cluster) error {
+	gateways, err := listGateways()
+	if err != nil {
+		return err
+	}
+	rules, err := listNATRules(egressIPKey)
+	if err != nil {
+		return err
+	}
+	clusterRouter, routes, err := listStaticRoutes(egressIPKey)
+	if err != nil {
+		return err
+	}
+
+	// Where each egress IP lives now.
+	current := make(map[string]*gateway)
+	for _, rule := range rules {
+		if gw := routerOf(gateways, rule.uuid); gw != nil {
+			current[rule.externalIP] = gw
+		}
+	}
+
+	// The SNAT rules each gateway should have, keyed by logical ip.
+	type snat struct {
+		logicalIP  string
+		externalIP string
+		pod        string
+		namespace  string
+	}
+	desired := make(map[string]map[string]snat)
+	owners := make(map[string]*gateway)
+	rejected := make(map[string]string)
+	for i := range cluster.Pods {
+		pod := &cluster.Pods[i]
+		egressIP := podEgressIP(cluster, pod)
+		if egressIP == "" || pod.Status.PodIP == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		if namespaceTenant(cluster, pod.Metadata.Namespace) != "" {
+			r.rejectEgressIP(rejected, pod, "egress ips are not assigned to the pods of tenants")
+			continue
+		}
+		ip := net.ParseIP(egressIP)
+		if ip == nil {
+			log.Printf("invalid egress ip %q for pod %v/%v", egressIP, pod.Metadata.Namespace, pod.Metadata.Name)
+			continue
+		}
+		owner, ok := owners[ip.String()]
+		if !ok {
+			owner = chooseEgressGateway(cluster, gateways, ip, current[ip.String()])
+			owners[ip.String()] = owner
+			if owner == nil {
+				log.Printf("no healthy gateway can host egress ip %v", ip)
+			}
+		}
+		if owner == nil {
+			continue
+		}
+		if desired[owner.router] == nil {
+			desired[owner.router] = make(map[string]snat)
+		}
+		desired[owner.router][pod.Status.PodIP] = snat{
+			logicalIP:  pod.Status.PodIP,
+			externalIP: ip.String(),
+			pod:        pod.Metadata.Namespace + "/" + pod.Metadata.Name,
+			namespace:  pod.Metadata.Namespace,
+		}
+	}
+	r.rejected = rejected
+
+	// The source based route of each pod goes to the owner of its egress IP,
+	// otherwise the pod's traffic leaves through whichever gateway holds the
+	// cluster's default route.
+	routed := make(map[string]snat)
+	nexthops := make(map[string]string)
+	for router, snats := range desired {
+		for _, s := range snats {
+			prefix := s.logicalIP + "/32"
+			routed[prefix] = s
+			nexthops[prefix] = gateways[router].joinIP.String()
+		}
+	}
+
+	txn := &ovn.Transaction{}
+	// Drop the rules that are stale or on the wrong gateway.  The rules of
+	// frozen pods are kept, and so are their egress IPs on the external
+	// ports.
+	frozen := make(map[string]*gateway)
+	for _, rule := range rules {
+		gw := routerOf(gateways, rule.uuid)
+		if gw == nil {
+			continue
+		}
+		if cluster.frozen(rule.externalIDs["pod"]) {
+			frozen[rule.externalIP] = gw
+			continue
+		}
+		want, ok := desired[gw.router][rule.logicalIP]
+		if ok && want.externalIP == rule.externalIP {
+			restampTenant(txn, cluster, "nat", rule.uuid, rule.externalIDs, want.namespace)
+			exemptNoSNAT(txn, gw, rule)
+			delete(desired[gw.router], rule.logicalIP)
+			continue
+		}
+		txn.Add("remove", "logical_router", gw.router, "nat", rule.uuid)
+	}
+	for _, route := range routes {
+		if cluster.frozen(route.externalIDs["pod"]) {
+			continue
+		}
+		s, ok := routed[route.ipPrefix]
+		if ok && nexthops[route.ipPrefix] == route.nexthop && route.policy == "src-ip" && route.externalIDs[egressIPKey] == s.externalIP {
+			restampTenant(txn, cluster, "logical_router_static_route", route.uuid, route.externalIDs, s.namespace)
+			delete(routed, route.ipPrefix)
+			continue
+		}
+		txn.Add("remove", "logical_router", clusterRouter, "static_routes", route.uuid)
+	}
+
+	// Add the missing ones.
+	id := 0
+	for router, snats := range desired {
+		for _, s := range snats {
+			id++
+			ref := fmt.Sprintf("@egress%d", id)
+			args := []string{"--id=" + ref, "create", "nat", "type=snat", "logical_ip=" + s.logicalIP, "external_ip=" + s.externalIP,
+				"external_ids:" + egressIPKey + "=" + s.externalIP, "external_ids:pod=\"" + s.pod + "\""}
+			args = append(args, noSNATArgs(gateways[router])...)
+			txn.Add(append(args, tenantExternalIDs(cluster, s.namespace)...)...)
+			txn.Add("add", "logical_router", router, "nat", ref)
+		}
+	}
+	for prefix, s := range routed {
+		id++
+		ref := fmt.Sprintf("@route%d", id)
+		args := []string{"--id=" + ref, "create", "logical_router_static_route", "ip_prefix=\"" + prefix + "\"", "nexthop=\"" + nexthops[prefix] + "\"",
+			"policy=src-ip", "external_ids:" + egressIPKey + "=" + s.externalIP, "external_ids:pod=\"" + s.pod + "\""}
+		txn.Add(append(args, tenantExternalIDs(cluster, s.namespace)...)...)
+		txn.Add("add", "logical_router", clusterRouter, "static_routes", ref)
+	}
+
+	// The owner of an egress IP answers ARP for it on its external port.
+	for _, gw := range gateways {
+		if gw.external == nil {
+			continue
+		}
+		ones, _ := gw.external.Mask.Size()
+		want := make(map[string]bool)
+		for ip, owner := range owners {
+			if owner == gw {
+				want[fmt.Sprintf("%s/%d", ip, ones)] = true
+			}
+		}
+		for ip, owner := range frozen {
+			if owner == gw {
+				want[fmt.Sprintf("%s/%d", ip, ones)] = true
+			}
+		}
+		for _, network := range gw.networks {
+			if want[network] {
+				delete(want, network)
+				continue
+			}
+			ip, _, err := net.ParseCIDR(network)
+			if err != nil || ip.Equal(gw.external.IP) {
+				continue
+			}
+			if _, used := current[ip.String()]; used || isEgressNetwork(rules, ip) {
+				txn.Add("remove", "logical_router_port", "rtoe-"+gw.router, "networks", "\""+network+"\"")
+			}
+		}
+		for network := range want {
+			txn.Add("add", "logical_router_port", "rtoe-"+gw.router, "networks", "\""+network+"\"")
+		}
+	}
+	return txn.Commit()
+}
+
+// isEgressNetwork reports whether ip is an egress IP of one of rules.  Only
+// those addresses are removed from external ports, others were added by
+// someone else.
+func isEgressNetwork(rules []*natRule, ip net.IP) bool {
+	for _, rule := range rules {
+		if rule.externalIP == ip.String() {
+			return true
+		}
+	}
+	return false
+}
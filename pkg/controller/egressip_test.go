@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+)
+
+// egressIPTables has two gateways, GR_node1 owning the egress IP
+// 192.0.2.50 of pod ns1/p1 and GR_node2.
+func egressIPTables() map[string][]map[string]string {
+	return map[string][]map[string]string{
+		"logical_router": {
+			{"_uuid": "gr1", "name": "GR_node1", "nat": "nat1", "options": "chassis=ch1", "external_ids": "physical_ip=192.0.2.10"},
+			{"_uuid": "gr2", "name": "GR_node2", "options": "chassis=ch2", "external_ids": "physical_ip=192.0.2.11"},
+			{"_uuid": "cr", "name": "ovn_cluster_router", "static_routes": "route1", "external_ids": "k8s-cluster-router=yes"},
+		},
+		"logical_router_port": {
+			{"name": "rtoe-GR_node1", "networks": "192.0.2.10/24 192.0.2.50/24"},
+			{"name": "rtoe-GR_node2", "networks": "192.0.2.11/24"},
+			{"name": "rtoj-GR_node1", "networks": "100.64.0.2/16"},
+			{"name": "rtoj-GR_node2", "networks": "100.64.0.3/16"},
+		},
+		"nat": {
+			{"_uuid": "nat1", "type": "snat", "logical_ip": "10.1.0.5", "external_ip": "192.0.2.50", "external_ids": "k8s-egress-ip=192.0.2.50 pod=ns1/p1"},
+		},
+		"logical_router_static_route": {
+			{"_uuid": "route1", "ip_prefix": "10.1.0.5/32", "nexthop": "100.64.0.2", "policy": "src-ip", "external_ids": "k8s-egress-ip=192.0.2.50 pod=ns1/p1"},
+		},
+	}
+}
+
+func TestEgressIPReconcile(t *testing.T) {
+	egressIP := map[string]string{EgressIPAnnotation: "192.0.2.50"}
+	tests := []struct {
+		name     string
+		pods     []common.Pod
+		node1    bool
+		tenant   bool
+		frozen   bool
+		want     []string
+		unwanted []string
+	}{
+		{
+			name:     "kept on its healthy owner",
+			pods:     []common.Pod{testPod("ns1", "p1", "node3", "10.1.0.5", egressIP)},
+			node1:    true,
+			unwanted: []string{"remove", "add", "--id"},
+		},
+		{
+			name: "moved when its owner fails",
+			pods: []common.Pod{testPod("ns1", "p1", "node3", "10.1.0.5", egressIP)},
+			want: []string{
+				"remove logical_router GR_node1 nat nat1",
+				"--id=@egress1 create nat type=snat logical_ip=10.1.0.5 external_ip=192.0.2.50",
+				"add logical_router GR_node2 nat @egress1",
+				"remove logical_router cr static_routes route1",
+				`--id=@route2 create logical_router_static_route ip_prefix="10.1.0.5/32" nexthop="100.64.0.3" policy=src-ip`,
+				"add logical_router cr static_routes @route2",
+				`remove logical_router_port rtoe-GR_node1 networks "192.0.2.50/24"`,
+				`add logical_router_port rtoe-GR_node2 networks "192.0.2.50/24"`,
+			},
+		},
+		{
+			name:  "released when the pod is gone",
+			node1: true,
+			want: []string{
+				"remove logical_router GR_node1 nat nat1",
+				"remove logical_router cr static_routes route1",
+				`remove logical_router_port rtoe-GR_node1 networks "192.0.2.50/24"`,
+			},
+			unwanted: []string{"add", "--id"},
+		},
+		{
+			name:   "released when the pod is a tenant's",
+			pods:   []common.Pod{testPod("ns1", "p1", "node3", "10.1.0.5", egressIP)},
+			node1:  true,
+			tenant: true,
+			want: []string{
+				"remove logical_router GR_node1 nat nat1",
+				"remove logical_router cr static_routes route1",
+				`remove logical_router_port rtoe-GR_node1 networks "192.0.2.50/24"`,
+			},
+			unwanted: []string{"add", "--id"},
+		},
+		{
+			name:     "kept while the pod's namespace is frozen",
+			frozen:   true,
+			unwanted: []string{"remove", "add", "--id"},
+		},
+	}
+	for _, test := range tests {
+		f := runFakeNB(egressIPTables())
+		cluster := &Cluster{
+			Pods:             test.pods,
+			Namespaces:       map[string]*common.Namespace{"ns1": testNamespace(test.tenant)},
+			Nodes:            map[string]*common.Node{"node1": testNode(test.node1), "node2": testNode(true)},
+			TenantIDs:        map[string]string{"t1": "t1"},
+			FrozenNamespaces: map[string]bool{"ns1": test.frozen},
+		}
+		err := (&EgressIPReconciler{}).Reconcile(cluster)
+		f.stop()
+		if err != nil {
+			t.Errorf("%v: Reconcile failed: %v", test.name, err)
+			continue
+		}
+		f.expect(t, test.name, test.want, test.unwanted)
+	}
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// FloatingIPAnnotation requests a floating IP for a pod.  The value is
+// "true" for any address of the pool, or the address wanted.
+const FloatingIPAnnotation = "ovn.stackube/floating-ip"
+
+// FloatingIPAddressAnnotation is set by the controller to the floating IP
+// assigned to the pod.
+const FloatingIPAddressAnnotation = "ovn.stackube/floating-ip-address"
+
+// floatingIPKey marks the NAT rows managed by FloatingIPReconciler.  Its
+// value is the pod, as namespace/name.
+const floatingIPKey = "k8s-floating-ip"
+
+// FloatingIPReconciler gives pods that ask for it an external IP from Pool
+// through a dnat_and_snat rule on a gateway router whose external subnet
+// contains the IP.  The pod's own node is preferred when it is a gateway.
+// The IP goes back to the pool when the pod goes away.  Without a Pool no
+// floating IPs are assigned and the existing ones are removed.
+//
+// The rules live on gateway routers, which are bound to their chassis, so
+// they are not distributed: logical_port and external_mac are left unset.
+//
+// The pods of tenants are left out: they are behind their tenant router,
+// which the gateway routers do not route to, and their addresses may be
+// used by other tenants too.  An event is recorded on those that ask for a
+// floating IP.
+type FloatingIPReconciler struct {
+	Server string
+	Pool   *net.IPNet
+
+	// rejected maps the uids of the pods refused a floating IP to the
+	// message of the event recorded for them.
+	rejected map[string]string
+}
+
+func (r *FloatingIPReconciler) Name() string {
+	return "floating-ip"
+}
+
+// rejectFloatingIP records an event on pod saying why it has no floating
+// IP, once per message.
+func (r *FloatingIPReconciler) rejectFloatingIP(rejected map[string]string, pod *common.Pod, message string) {
+	rejected[pod.Metadata.UID] = message
+	if r.rejected[pod.Metadata.UID] == message {
+		return
+	}
+	log.Printf("pod %v: %v", podKey(pod), message)
+	object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on pod %v: %v", podKey(pod), message), func() error {
+		return common.RecordEvent(r.Server, component, object, "FloatingIPRejected", message)
+	})
+	if err != nil {
+		log.Printf("pod %v: failed to record event: %v", podKey(pod), err)
+		delete(rejected, pod.Metadata.UID)
+	}
+}
+
+// chooseFloatingIPGateway prefers the gateway of the pod's node and falls
+// back to the first healthy gateway that can host ip.
+func chooseFloatingIPGateway(cluster *Cluster, gateways map[string]*gateway, pod *common.Pod, ip net.IP) *gateway {
+	if gw, ok := gateways["GR_"+pod.Spec.NodeName]; ok && gw.healthy(cluster) && gw.external != nil && gw.external.Contains(ip) {
+		return gw
+	}
+	return chooseEgressGateway(cluster, gateways, ip, nil)
+}
+
+func (r *FloatingIPReconciler) Reconcile(cluster *Cluster) error {
+	gateways, err := listGateways()
+	if err != nil {
+		return err
+	}
+	rules, err := listNATRules(floatingIPKey)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]*common.Pod)
+	rejected := make(map[string]string)
+	var pool *common.IPAllocator
+	if r.Pool != nil {
+		if pool, err = common.NewIPAllocator(r.Pool); err != nil {
+			return fmt.Errorf("invalid floating ip pool: %v", err)
+		}
+		for i := range cluster.Pods {
+			pod := &cluster.Pods[i]
+			if pod.Metadata.Annotations[FloatingIPAnnotation] == "" || pod.Status.PodIP == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+				continue
+			}
+			if namespaceTenant(cluster, pod.Metadata.Namespace) != "" {
+				r.rejectFloatingIP(rejected, pod, "floating ips are not assigned to the pods of tenants")
+				continue
+			}
+			wanted[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod
+		}
+	}
+	r.rejected = rejected
+	assigned := make(map[string]net.IP)
+	txn := &ovn.Transaction{}
+	// Keep the rules of pods that still want them on a healthy gateway and
+	// release the others.
+	for _, rule := range rules {
+		key := rule.externalIDs[floatingIPKey]
+		gw := routerOf(gateways, rule.uuid)
+		pod, ok := wanted[key]
+		ip := net.ParseIP(rule.externalIP)
+		if cluster.frozen(key) {
+			// The pod keeps its rule and address as they are.
+			if ip != nil && pool != nil {
+				pool.AllocateIP(ip)
+			}
+			continue
+		}
+		// Rules of older versions may still be distributed.
+		keep := ok && ip != nil && gw != nil && gw.healthy(cluster) && rule.logicalIP == pod.Status.PodIP && rule.logicalPort == ""
+		if keep {
+			if requested := requestedFloatingIP(pod); requested != nil && !requested.Equal(ip) {
+				keep = false
+			}
+		}
+		if ok && ip != nil && pool.AllocateIP(ip) == nil {
+			// The pod keeps its address even if the rule has to move.
+			assigned[key] = ip
+		}
+		if keep {
+			restampTenant(txn, cluster, "nat", rule.uuid, rule.externalIDs, pod.Metadata.Namespace)
+			exemptNoSNAT(txn, gw, rule)
+			delete(wanted, key)
+			continue
+		}
+		if gw != nil {
+			txn.Add("remove", "logical_router", gw.router, "nat", rule.uuid)
+		}
+	}
+
+	id := 0
+	for key, pod := range wanted {
+		ip := assigned[key]
+		if requested := requestedFloatingIP(pod); requested != nil && !requested.Equal(ip) {
+			if ip != nil {
+				pool.Release(ip)
+			}
+			if err := pool.AllocateIP(requested); err != nil {
+				log.Printf("pod %v: can not assign floating ip %v: %v", key, requested, err)
+				continue
+			}
+			ip = requested
+		}
+		if ip == nil {
+			ip, err = pool.Allocate()
+			if err != nil {
+				log.Printf("pod %v: %v", key, err)
+				continue
+			}
+		}
+		gw := chooseFloatingIPGateway(cluster, gateways, pod, ip)
+		if gw == nil {
+			log.Printf("pod %v: no healthy gateway can host floating ip %v", key, ip)
+			pool.Release(ip)
+			continue
+		}
+		id++
+		ref := fmt.Sprintf("@fip%d", id)
+		args := []string{"--id=" + ref, "create", "nat", "type=dnat_and_snat", "logical_ip=" + pod.Status.PodIP, "external_ip=" + ip.String(),
+			"external_ids:" + floatingIPKey + "=\"" + key + "\""}
+		args = append(args, noSNATArgs(gw)...)
+		args = append(args, tenantExternalIDs(cluster, pod.Metadata.Namespace)...)
+		txn.Add(args...)
+		txn.Add("add", "logical_router", gw.router, "nat", ref)
+		assigned[key] = ip
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	// Tell the pods which address they got.
+	for i := range cluster.Pods {
+		pod := &cluster.Pods[i]
+		key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+		address := ""
+		if ip, ok := assigned[key]; ok && pod.Metadata.Annotations[FloatingIPAnnotation] != "" {
+			address = ip.String()
+		}
+		if pod.Metadata.Annotations[FloatingIPAddressAnnotation] == address {
+			continue
+		}
+		err := exec.Apply(fmt.Sprintf("annotate pod %v %v=%q", key, FloatingIPAddressAnnotation, address), func() error {
+			return common.PatchPodAnnotations(r.Server, pod.Metadata.Namespace, pod.Metadata.Name, map[string]string{FloatingIPAddressAnnotation: address})
+		})
+		if err != nil {
+			log.Printf("pod %v: failed to record floating ip: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// requestedFloatingIP returns the address a pod asked for, or nil when it
+// takes any address of the pool.
+func requestedFloatingIP(pod *common.Pod) net.IP {
+	return net.ParseIP(pod.Metadata.Annotations[FloatingIPAnnotation])
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+)
+
+// floatingIPTables has two gateways, GR_node1 holding the floating IP
+// 192.0.2.40 of pod ns1/p1 and GR_node2.
+func floatingIPTables() map[string][]map[string]string {
+	return map[string][]map[string]string{
+		"logical_router": {
+			{"_uuid": "gr1", "name": "GR_node1", "nat": "fip1", "options": "chassis=ch1", "external_ids": "physical_ip=192.0.2.10"},
+			{"_uuid": "gr2", "name": "GR_node2", "options": "chassis=ch2", "external_ids": "physical_ip=192.0.2.11"},
+		},
+		"logical_router_port": {
+			{"name": "rtoe-GR_node1", "networks": "192.0.2.10/24"},
+			{"name": "rtoe-GR_node2", "networks": "192.0.2.11/24"},
+			{"name": "rtoj-GR_node1", "networks": "100.64.0.2/16"},
+			{"name": "rtoj-GR_node2", "networks": "100.64.0.3/16"},
+		},
+		"nat": {
+			{"_uuid": "fip1", "type": "dnat_and_snat", "logical_ip": "10.1.0.5", "external_ip": "192.0.2.40", "external_ids": "k8s-floating-ip=ns1/p1"},
+		},
+	}
+}
+
+func TestFloatingIPReconcile(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("192.0.2.32/28")
+	tests := []struct {
+		name     string
+		pods     []common.Pod
+		node1    bool
+		tenant   bool
+		want     []string
+		unwanted []string
+	}{
+		{
+			name:     "kept on its healthy gateway",
+			pods:     []common.Pod{testPod("ns1", "p1", "node1", "10.1.0.5", map[string]string{FloatingIPAnnotation: "true"})},
+			node1:    true,
+			unwanted: []string{"remove", "add", "--id"},
+		},
+		{
+			name: "moved with its address when the gateway fails",
+			pods: []common.Pod{testPod("ns1", "p1", "node1", "10.1.0.5", map[string]string{FloatingIPAnnotation: "true"})},
+			want: []string{
+				"remove logical_router GR_node1 nat fip1",
+				"--id=@fip1 create nat type=dnat_and_snat logical_ip=10.1.0.5 external_ip=192.0.2.40",
+				"add logical_router GR_node2 nat @fip1",
+			},
+		},
+		{
+			name:  "replaced when the pod asks for another address",
+			pods:  []common.Pod{testPod("ns1", "p1", "node1", "10.1.0.5", map[string]string{FloatingIPAnnotation: "192.0.2.41"})},
+			node1: true,
+			want: []string{
+				"remove logical_router GR_node1 nat fip1",
+				"--id=@fip1 create nat type=dnat_and_snat logical_ip=10.1.0.5 external_ip=192.0.2.41",
+				"add logical_router GR_node1 nat @fip1",
+			},
+		},
+		{
+			name:     "released when the pod is a tenant's",
+			pods:     []common.Pod{testPod("ns1", "p1", "node1", "10.1.0.5", map[string]string{FloatingIPAnnotation: "true"})},
+			node1:    true,
+			tenant:   true,
+			want:     []string{"remove logical_router GR_node1 nat fip1"},
+			unwanted: []string{"add", "--id"},
+		},
+		{
+			name:     "released when the pod is gone",
+			node1:    true,
+			want:     []string{"remove logical_router GR_node1 nat fip1"},
+			unwanted: []string{"add", "--id"},
+		},
+	}
+	for _, test := range tests {
+		f := runFakeNB(floatingIPTables())
+		cluster := &Cluster{
+			Pods:       test.pods,
+			Namespaces: map[string]*common.Namespace{"ns1": testNamespace(test.tenant)},
+			Nodes:      map[string]*common.Node{"node1": testNode(test.node1), "node2": testNode(true)},
+			TenantIDs:  map[string]string{"t1": "t1"},
+		}
+		err := (&FloatingIPReconciler{Pool: pool}).Reconcile(cluster)
+		f.stop()
+		if err != nil {
+			t.Errorf("%v: Reconcile failed: %v", test.name, err)
+			continue
+		}
+		f.expect(t, test.name, test.want, test.unwanted)
+	}
+}
@@ -0,0 +1,316 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// gateway is a gateway router created by "ovnctl gateway".
+type gateway struct {
+	router string
+	node   string
+	// chassis is the chassis the router is bound to.
+	chassis string
+	// first is set on the gateway the cluster's default route points to.
+	first bool
+	// joinIP is the router's address on the "join" switch.
+	joinIP net.IP
+	// external is the physical address of the router's external port, as
+	// recorded in the router's external_ids:physical_ip.
+	external *net.IPNet
+	// networks are all the networks of the external port, including
+	// external and the egress IPs the router owns.
+	networks []string
+	// nat are the uuids of the router's NAT rows.
+	nat map[string]bool
+	// noSNAT is the uuid of the address set of destinations that see the
+	// real pod ips, see "ovnctl gateway --no-snat-destinations", or "".
+	noSNAT string
+}
+
+// natRule is a row of the NAT table.
+type natRule struct {
+	uuid        string
+	natType     string
+	logicalIP   string
+	externalIP  string
+	logicalPort string
+	externalMac string
+	// exemptedExtIPs is the address set of destinations that are not
+	// SNATed, or "".
+	exemptedExtIPs string
+	externalIDs    map[string]string
+}
+
+// listGateways returns the gateway routers by name.
+func listGateways() (map[string]*gateway, error) {
+	routers, err := ovn.ListRows("logical_router", []string{"name", "nat", "options", "external_ids"})
+	if err != nil {
+		return nil, err
+	}
+	ports, err := ovn.ListRows("logical_router_port", []string{"name", "networks"})
+	if err != nil {
+		return nil, err
+	}
+	networks := make(map[string][]string)
+	for _, port := range ports {
+		networks[port["name"]] = ovn.ParseSet(port["networks"])
+	}
+	sets, err := ovn.ListRows("address_set", []string{"_uuid", "name"})
+	if err != nil {
+		return nil, err
+	}
+	addressSets := make(map[string]string)
+	for _, set := range sets {
+		addressSets[set["name"]] = set["_uuid"]
+	}
+
+	gateways := make(map[string]*gateway)
+	for _, router := range routers {
+		name := router["name"]
+		if !strings.HasPrefix(name, "GR_") || ovn.ParseMap(router["options"])["chassis"] == "" {
+			continue
+		}
+		gw := &gateway{
+			router:   name,
+			node:     strings.TrimPrefix(name, "GR_"),
+			chassis:  ovn.ParseMap(router["options"])["chassis"],
+			networks: networks["rtoe-"+name],
+			nat:      make(map[string]bool),
+			noSNAT:   addressSets["no_snat_"+name],
+			first:    ovn.ParseMap(router["external_ids"])["first_gateway"] == "yes",
+		}
+		for _, uuid := range ovn.ParseSet(router["nat"]) {
+			gw.nat[uuid] = true
+		}
+		if join := networks["rtoj-"+name]; len(join) > 0 {
+			gw.joinIP, _, _ = net.ParseCIDR(join[0])
+		}
+		physicalIP := net.ParseIP(ovn.ParseMap(router["external_ids"])["physical_ip"])
+		for _, network := range gw.networks {
+			ip, ipNet, err := net.ParseCIDR(network)
+			if err == nil && ip.Equal(physicalIP) {
+				ipNet.IP = ip
+				gw.external = ipNet
+				break
+			}
+		}
+		gateways[name] = gw
+	}
+	return gateways, nil
+}
+
+// healthy reports whether the gateway's node is known and ready.
+func (gw *gateway) healthy(cluster *Cluster) bool {
+	node, ok := cluster.Nodes[gw.node]
+	return ok && node.Ready()
+}
+
+// sortedGateways returns the gateways ordered by router name.
+func sortedGateways(gateways map[string]*gateway) []*gateway {
+	var sorted []*gateway
+	for _, gw := range gateways {
+		sorted = append(sorted, gw)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].router < sorted[j].router })
+	return sorted
+}
+
+// routerOf returns the gateway holding the NAT row uuid, or nil.
+func routerOf(gateways map[string]*gateway, uuid string) *gateway {
+	for _, gw := range gateways {
+		if gw.nat[uuid] {
+			return gw
+		}
+	}
+	return nil
+}
+
+// listNATRules returns the NAT rows that have the external_ids key set.
+func listNATRules(key string) ([]*natRule, error) {
+	columns := []string{"_uuid", "type", "logical_ip", "external_ip", "logical_port", "external_mac", "external_ids"}
+	exempted, err := ovn.HasColumn("nat", "exempted_ext_ips")
+	if err != nil {
+		return nil, err
+	}
+	if exempted {
+		columns = append(columns, "exempted_ext_ips")
+	}
+	rows, err := ovn.ListRows("nat", columns)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*natRule
+	for _, row := range rows {
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		if _, ok := externalIDs[key]; !ok {
+			continue
+		}
+		rules = append(rules, &natRule{
+			uuid:           row["_uuid"],
+			natType:        row["type"],
+			logicalIP:      row["logical_ip"],
+			externalIP:     row["external_ip"],
+			logicalPort:    row["logical_port"],
+			externalMac:    row["external_mac"],
+			exemptedExtIPs: row["exempted_ext_ips"],
+			externalIDs:    externalIDs,
+		})
+	}
+	return rules, nil
+}
+
+// exemptNoSNAT adds the commands that make the NAT row of rule on gw leave
+// the gateway's no-SNAT destinations alone to txn.
+func exemptNoSNAT(txn *ovn.Transaction, gw *gateway, rule *natRule) {
+	if rule.exemptedExtIPs == gw.noSNAT {
+		return
+	}
+	if gw.noSNAT == "" {
+		txn.Add("clear", "nat", rule.uuid, "exempted_ext_ips")
+		return
+	}
+	txn.Add("set", "nat", rule.uuid, "exempted_ext_ips="+gw.noSNAT)
+}
+
+// noSNATArgs returns the arguments that exempt the gateway's no-SNAT
+// destinations when a NAT row is created on gw.
+func noSNATArgs(gw *gateway) []string {
+	if gw.noSNAT == "" {
+		return nil
+	}
+	return []string{"exempted_ext_ips=" + gw.noSNAT}
+}
+
+// staticRoute is a row of the Logical_Router_Static_Route table.
+type staticRoute struct {
+	uuid        string
+	ipPrefix    string
+	nexthop     string
+	policy      string
+	externalIDs map[string]string
+}
+
+// getClusterRouter returns the uuid of the distributed cluster router.
+func getClusterRouter() (string, []string, error) {
+	rows, err := ovn.ListRows("logical_router", []string{"_uuid", "static_routes"}, "external_ids:k8s-cluster-router=yes")
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rows) == 0 {
+		return "", nil, fmt.Errorf("cluster router not found")
+	}
+	return rows[0]["_uuid"], ovn.ParseSet(rows[0]["static_routes"]), nil
+}
+
+// listStaticRoutes returns the static routes of the cluster router that
+// have the external_ids key set.
+func listStaticRoutes(key string) (string, []*staticRoute, error) {
+	router, uuids, err := getClusterRouter()
+	if err != nil {
+		return "", nil, err
+	}
+	onRouter := make(map[string]bool)
+	for _, uuid := range uuids {
+		onRouter[uuid] = true
+	}
+	rows, err := ovn.ListRows("logical_router_static_route", []string{"_uuid", "ip_prefix", "nexthop", "policy", "external_ids"})
+	if err != nil {
+		return "", nil, err
+	}
+	var routes []*staticRoute
+	for _, row := range rows {
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		if _, ok := externalIDs[key]; !ok || !onRouter[row["_uuid"]] {
+			continue
+		}
+		routes = append(routes, &staticRoute{
+			uuid:        row["_uuid"],
+			ipPrefix:    row["ip_prefix"],
+			nexthop:     row["nexthop"],
+			policy:      row["policy"],
+			externalIDs: externalIDs,
+		})
+	}
+	return router, routes, nil
+}
+
+// chassisGateways returns the healthy gateways connected to the "join"
+// switch, ordered by the priority their chassis get for distributed gateway
+// ports: the gateway holding the cluster's default route comes first, the
+// others follow by name.
+func chassisGateways(cluster *Cluster, gateways map[string]*gateway) []*gateway {
+	var healthy []*gateway
+	first := -1
+	for _, gw := range sortedGateways(gateways) {
+		if !gw.healthy(cluster) || gw.joinIP == nil || gw.chassis == "" {
+			continue
+		}
+		if gw.first && first < 0 {
+			first = len(healthy)
+		}
+		healthy = append(healthy, gw)
+	}
+	if first > 0 {
+		gw := healthy[first]
+		copy(healthy[1:first+1], healthy[:first])
+		healthy[0] = gw
+	}
+	return healthy
+}
+
+// listGatewayChassis returns the gateway chassis of the router ports, as
+// "chassis:priority", by port name.
+func listGatewayChassis() (map[string][]string, error) {
+	rows, err := ovn.ListRows("gateway_chassis", []string{"_uuid", "chassis_name", "priority"})
+	if err != nil {
+		return nil, err
+	}
+	chassisOf := make(map[string]string)
+	for _, row := range rows {
+		chassisOf[row["_uuid"]] = row["chassis_name"] + ":" + row["priority"]
+	}
+	ports, err := ovn.ListRows("logical_router_port", []string{"name", "gateway_chassis"})
+	if err != nil {
+		return nil, err
+	}
+	chassis := make(map[string][]string)
+	for _, port := range ports {
+		for _, uuid := range ovn.ParseSet(port["gateway_chassis"]) {
+			chassis[port["name"]] = append(chassis[port["name"]], chassisOf[uuid])
+		}
+	}
+	return chassis, nil
+}
+
+// setGatewayChassis adds the commands that bind the router port to the
+// chassis of gateways, in the order of chassisGateways, to txn.  current
+// are the port's gateway chassis as returned by listGatewayChassis.  The
+// port is left alone if it is already bound that way or there is no
+// gateway to bind it to.
+func setGatewayChassis(txn *ovn.Transaction, port string, current []string, gateways []*gateway) {
+	if len(gateways) == 0 {
+		return
+	}
+	var want []string
+	for i, gw := range gateways {
+		want = append(want, fmt.Sprintf("%s:%d", gw.chassis, len(gateways)-i))
+	}
+	sort.Strings(want)
+	have := append([]string(nil), current...)
+	sort.Strings(have)
+	if strings.Join(have, ",") == strings.Join(want, ",") {
+		return
+	}
+	for _, chassis := range have {
+		txn.Add("lrp-del-gateway-chassis", port, strings.SplitN(chassis, ":", 2)[0])
+	}
+	for i, gw := range gateways {
+		txn.Add("lrp-set-gateway-chassis", port, gw.chassis, strconv.Itoa(len(gateways)-i))
+	}
+}
@@ -0,0 +1,223 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// MetadataReconciler brings pods to the metadata proxy of their node, the
+// way Mode says, and keeps everything but the metadata traffic of a
+// switch's own pods away from it with an ACL.  Since a switch only holds
+// pods of one tenant, the proxy only sees requests of that tenant.  Without
+// a mode the rows created before are removed.
+type MetadataReconciler struct {
+	Mode string
+}
+
+func (r *MetadataReconciler) Name() string {
+	return "metadata"
+}
+
+// metadataRow is an ACL or router policy marked with common.MetadataKey.
+type metadataRow struct {
+	uuid    string
+	sw      string
+	match   string
+	nexthop string
+}
+
+// listMetadataRows returns the marked rows of table.
+func listMetadataRows(table string, columns []string) ([]*metadataRow, error) {
+	rows, err := ovn.ListRows(table, append([]string{"_uuid", "external_ids"}, columns...))
+	if err != nil {
+		return nil, err
+	}
+	var marked []*metadataRow
+	for _, row := range rows {
+		sw, ok := ovn.ParseMap(row["external_ids"])[common.MetadataKey]
+		if !ok {
+			continue
+		}
+		marked = append(marked, &metadataRow{uuid: row["_uuid"], sw: sw, match: row["match"], nexthop: row["nexthop"]})
+	}
+	return marked, nil
+}
+
+// managementPortACL returns the match of the ACL that drops metadata
+// traffic to the management port of a node that does not come from the
+// pods of its switch.
+func managementPortACL(node string, subnet *net.IPNet) string {
+	return fmt.Sprintf("outport == \"k8s-%s\" && ip4.dst == %s && !(ip4.src == %s && tcp.dst == 80)", node, common.MetadataIP, subnet)
+}
+
+// localportACL returns the match of the ACL that drops all the traffic to
+// the metadata localport of a switch but the metadata traffic of its pods.
+func localportACL(sw string, subnet *net.IPNet) string {
+	return fmt.Sprintf("outport == \"%s\" && ip4 && !(ip4.src == %s && ip4.dst == %s && tcp.dst == 80)", common.MetadataPortName(sw), subnet, common.MetadataIP)
+}
+
+// metadataPolicy returns the match of the policy that reroutes the
+// metadata traffic of subnet.
+func metadataPolicy(subnet *net.IPNet) string {
+	return fmt.Sprintf("ip4.src == %s && ip4.dst == %s", subnet, common.MetadataIP)
+}
+
+// metadataPort is the wanted state of a metadata localport.
+type metadataPort struct {
+	sw        string
+	addresses string
+	subnet    string
+	tenant    string
+	node      string
+}
+
+// upToDate reports whether row is the port p.
+func (p *metadataPort) upToDate(row map[string]string) bool {
+	externalIDs := ovn.ParseMap(row["external_ids"])
+	return row["addresses"] == p.addresses && externalIDs[common.MetadataKey] == p.sw &&
+		externalIDs["subnet"] == p.subnet && externalIDs[tenantKey] == p.tenant && externalIDs[nodeKey] == p.node
+}
+
+func (r *MetadataReconciler) Reconcile(cluster *Cluster) error {
+	switchRows, err := ovn.ListRows("logical_switch", []string{"name", "other_config", "external_ids"})
+	if err != nil {
+		return err
+	}
+	portRows, err := ovn.ListRows("logical_switch_port", []string{"name", "addresses", "external_ids"})
+	if err != nil {
+		return err
+	}
+	acls, err := listMetadataRows("acl", []string{"match"})
+	if err != nil {
+		return err
+	}
+	ports := make(map[string]map[string]string)
+	for _, row := range portRows {
+		ports[row["name"]] = row
+	}
+	// Older northbound schemas have no router policies, which only matter
+	// to the management port mode.
+	policies, err := listMetadataRows("logical_router_policy", []string{"match", "nexthop"})
+	if err != nil {
+		if r.Mode == common.MetadataModeManagementPort {
+			return err
+		}
+		policies = nil
+	}
+	clusterRouter := ""
+	if r.Mode == common.MetadataModeManagementPort || len(policies) > 0 {
+		routers, err := ovn.ListRows("logical_router", []string{"name", "external_ids"}, "external_ids:k8s-cluster-router=yes")
+		if err != nil {
+			return err
+		}
+		if len(routers) == 0 {
+			return fmt.Errorf("cluster router not found")
+		}
+		clusterRouter = routers[0]["name"]
+	}
+
+	wantACLs := make(map[string]string)
+	wantPolicies := make(map[string]string)
+	nexthops := make(map[string]string)
+	wantPorts := make(map[string]*metadataPort)
+	switches := make(map[string]bool)
+	for _, row := range switchRows {
+		name := row["name"]
+		switches[name] = true
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		_, subnet, err := net.ParseCIDR(ovn.ParseMap(row["other_config"])["subnet"])
+		if err != nil {
+			continue
+		}
+		switch r.Mode {
+		case common.MetadataModeManagementPort:
+			// The switches of the nodes are named after them.
+			if _, ok := cluster.Nodes[name]; !ok {
+				continue
+			}
+			mgmt, ok := ports["k8s-"+name]
+			fields := strings.Fields(mgmt["addresses"])
+			if !ok || len(fields) < 2 {
+				log.Printf("node %v: management port not found", name)
+				continue
+			}
+			wantPolicies[name] = metadataPolicy(subnet)
+			nexthops[name] = fields[1]
+			wantACLs[name] = managementPortACL(name, subnet)
+		case common.MetadataModeLocalport:
+			tenant, ok := externalIDs[tenantKey]
+			if !ok {
+				continue
+			}
+			ip := net.ParseIP(common.MetadataIP)
+			wantPorts[common.MetadataPortName(name)] = &metadataPort{
+				sw:        name,
+				addresses: common.IPToMac(ip) + " " + ip.String(),
+				subnet:    subnet.String(),
+				tenant:    tenant,
+				node:      externalIDs[nodeKey],
+			}
+			wantACLs[name] = localportACL(name, subnet)
+		}
+	}
+
+	txn := &ovn.Transaction{}
+	for name, port := range wantPorts {
+		if row, ok := ports[name]; ok && port.upToDate(row) {
+			continue
+		}
+		txn.Add("--may-exist", "lsp-add", port.sw, name)
+		txn.Add("lsp-set-type", name, "localport")
+		txn.Add("lsp-set-addresses", name, port.addresses)
+		txn.Add("set", "logical_switch_port", name, "external_ids:"+common.MetadataKey+"="+port.sw,
+			"external_ids:subnet="+port.subnet, "external_ids:"+tenantKey+"="+port.tenant)
+		if port.node != "" {
+			txn.Add("set", "logical_switch_port", name, "external_ids:"+nodeKey+"="+port.node)
+		}
+	}
+	for name, row := range ports {
+		if _, ok := ovn.ParseMap(row["external_ids"])[common.MetadataKey]; ok && wantPorts[name] == nil {
+			txn.Add("--if-exists", "lsp-del", name)
+		}
+	}
+
+	// Keep one matching row per switch, remove the others.
+	for _, acl := range acls {
+		if match, ok := wantACLs[acl.sw]; ok && match == acl.match {
+			delete(wantACLs, acl.sw)
+		} else if switches[acl.sw] {
+			txn.Add("remove", "logical_switch", acl.sw, "acls", acl.uuid)
+		}
+	}
+	n := 0
+	for sw, match := range wantACLs {
+		ref := fmt.Sprintf("@metadata_acl%d", n)
+		n++
+		txn.Add("--id="+ref, "create", "acl", "direction=to-lport", "priority=1000", "match="+strconv.Quote(match),
+			"action=drop", "external_ids:"+common.MetadataKey+"=\""+sw+"\"")
+		txn.Add("add", "logical_switch", sw, "acls", ref)
+	}
+
+	for _, policy := range policies {
+		if match, ok := wantPolicies[policy.sw]; ok && match == policy.match && nexthops[policy.sw] == policy.nexthop {
+			delete(wantPolicies, policy.sw)
+		} else {
+			txn.Add("remove", "logical_router", clusterRouter, "policies", policy.uuid)
+		}
+	}
+	n = 0
+	for sw, match := range wantPolicies {
+		ref := fmt.Sprintf("@metadata_policy%d", n)
+		n++
+		txn.Add("--id="+ref, "create", "logical_router_policy", "priority=1000", "match="+strconv.Quote(match),
+			"action=reroute", "nexthop="+strconv.Quote(nexthops[sw]), "external_ids:"+common.MetadataKey+"=\""+sw+"\"")
+		txn.Add("add", "logical_router", clusterRouter, "policies", ref)
+	}
+	return txn.Commit()
+}
@@ -0,0 +1,384 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// networkKey marks the switches and switch ports of Network resources.  Its
+// value is the network's name.
+const networkKey = "k8s-network"
+
+// NetworkReconciler creates a logical switch for every Network resource and
+// connects it to the router of the network's tenant, or to the cluster
+// router.  A network with a VLAN is also bridged to the provider network
+// through a localnet port; its router port is bound to the gateway chassis,
+// so that only one chassis answers for the gateway on the VLAN.  A network
+// whose CIDR overlaps another subnet of its router fails.  The OVN objects
+// and the address usage are reported in the network's status.
+type NetworkReconciler struct {
+	Server string
+	// PhysicalNetwork is the name localnet ports use for the provider
+	// network in ovn-bridge-mappings.
+	PhysicalNetwork string
+	// ClusterSubnet is the subnet the node switches on the cluster router
+	// are carved from, or nil if unknown.
+	ClusterSubnet *net.IPNet
+
+	// rejected maps the uids of the networks whose tenant is unknown to
+	// the message of the event recorded for them.
+	rejected map[string]string
+}
+
+func (r *NetworkReconciler) Name() string {
+	return "network"
+}
+
+func networkSwitchName(name string) string {
+	return "net_" + name
+}
+
+func networkLocalnetPort(name string) string {
+	return "provnet_" + name
+}
+
+// networkConfig is the validated spec of a network.
+type networkConfig struct {
+	subnet  *net.IPNet
+	gateway net.IP
+	tenant  string
+	router  string
+	dns     string
+	vlan    int
+}
+
+// networkConfig validates the spec of network.  clusterRouter is the
+// router of networks without a tenant.  used are the subnets taken on each
+// router by name, see checkOverlap.
+func (r *NetworkReconciler) networkConfig(cluster *Cluster, network *common.Network, clusterRouter string, used map[string][]*routerSubnet) (*networkConfig, error) {
+	spec := &network.Spec
+	_, subnet, err := net.ParseCIDR(spec.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q: %v", spec.CIDR, err)
+	}
+	cfg := &networkConfig{subnet: subnet, gateway: common.FirstIP(subnet), vlan: spec.VLAN}
+	if spec.Gateway != "" {
+		cfg.gateway = net.ParseIP(spec.Gateway)
+		if cfg.gateway == nil || !subnet.Contains(cfg.gateway) {
+			return nil, fmt.Errorf("gateway %q is not an address of %v", spec.Gateway, subnet)
+		}
+	}
+	for _, server := range spec.DNS {
+		if net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("invalid dns server %q", server)
+		}
+	}
+	cfg.dns = strings.Join(spec.DNS, ",")
+	// The switch hands out addresses of the whole subnet.
+	if _, err := common.NewIPAllocator(subnet); err != nil {
+		return nil, err
+	}
+	if spec.VLAN < 0 || spec.VLAN > 4094 {
+		return nil, fmt.Errorf("invalid vlan %d", spec.VLAN)
+	}
+	if spec.Tenant != "" {
+		if reason, unknown := cluster.UnknownTenants[spec.Tenant]; unknown {
+			return nil, &unknownTenantError{reason}
+		}
+		cfg.tenant = cluster.TenantIDs[spec.Tenant]
+		cfg.router = tenantRouterName(cfg.tenant)
+	} else if clusterRouter != "" {
+		cfg.router = clusterRouter
+	} else {
+		return nil, fmt.Errorf("cluster router not found")
+	}
+	if err := checkOverlap(used[cfg.router], "rtos-"+networkSwitchName(network.Metadata.Name), cfg.subnet); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// unknownTenantError fails a network whose tenant is unknown.
+type unknownTenantError struct {
+	reason string
+}
+
+func (e *unknownTenantError) Error() string {
+	return e.reason
+}
+
+// rejectNetwork records an event on network saying that its tenant is
+// unknown, once per message.
+func (r *NetworkReconciler) rejectNetwork(rejected map[string]string, network *common.Network, message string) {
+	rejected[network.Metadata.UID] = message
+	if r.rejected[network.Metadata.UID] == message {
+		return
+	}
+	object := common.ObjectReference{APIVersion: common.NetworkAPIVersion, Kind: "Network", Name: network.Metadata.Name, UID: network.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on network %v: %v", network.Metadata.Name, message), func() error {
+		return common.RecordEvent(r.Server, component, object, "TenantNotFound", message)
+	})
+	if err != nil {
+		log.Printf("network %v: failed to record event: %v", network.Metadata.Name, err)
+		delete(rejected, network.Metadata.UID)
+	}
+}
+
+// routerSubnet is a subnet taken on a router, by a router port or by the
+// cluster subnet.
+type routerSubnet struct {
+	port   string
+	owner  string
+	subnet *net.IPNet
+}
+
+// checkOverlap fails if subnet overlaps one of used, other than the ones of
+// the router port port.
+func checkOverlap(used []*routerSubnet, port string, subnet *net.IPNet) error {
+	for _, u := range used {
+		if u.port != port && common.Overlap(u.subnet, subnet) {
+			return fmt.Errorf("cidr %v overlaps %v of %v", subnet, u.subnet, u.owner)
+		}
+	}
+	return nil
+}
+
+// listRouterSubnets returns the subnets of the ports of each router by
+// router name.  The cluster subnet is added to clusterRouter's.
+func (r *NetworkReconciler) listRouterSubnets(clusterRouter string) (map[string][]*routerSubnet, error) {
+	routers, err := ovn.ListRows("logical_router", []string{"name", "ports"})
+	if err != nil {
+		return nil, err
+	}
+	ports, err := ovn.ListRows("logical_router_port", []string{"_uuid", "name", "networks"})
+	if err != nil {
+		return nil, err
+	}
+	routerOf := make(map[string]string)
+	for _, router := range routers {
+		for _, uuid := range ovn.ParseSet(router["ports"]) {
+			routerOf[uuid] = router["name"]
+		}
+	}
+	used := make(map[string][]*routerSubnet)
+	for _, port := range ports {
+		router, ok := routerOf[port["_uuid"]]
+		if !ok {
+			continue
+		}
+		for _, network := range ovn.ParseSet(port["networks"]) {
+			if _, subnet, err := net.ParseCIDR(network); err == nil {
+				used[router] = append(used[router], &routerSubnet{port: port["name"], owner: "router port " + port["name"], subnet: subnet})
+			}
+		}
+	}
+	if clusterRouter != "" && r.ClusterSubnet != nil {
+		used[clusterRouter] = append(used[clusterRouter], &routerSubnet{owner: "the cluster subnet", subnet: r.ClusterSubnet})
+	}
+	return used, nil
+}
+
+// upToDate reports whether sw was built from cfg.
+func (cfg *networkConfig) upToDate(sw *logicalSwitch) bool {
+	return sw.subnet != nil && sw.subnet.String() == cfg.subnet.String() &&
+		sw.externalIDs["gateway"] == cfg.gateway.String() &&
+		sw.externalIDs["router"] == cfg.router &&
+		sw.externalIDs["dns"] == cfg.dns &&
+		sw.externalIDs["vlan"] == strconv.Itoa(cfg.vlan)
+}
+
+// addNetworkSwitch adds the commands that create or rebuild the switch of
+// network to txn.
+func (r *NetworkReconciler) addNetworkSwitch(txn *ovn.Transaction, network *common.Network, cfg *networkConfig) {
+	name := networkSwitchName(network.Metadata.Name)
+	ones, _ := cfg.subnet.Mask.Size()
+	mac := common.IPToMac(cfg.gateway)
+	txn.Add("--may-exist", "ls-add", name)
+	txn.Add("set", "logical_switch", name, "other_config:subnet="+cfg.subnet.String(),
+		"external_ids:"+networkKey+"="+network.Metadata.Name, "external_ids:gateway="+cfg.gateway.String(),
+		"external_ids:router="+cfg.router, "external_ids:dns=\""+cfg.dns+"\"", "external_ids:vlan="+strconv.Itoa(cfg.vlan))
+	if cfg.tenant != "" {
+		txn.Add("set", "logical_switch", name, "external_ids:"+tenantKey+"="+cfg.tenant)
+	} else {
+		txn.Add("remove", "logical_switch", name, "external_ids", tenantKey)
+	}
+
+	// The router port moves along with the gateway and the tenant.
+	txn.Add("--if-exists", "lrp-del", "rtos-"+name)
+	txn.Add("lrp-add", cfg.router, "rtos-"+name, mac, fmt.Sprintf("%s/%d", cfg.gateway, ones))
+	txn.Add("--may-exist", "lsp-add", name, "stor-"+name)
+	txn.Add("set", "logical_switch_port", "stor-"+name, "type=router", "options:router-port=rtos-"+name, "addresses="+"\""+mac+"\"")
+
+	localnet := networkLocalnetPort(network.Metadata.Name)
+	if cfg.vlan == 0 {
+		txn.Add("--if-exists", "lsp-del", localnet)
+		return
+	}
+	txn.Add("--may-exist", "lsp-add", name, localnet)
+	txn.Add("lsp-set-addresses", localnet, "unknown")
+	txn.Add("lsp-set-type", localnet, "localnet")
+	txn.Add("lsp-set-options", localnet, "network_name="+r.PhysicalNetwork)
+	txn.Add("set", "logical_switch_port", localnet, fmt.Sprintf("tag=%d", cfg.vlan))
+}
+
+func (r *NetworkReconciler) Reconcile(cluster *Cluster) error {
+	routers, err := ovn.ListRows("logical_router", []string{"name", "external_ids"})
+	if err != nil {
+		return err
+	}
+	clusterRouter := ""
+	tenantRouters := make(map[string]bool)
+	for _, router := range routers {
+		externalIDs := ovn.ParseMap(router["external_ids"])
+		if externalIDs["k8s-cluster-router"] == "yes" {
+			clusterRouter = router["name"]
+		}
+		if _, ok := externalIDs[tenantKey]; ok {
+			tenantRouters[router["name"]] = true
+		}
+	}
+	switches, err := listLogicalSwitches(networkKey)
+	if err != nil {
+		return err
+	}
+	ports, err := listSwitchPorts(networkKey)
+	if err != nil {
+		return err
+	}
+	used, err := r.listRouterSubnets(clusterRouter)
+	if err != nil {
+		return err
+	}
+	gateways, err := listGateways()
+	if err != nil {
+		return err
+	}
+	chassis, err := listGatewayChassis()
+	if err != nil {
+		return err
+	}
+	healthy := chassisGateways(cluster, gateways)
+
+	// The networks that were built go first, so that a new network
+	// overlapping one of them is the one that fails.
+	var networks []*common.Network
+	for i := range cluster.Networks {
+		if _, ok := switches[networkSwitchName(cluster.Networks[i].Metadata.Name)]; ok {
+			networks = append(networks, &cluster.Networks[i])
+		}
+	}
+	for i := range cluster.Networks {
+		if _, ok := switches[networkSwitchName(cluster.Networks[i].Metadata.Name)]; !ok {
+			networks = append(networks, &cluster.Networks[i])
+		}
+	}
+
+	txn := &ovn.Transaction{}
+	statuses := make(map[*common.Network]*common.NetworkStatus)
+	seen := make(map[string]bool)
+	rejected := make(map[string]string)
+	for _, network := range networks {
+		name := networkSwitchName(network.Metadata.Name)
+		seen[name] = true
+		cfg, err := r.networkConfig(cluster, network, clusterRouter, used)
+		if err != nil {
+			// Leave what was built from the last valid spec alone.
+			statuses[network] = &common.NetworkStatus{Phase: "Failed", Message: err.Error()}
+			if _, unknown := err.(*unknownTenantError); unknown {
+				r.rejectNetwork(rejected, network, err.Error())
+			}
+			continue
+		}
+		used[cfg.router] = append(used[cfg.router], &routerSubnet{port: "rtos-" + name, owner: "network " + network.Metadata.Name, subnet: cfg.subnet})
+
+		if cfg.tenant != "" && !tenantRouters[cfg.router] {
+			txn.Add("--may-exist", "lr-add", cfg.router)
+			txn.Add("set", "logical_router", cfg.router, "external_ids:"+tenantKey+"="+cfg.tenant)
+			tenantRouters[cfg.router] = true
+		}
+		sw, ok := switches[name]
+		current := chassis["rtos-"+name]
+		if !ok || !cfg.upToDate(sw) {
+			r.addNetworkSwitch(txn, network, cfg)
+			if !ok {
+				sw = &logicalSwitch{name: name, ports: make(map[string]bool)}
+			}
+			sw.subnet = cfg.subnet
+			// The router port was recreated without gateway chassis.
+			current = nil
+		}
+		if cfg.vlan != 0 {
+			if len(healthy) == 0 {
+				log.Printf("network %v: no healthy gateway to bind the router port to", network.Metadata.Name)
+			}
+			setGatewayChassis(txn, "rtos-"+name, current, healthy)
+		}
+
+		allocator, err := newSwitchAllocator(sw, ports, cfg.gateway)
+		if err != nil {
+			statuses[network] = &common.NetworkStatus{Phase: "Failed", Message: err.Error()}
+			continue
+		}
+		status := &common.NetworkStatus{
+			Phase:         "Ready",
+			LogicalSwitch: name,
+			LogicalRouter: cfg.router,
+			RouterPort:    "rtos-" + name,
+			Free:          allocator.Free(),
+		}
+		for _, port := range ports {
+			if sw.ports[port.uuid] && port.ip != nil && allocator.Has(port.ip) {
+				status.Allocated++
+			}
+		}
+		if cfg.vlan != 0 {
+			status.LocalnetPort = networkLocalnetPort(network.Metadata.Name)
+		}
+		statuses[network] = status
+	}
+
+	// Remove the switches of deleted networks.
+	for name := range switches {
+		if !seen[name] {
+			txn.Add("--if-exists", "ls-del", name)
+			txn.Add("--if-exists", "lrp-del", "rtos-"+name)
+		}
+	}
+	r.rejected = rejected
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	for network, status := range statuses {
+		if reflect.DeepEqual(network.Status, *status) {
+			continue
+		}
+		name := network.Metadata.Name
+		err := exec.Apply(fmt.Sprintf("update status of network %v to %v", name, status.Phase), func() error {
+			return common.UpdateNetworkStatus(r.Server, name, status)
+		})
+		if err != nil {
+			log.Printf("network %v: failed to update status: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// networkTenants returns the IDs of the tenants that have a Network.
+func networkTenants(cluster *Cluster) map[string]bool {
+	tenants := make(map[string]bool)
+	for _, network := range cluster.Networks {
+		if id := cluster.TenantIDs[network.Spec.Tenant]; id != "" {
+			tenants[id] = true
+		}
+	}
+	return tenants
+}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/neutron"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// NeutronNetworkAnnotation puts the primary interface of a pod, or of all
+// pods of a namespace, on an existing Neutron network, given by name or ID.
+// A pod's annotation wins over its namespace's.
+const NeutronNetworkAnnotation = "ovn.stackube/neutron-network"
+
+// NeutronSubnetAnnotation picks the subnet, by name or ID, of the network
+// of NeutronNetworkAnnotation.  The first IPv4 subnet is used without it.
+const NeutronSubnetAnnotation = "ovn.stackube/neutron-subnet"
+
+// NeutronReconciler gives the pods that request a Neutron network a port on
+// it.  The Neutron OVN driver creates the logical switch port of the port;
+// once it is there its addresses are recorded in common.PodNetworkAnnotation
+// with the port as iface-id, so that the CNI plugin binds the pod to it.
+//
+// A pod may only use the shared networks and those of its namespace's
+// tenant.  The ports are described with Cluster, so that the ports of other
+// clusters using the same Neutron are left alone.
+type NeutronReconciler struct {
+	Server  string
+	Neutron neutron.API
+	Cluster string
+	// rejected maps the uids of the pods refused their network to the
+	// message of the event recorded on them.
+	rejected map[string]string
+}
+
+func (r *NeutronReconciler) Name() string {
+	return "neutron"
+}
+
+// podNeutronNetwork returns the Neutron network and subnet requested for
+// pod, or "".
+func podNeutronNetwork(cluster *Cluster, pod *common.Pod) (string, string) {
+	annotations := pod.Metadata.Annotations
+	if annotations[NeutronNetworkAnnotation] == "" {
+		ns, ok := cluster.Namespaces[pod.Metadata.Namespace]
+		if !ok {
+			return "", ""
+		}
+		annotations = ns.Metadata.Annotations
+	}
+	return annotations[NeutronNetworkAnnotation], annotations[NeutronSubnetAnnotation]
+}
+
+// ownsPort reports whether port was created by r.  Ports created before
+// they were described with the cluster are recognized by their pod.
+func (r *NeutronReconciler) ownsPort(cluster *Cluster, port *neutron.Port) bool {
+	if port.Description != "" {
+		return port.Description == neutron.ClusterDescription(r.Cluster)
+	}
+	for i := range cluster.Pods {
+		if cluster.Pods[i].Metadata.UID == port.DeviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectNetwork records an event on pod saying why it can not use its
+// network, once per message.
+func (r *NeutronReconciler) rejectNetwork(rejected map[string]string, pod *common.Pod, message string) {
+	rejected[pod.Metadata.UID] = message
+	if r.rejected[pod.Metadata.UID] == message {
+		return
+	}
+	log.Printf("pod %v: %v", podKey(pod), message)
+	object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on pod %v: %v", podKey(pod), message), func() error {
+		return common.RecordEvent(r.Server, component, object, "NeutronNetworkRejected", message)
+	})
+	if err != nil {
+		log.Printf("pod %v: failed to record event: %v", podKey(pod), err)
+		delete(rejected, pod.Metadata.UID)
+	}
+}
+
+// neutronSubnet returns the subnet of network named or identified by
+// subnet, or its first IPv4 subnet.
+func (r *NeutronReconciler) neutronSubnet(network *neutron.Network, subnet string) (*neutron.Subnet, error) {
+	subnets, err := r.Neutron.Subnets(network.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subnets {
+		if subnet == "" && subnets[i].IPVersion == 4 || subnet != "" && (subnets[i].Name == subnet || subnets[i].ID == subnet) {
+			return &subnets[i], nil
+		}
+	}
+	if subnet == "" {
+		return nil, fmt.Errorf("network %v has no IPv4 subnet", network.Name)
+	}
+	return nil, fmt.Errorf("network %v has no subnet %v", network.Name, subnet)
+}
+
+func (r *NeutronReconciler) Reconcile(cluster *Cluster) error {
+	existing, err := r.Neutron.Ports(neutron.DeviceOwner)
+	if err != nil {
+		return fmt.Errorf("failed to list neutron ports: %v", err)
+	}
+	byPod := make(map[string]*neutron.Port)
+	for i := range existing {
+		if r.ownsPort(cluster, &existing[i]) {
+			byPod[existing[i].DeviceID] = &existing[i]
+		}
+	}
+	rows, err := ovn.ListRows("logical_switch_port", []string{"_uuid", "name", "external_ids"})
+	if err != nil {
+		return err
+	}
+	switchPorts := make(map[string]map[string]string)
+	for _, row := range rows {
+		switchPorts[row["name"]] = row
+	}
+
+	txn := &ovn.Transaction{}
+	annotations := make(map[*common.Pod]*common.PodNetwork)
+	wanted := make(map[string]bool)
+	rejected := make(map[string]string)
+	for i := range cluster.Pods {
+		pod := &cluster.Pods[i]
+		networkName, subnetName := podNeutronNetwork(cluster, pod)
+		if networkName == "" || !podActive(pod) {
+			continue
+		}
+		// Keep the port of a pod that is still asking for one through
+		// transient errors below.
+		port := byPod[pod.Metadata.UID]
+		if port != nil {
+			wanted[port.ID] = true
+		}
+		tenant := namespaceTenant(cluster, pod.Metadata.Namespace)
+		network, err := r.Neutron.Network(networkName, tenant)
+		if err == neutron.ErrNotFound {
+			r.rejectNetwork(rejected, pod, fmt.Sprintf("neutron network %v not found", networkName))
+			continue
+		}
+		if err != nil {
+			log.Printf("pod %v: neutron network %v: %v", podKey(pod), networkName, err)
+			continue
+		}
+		if !network.UsableBy(tenant) {
+			// Networks found by ID may belong to any project.
+			r.rejectNetwork(rejected, pod, fmt.Sprintf("neutron network %v is neither shared nor owned by the tenant of namespace %v", networkName, pod.Metadata.Namespace))
+			if port != nil {
+				delete(wanted, port.ID)
+			}
+			continue
+		}
+		subnet, err := r.neutronSubnet(network, subnetName)
+		if err != nil {
+			log.Printf("pod %v: %v", podKey(pod), err)
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			log.Printf("pod %v: subnet %v: %v", podKey(pod), subnet.ID, err)
+			continue
+		}
+		gateway := net.ParseIP(subnet.GatewayIP)
+		if gateway == nil {
+			log.Printf("pod %v: subnet %v has no gateway", podKey(pod), subnet.ID)
+			continue
+		}
+
+		if port != nil && (port.NetworkID != network.ID || port.IP(subnet.ID) == nil) {
+			// The pod asks for another network or subnet now.
+			if err := r.deletePort(port); err != nil {
+				log.Printf("pod %v: %v", podKey(pod), err)
+				continue
+			}
+			port = nil
+		}
+		if port == nil {
+			request := &neutron.Port{
+				Name:        podPortName(pod),
+				NetworkID:   network.ID,
+				FixedIPs:    []neutron.FixedIP{{SubnetID: subnet.ID}},
+				DeviceID:    pod.Metadata.UID,
+				DeviceOwner: neutron.DeviceOwner,
+				HostID:      pod.Spec.NodeName,
+				ProjectID:   tenant,
+				Description: neutron.ClusterDescription(r.Cluster),
+			}
+			err := exec.Apply(fmt.Sprintf("create neutron port for pod %v on network %v", podKey(pod), network.Name), func() error {
+				var err error
+				port, err = r.Neutron.CreatePort(request)
+				return err
+			})
+			if err != nil {
+				log.Printf("pod %v: failed to create neutron port: %v", podKey(pod), err)
+				continue
+			}
+			if port == nil {
+				continue
+			}
+		}
+		wanted[port.ID] = true
+
+		row, ok := switchPorts[port.ID]
+		if !ok {
+			log.Printf("pod %v: waiting for the logical switch port of neutron port %v", podKey(pod), port.ID)
+			continue
+		}
+		// The port is the OVN driver's; its tenant is the project of the
+		// neutron port, so it is only marked with the pod.
+		if ovn.ParseMap(row["external_ids"])["pod"] != podKey(pod) {
+			txn.Add("set", "logical_switch_port", row["_uuid"], "external_ids:pod=\""+podKey(pod)+"\"")
+		}
+		ones, _ := cidr.Mask.Size()
+		annotations[pod] = &common.PodNetwork{
+			IPAddress:  fmt.Sprintf("%s/%d", port.IP(subnet.ID), ones),
+			MacAddress: port.MacAddress,
+			GatewayIP:  fmt.Sprintf("%s/%d", gateway, ones),
+			IfaceID:    port.ID,
+		}
+	}
+
+	// Remove the ports of pods that are gone or no longer ask for one.  The
+	// pods of frozen namespaces keep theirs.
+	for _, port := range byPod {
+		if !wanted[port.ID] && !cluster.FrozenPods[port.DeviceID] {
+			if err := r.deletePort(port); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	r.rejected = rejected
+
+	for pod, network := range annotations {
+		if err := annotatePodNetwork(r.Server, pod, network); err != nil {
+			log.Printf("pod %v: failed to record its network: %v", podKey(pod), err)
+		}
+	}
+	return nil
+}
+
+// deletePort deletes a neutron port of a pod.
+func (r *NeutronReconciler) deletePort(port *neutron.Port) error {
+	err := exec.Apply(fmt.Sprintf("delete neutron port %v of %v", port.ID, port.Name), func() error {
+		return r.Neutron.DeletePort(port.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete neutron port %v: %v", port.ID, err)
+	}
+	return nil
+}
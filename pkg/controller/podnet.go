@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// podKey returns namespace/name of pod.
+func podKey(pod *common.Pod) string {
+	return pod.Metadata.Namespace + "/" + pod.Metadata.Name
+}
+
+// podPortName returns the name of the logical switch port of pod.  It is
+// the iface-id the CNI plugin sets on the pod's OVS interface.
+func podPortName(pod *common.Pod) string {
+	return pod.Metadata.Namespace + "_" + pod.Metadata.Name
+}
+
+// podActive reports whether pod is scheduled and not terminated.
+func podActive(pod *common.Pod) bool {
+	return pod.Spec.NodeName != "" && pod.Status.Phase != "Succeeded" && pod.Status.Phase != "Failed"
+}
+
+// logicalSwitch is a row of the Logical_Switch table.
+type logicalSwitch struct {
+	uuid        string
+	name        string
+	subnet      *net.IPNet
+	ports       map[string]bool
+	externalIDs map[string]string
+}
+
+// listLogicalSwitches returns the switches that have the external_ids key
+// set, by name.
+func listLogicalSwitches(key string) (map[string]*logicalSwitch, error) {
+	rows, err := ovn.ListRows("logical_switch", []string{"_uuid", "name", "other_config", "ports", "external_ids"})
+	if err != nil {
+		return nil, err
+	}
+	switches := make(map[string]*logicalSwitch)
+	for _, row := range rows {
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		if _, ok := externalIDs[key]; !ok {
+			continue
+		}
+		sw := &logicalSwitch{
+			uuid:        row["_uuid"],
+			name:        row["name"],
+			ports:       make(map[string]bool),
+			externalIDs: externalIDs,
+		}
+		if subnet := ovn.ParseMap(row["other_config"])["subnet"]; subnet != "" {
+			_, sw.subnet, _ = net.ParseCIDR(subnet)
+		}
+		for _, uuid := range ovn.ParseSet(row["ports"]) {
+			sw.ports[uuid] = true
+		}
+		switches[sw.name] = sw
+	}
+	return switches, nil
+}
+
+// switchPort is a row of the Logical_Switch_Port table with a "MAC IP"
+// address.
+type switchPort struct {
+	uuid        string
+	name        string
+	mac         string
+	ip          net.IP
+	externalIDs map[string]string
+}
+
+// listSwitchPorts returns the switch ports that have the external_ids key
+// set, by name.
+func listSwitchPorts(key string) (map[string]*switchPort, error) {
+	rows, err := ovn.ListRows("logical_switch_port", []string{"_uuid", "name", "addresses", "external_ids"})
+	if err != nil {
+		return nil, err
+	}
+	ports := make(map[string]*switchPort)
+	for _, row := range rows {
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		if _, ok := externalIDs[key]; !ok {
+			continue
+		}
+		port := &switchPort{uuid: row["_uuid"], name: row["name"], externalIDs: externalIDs}
+		if fields := strings.Fields(row["addresses"]); len(fields) >= 2 {
+			port.mac = fields[0]
+			port.ip = net.ParseIP(fields[1])
+		}
+		ports[port.name] = port
+	}
+	return ports, nil
+}
+
+// listPortsOn returns the ports on switches, by name.  Unlike
+// listSwitchPorts it takes the ports of any owner, e.g. those of ovnctl and
+// the dynamically addressed ones of the default network's pods, and the
+// MACs of router ports.
+func listPortsOn(switches map[string]*logicalSwitch) (map[string]*switchPort, error) {
+	rows, err := ovn.ListRows("logical_switch_port", []string{"_uuid", "name", "addresses", "dynamic_addresses", "external_ids"})
+	if err != nil {
+		return nil, err
+	}
+	ports := make(map[string]*switchPort)
+	for _, row := range rows {
+		port := &switchPort{uuid: row["_uuid"], name: row["name"], externalIDs: ovn.ParseMap(row["external_ids"])}
+		if switchOf(switches, port) == nil {
+			continue
+		}
+		fields := strings.Fields(row["addresses"])
+		if len(fields) > 0 && fields[0] == "dynamic" {
+			fields = strings.Fields(row["dynamic_addresses"])
+		}
+		if len(fields) > 0 {
+			if mac, err := net.ParseMAC(fields[0]); err == nil {
+				port.mac = mac.String()
+			}
+		}
+		if len(fields) > 1 {
+			port.ip = net.ParseIP(fields[1])
+		}
+		ports[port.name] = port
+	}
+	return ports, nil
+}
+
+// switchOf returns the switch holding port, or nil.
+func switchOf(switches map[string]*logicalSwitch, port *switchPort) *logicalSwitch {
+	for _, sw := range switches {
+		if sw.ports[port.uuid] {
+			return sw
+		}
+	}
+	return nil
+}
+
+// gatewayIPNet returns the router address of subnet, its first usable one.
+func gatewayIPNet(subnet *net.IPNet) *net.IPNet {
+	return &net.IPNet{IP: common.FirstIP(subnet), Mask: subnet.Mask}
+}
+
+// newSwitchAllocator returns an allocator for the pod addresses of sw with
+// the router address gateway and the addresses of ports on sw marked used.
+func newSwitchAllocator(sw *logicalSwitch, ports map[string]*switchPort, gateway net.IP) (*common.IPAllocator, error) {
+	allocator, err := common.NewIPAllocator(sw.subnet)
+	if err != nil {
+		return nil, err
+	}
+	allocator.AllocateIP(gateway)
+	for _, port := range ports {
+		if sw.ports[port.uuid] && port.ip != nil {
+			allocator.AllocateIP(port.ip)
+		}
+	}
+	return allocator, nil
+}
+
+// annotatePod sets the annotation key of pod to value unless it is set
+// already.  An empty value removes the annotation.
+func annotatePod(server string, pod *common.Pod, key, value string) error {
+	if current, ok := pod.Metadata.Annotations[key]; current == value && (ok || value == "") {
+		return nil
+	}
+	return exec.Apply(fmt.Sprintf("annotate pod %v %v=%s", podKey(pod), key, value), func() error {
+		return common.PatchPodAnnotations(server, pod.Metadata.Namespace, pod.Metadata.Name, map[string]string{key: value})
+	})
+}
+
+// annotatePodNetwork records network in the pod's PodNetworkAnnotation
+// unless it is there already.
+func annotatePodNetwork(server string, pod *common.Pod, network *common.PodNetwork) error {
+	value, err := json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	return annotatePod(server, pod, common.PodNetworkAnnotation, string(value))
+}
@@ -0,0 +1,591 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// TenantAnnotation puts a namespace into a tenant.  Pods of namespaces
+// without it stay on the cluster router's topology.
+const TenantAnnotation = "ovn.stackube/tenant"
+
+// TenantSubnetAnnotation overrides the subnet of a namespace's tenant.
+const TenantSubnetAnnotation = "ovn.stackube/tenant-subnet"
+
+// tenantKey marks the routers, switches and switch ports managed by
+// TenantReconciler.  Its value is the tenant ID.  The other objects the
+// controller creates for a tenant's namespace carry it as well.
+const tenantKey = "k8s-tenant"
+
+// nodeKey records the node of a per-node switch.
+const nodeKey = "k8s-node"
+
+// staticAddressKey marks the ports TenantReconciler adds to the switches of
+// the nodes for the static addresses of default network pods.  Its value is
+// the switch.
+const staticAddressKey = "k8s-static-address"
+
+// TenantReconciler gives every tenant its own logical router and, on each
+// node running pods of the tenant, a switch with a slice of the tenant's
+// subnet.  Tenants do not share an L3 domain, so their subnets may overlap.
+// Each pod of a tenant gets a port with an address on the switch of its
+// node, recorded in common.PodNetworkAnnotation for the CNI plugin.  The
+// tenant routers reach the gateways and the management ports of the nodes
+// through the "join" switch, see connectTenants.
+//
+// Pods may request a static address and MAC.  Those of the default network
+// get them reserved with a port on the switch ovnctl created for their
+// node, next to the ports of the other pods there.
+type TenantReconciler struct {
+	Server string
+	// Subnet is the subnet of tenants without TenantSubnetAnnotation.
+	Subnet *net.IPNet
+	// NodePrefix is the prefix length of the per-node switch subnets.
+	NodePrefix int
+
+	// rejected maps the uids of the pods whose static address was rejected
+	// to the message of the event recorded for them.
+	rejected map[string]string
+}
+
+func (r *TenantReconciler) Name() string {
+	return "tenant"
+}
+
+func tenantRouterName(tenant string) string {
+	return "tenant_" + tenant
+}
+
+func tenantSwitchName(tenant, node string) string {
+	return "tenant_" + tenant + "_" + node
+}
+
+// staticAddress returns the address and MAC requested for pod through
+// common.IPAddressAnnotation and common.MacAddressAnnotation, nil and "" for
+// the ones not requested.
+func staticAddress(pod *common.Pod) (net.IP, string, error) {
+	var ip net.IP
+	if value, ok := pod.Metadata.Annotations[common.IPAddressAnnotation]; ok {
+		if ip = net.ParseIP(value); ip == nil {
+			return nil, "", fmt.Errorf("invalid ip address %q", value)
+		}
+		if ip = ip.To4(); ip == nil {
+			return nil, "", fmt.Errorf("ipv6 address %v is not supported, only ipv4 addresses can be assigned", value)
+		}
+	}
+	mac := ""
+	if value, ok := pod.Metadata.Annotations[common.MacAddressAnnotation]; ok {
+		hw, err := net.ParseMAC(value)
+		if err != nil || len(hw) != 6 || hw[0]&1 != 0 {
+			return nil, "", fmt.Errorf("invalid unicast mac address %q", value)
+		}
+		mac = hw.String()
+	}
+	return ip, mac, nil
+}
+
+// hasStaticAddress reports whether pod requests a static address or MAC.
+func hasStaticAddress(pod *common.Pod) bool {
+	_, ip := pod.Metadata.Annotations[common.IPAddressAnnotation]
+	_, mac := pod.Metadata.Annotations[common.MacAddressAnnotation]
+	return ip || mac
+}
+
+// rejectStaticAddress records an event on pod saying why its static address
+// was not assigned, once per message.
+func (r *TenantReconciler) rejectStaticAddress(rejected map[string]string, pod *common.Pod, message string) {
+	rejected[pod.Metadata.UID] = message
+	if r.rejected[pod.Metadata.UID] == message {
+		return
+	}
+	log.Printf("pod %v: %v", podKey(pod), message)
+	object := common.ObjectReference{Kind: "Pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, UID: pod.Metadata.UID}
+	err := exec.Apply(fmt.Sprintf("record event on pod %v: %v", podKey(pod), message), func() error {
+		return common.RecordEvent(r.Server, component, object, "StaticAddressRejected", message)
+	})
+	if err != nil {
+		log.Printf("pod %v: failed to record event: %v", podKey(pod), err)
+		delete(rejected, pod.Metadata.UID)
+	}
+}
+
+// macInUse reports whether a port on sw other than portName has mac.
+func macInUse(sw *logicalSwitch, ports map[string]*switchPort, portName, mac string) bool {
+	for _, port := range ports {
+		if port.name != portName && sw.ports[port.uuid] && port.mac == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// portMac returns the MAC of a new port with ip on sw.  Like ovnctl's
+// allocateMac it is derived from ip unless that MAC is taken, e.g. by a pod
+// with a static MAC, in which case a random one is generated.  taken holds
+// the MACs given out on sw in this pass.
+func portMac(sw *logicalSwitch, ports map[string]*switchPort, portName string, ip net.IP, taken map[string]bool) (string, error) {
+	if mac := common.IPToMac(ip); !taken[mac] && !macInUse(sw, ports, portName, mac) {
+		return mac, nil
+	}
+	for i := 0; i < 16; i++ {
+		mac, err := common.GenerateMac()
+		if err != nil {
+			return "", err
+		}
+		if !taken[mac] && !macInUse(sw, ports, portName, mac) {
+			return mac, nil
+		}
+	}
+	return "", fmt.Errorf("failed to allocate an unused mac address on %v", sw.name)
+}
+
+// namespaceTenant returns the tenant ID of namespace, or "".
+func namespaceTenant(cluster *Cluster, namespace string) string {
+	if ns, ok := cluster.Namespaces[namespace]; ok {
+		return cluster.TenantIDs[ns.Metadata.Annotations[TenantAnnotation]]
+	}
+	return ""
+}
+
+// tenantExternalIDs returns the argument that stamps an object created for
+// namespace with its tenant ID, if it has one.
+func tenantExternalIDs(cluster *Cluster, namespace string) []string {
+	if tenant := namespaceTenant(cluster, namespace); tenant != "" {
+		return []string{"external_ids:" + tenantKey + "=" + tenant}
+	}
+	return nil
+}
+
+// restampTenant adds the command that corrects the tenant ID of an
+// existing row of table created for namespace to txn.
+func restampTenant(txn *ovn.Transaction, cluster *Cluster, table, uuid string, externalIDs map[string]string, namespace string) {
+	tenant := namespaceTenant(cluster, namespace)
+	current, ok := externalIDs[tenantKey]
+	if tenant == current && (ok || tenant == "") {
+		return
+	}
+	if tenant == "" {
+		txn.Add("remove", table, uuid, "external_ids", tenantKey)
+	} else {
+		txn.Add("set", table, uuid, "external_ids:"+tenantKey+"="+tenant)
+	}
+}
+
+// tenantSubnets returns the subnet of each tenant that has one.
+func (r *TenantReconciler) tenantSubnets(cluster *Cluster) map[string]*net.IPNet {
+	var names []string
+	for name := range cluster.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	subnets := make(map[string]*net.IPNet)
+	for _, name := range names {
+		annotations := cluster.Namespaces[name].Metadata.Annotations
+		tenant := namespaceTenant(cluster, name)
+		if tenant == "" {
+			continue
+		}
+		subnet := r.Subnet
+		if s := annotations[TenantSubnetAnnotation]; s != "" {
+			_, parsed, err := net.ParseCIDR(s)
+			if err != nil {
+				log.Printf("namespace %v: invalid tenant subnet %q: %v", name, s, err)
+				continue
+			}
+			subnet = parsed
+		}
+		if subnet == nil {
+			log.Printf("namespace %v: tenant %v has no subnet", name, tenant)
+			continue
+		}
+		if ones, _ := subnet.Mask.Size(); ones > r.NodePrefix {
+			log.Printf("namespace %v: tenant subnet %v is smaller than a /%d node subnet", name, subnet, r.NodePrefix)
+			continue
+		}
+		if current, ok := subnets[tenant]; ok {
+			if current.String() != subnet.String() {
+				log.Printf("namespace %v: ignoring subnet %v, tenant %v already uses %v", name, subnet, tenant, current)
+			}
+			continue
+		}
+		subnets[tenant] = subnet
+	}
+	return subnets
+}
+
+// addTenantSwitch adds the commands creating the switch of tenant on node
+// to txn.  Its subnet is the first slice of the tenant's subnet not used by
+// another switch of the tenant.
+func (r *TenantReconciler) addTenantSwitch(txn *ovn.Transaction, switches map[string]*logicalSwitch, tenant, node string, subnet *net.IPNet) (*logicalSwitch, error) {
+	candidates, err := common.SplitSubnet(subnet, r.NodePrefix)
+	if err != nil {
+		return nil, err
+	}
+	var nodeSubnet *net.IPNet
+	for _, candidate := range candidates {
+		used := false
+		for _, sw := range switches {
+			if sw.externalIDs[tenantKey] == tenant && sw.subnet != nil && common.Overlap(sw.subnet, candidate) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			nodeSubnet = candidate
+			break
+		}
+	}
+	if nodeSubnet == nil {
+		return nil, fmt.Errorf("no free /%d subnet left in %v", r.NodePrefix, subnet)
+	}
+
+	name := tenantSwitchName(tenant, node)
+	router := tenantRouterName(tenant)
+	gw := gatewayIPNet(nodeSubnet)
+	mac := common.IPToMac(gw.IP)
+	txn.Add("--may-exist", "ls-add", name)
+	txn.Add("set", "logical_switch", name, "other_config:subnet="+nodeSubnet.String(),
+		"external_ids:"+tenantKey+"="+tenant, "external_ids:"+nodeKey+"="+node)
+	txn.Add("--may-exist", "lrp-add", router, "rtos-"+name, mac, gw.String())
+	txn.Add("--may-exist", "lsp-add", name, "stor-"+name)
+	txn.Add("set", "logical_switch_port", "stor-"+name, "type=router", "options:router-port=rtos-"+name, "addresses="+"\""+mac+"\"")
+	return &logicalSwitch{
+		name:        name,
+		subnet:      nodeSubnet,
+		ports:       make(map[string]bool),
+		externalIDs: map[string]string{tenantKey: tenant, nodeKey: node},
+	}, nil
+}
+
+// switchAddresses hands out the addresses of the pod ports of a switch.
+type switchAddresses struct {
+	sw        *logicalSwitch
+	ports     map[string]*switchPort
+	gateway   *net.IPNet
+	allocator *common.IPAllocator
+	// taken holds the MACs given out in this pass.
+	taken map[string]bool
+}
+
+// newSwitchAddresses returns the addresses of sw, whose router has gateway,
+// with those of ports marked used.
+func newSwitchAddresses(sw *logicalSwitch, ports map[string]*switchPort, gateway *net.IPNet) (*switchAddresses, error) {
+	allocator, err := newSwitchAllocator(sw, ports, gateway.IP)
+	if err != nil {
+		return nil, err
+	}
+	return &switchAddresses{sw: sw, ports: ports, gateway: gateway, allocator: allocator, taken: make(map[string]bool)}, nil
+}
+
+// assignPort gives pod a port on a.sw with requestedIP and requestedMAC, or
+// free ones for those not requested, and returns the pod's network.  The
+// current port of the pod is kept when it holds the request.  A request
+// that can not be met is rejected with an event and the current port is
+// kept.  It returns nil when the pod has no address.
+func (r *TenantReconciler) assignPort(txn *ovn.Transaction, a *switchAddresses, pod *common.Pod, requestedIP net.IP, requestedMAC string, externalIDs []string, rejected map[string]string) *common.PodNetwork {
+	sw := a.sw
+	portName := podPortName(pod)
+	ones, _ := sw.subnet.Mask.Size()
+	network := &common.PodNetwork{GatewayIP: a.gateway.String()}
+	port, hasPort := a.ports[portName]
+	if hasPort && sw.ports[port.uuid] && port.ip != nil && sw.subnet.Contains(port.ip) &&
+		(requestedIP == nil || requestedIP.Equal(port.ip)) && (requestedMAC == "" || requestedMAC == port.mac) {
+		network.IPAddress = fmt.Sprintf("%s/%d", port.ip, ones)
+		network.MacAddress = port.mac
+		return network
+	}
+	// The pod moved to another tenant, its switch was rebuilt or it
+	// requests another address.  The old port is replaced only once the
+	// new address is assigned, so its address may be requested again but is
+	// kept when the request fails.
+	var oldIP net.IP
+	if hasPort && sw.ports[port.uuid] && port.ip != nil {
+		oldIP = port.ip
+		a.allocator.Release(oldIP)
+	}
+	keepOldIP := func() {
+		if oldIP != nil {
+			a.allocator.AllocateIP(oldIP)
+		}
+	}
+	if requestedMAC != "" && (a.taken[requestedMAC] || macInUse(sw, a.ports, portName, requestedMAC)) {
+		r.rejectStaticAddress(rejected, pod, fmt.Sprintf("can not assign mac address %v: it is in use on %v", requestedMAC, sw.name))
+		keepOldIP()
+		return nil
+	}
+	ip := requestedIP
+	if ip != nil {
+		if err := a.allocator.AllocateIP(ip); err != nil {
+			r.rejectStaticAddress(rejected, pod, fmt.Sprintf("can not assign ip address %v on %v: %v", ip, sw.name, err))
+			keepOldIP()
+			return nil
+		}
+	} else {
+		var err error
+		if ip, err = a.allocator.Allocate(); err != nil {
+			log.Printf("pod %v: %v", podKey(pod), err)
+			keepOldIP()
+			return nil
+		}
+	}
+	mac := requestedMAC
+	if mac == "" {
+		var err error
+		if mac, err = portMac(sw, a.ports, portName, ip, a.taken); err != nil {
+			log.Printf("pod %v: %v", podKey(pod), err)
+			a.allocator.Release(ip)
+			keepOldIP()
+			return nil
+		}
+	}
+	a.taken[mac] = true
+	addresses := mac + " " + ip.String()
+	if hasPort {
+		txn.Add("--if-exists", "lsp-del", portName)
+	}
+	txn.Add("lsp-add", sw.name, portName)
+	txn.Add("lsp-set-addresses", portName, addresses)
+	txn.Add("lsp-set-port-security", portName, addresses)
+	txn.Add(append([]string{"set", "logical_switch_port", portName}, externalIDs...)...)
+	network.IPAddress = fmt.Sprintf("%s/%d", ip, ones)
+	network.MacAddress = mac
+	return network
+}
+
+func (r *TenantReconciler) Reconcile(cluster *Cluster) error {
+	tenants := r.tenantSubnets(cluster)
+	routers, err := ovn.ListRows("logical_router", []string{"name", "external_ids"})
+	if err != nil {
+		return err
+	}
+	switches, err := listLogicalSwitches(tenantKey)
+	if err != nil {
+		return err
+	}
+	ports, err := listSwitchPorts(tenantKey)
+	if err != nil {
+		return err
+	}
+	// The switches and ports of Network resources are NetworkReconciler's,
+	// the metadata ports MetadataReconciler's.
+	for name, sw := range switches {
+		if _, ok := sw.externalIDs[networkKey]; ok {
+			delete(switches, name)
+		}
+	}
+	for name, port := range ports {
+		_, network := port.externalIDs[networkKey]
+		_, metadata := port.externalIDs[common.MetadataKey]
+		if network || metadata {
+			delete(ports, name)
+		}
+	}
+
+	txn := &ovn.Transaction{}
+	// One router per tenant.  Tenants with only Networks keep theirs too,
+	// frozen tenants keep everything.
+	withNetworks := networkTenants(cluster)
+	haveRouter := make(map[string]bool)
+	for _, router := range routers {
+		tenant, ok := ovn.ParseMap(router["external_ids"])[tenantKey]
+		if !ok {
+			continue
+		}
+		if _, want := tenants[tenant]; !want && !withNetworks[tenant] && !cluster.FrozenTenants[tenant] {
+			txn.Add("--if-exists", "lr-del", router["name"])
+			txn.Add("--if-exists", "lsp-del", tenantJoinSwitchPort(tenant))
+			continue
+		}
+		haveRouter[tenant] = true
+	}
+	for tenant := range tenants {
+		if !haveRouter[tenant] {
+			txn.Add("--may-exist", "lr-add", tenantRouterName(tenant))
+			txn.Add("set", "logical_router", tenantRouterName(tenant), "external_ids:"+tenantKey+"="+tenant)
+			haveRouter[tenant] = true
+		}
+	}
+
+	// Connect the routers to the gateways.  Their traffic is SNATed to the
+	// tenant's address on the "join" switch, so all of the tenant's subnets
+	// are.
+	cidrs := make(map[string][]*net.IPNet)
+	for tenant, subnet := range tenants {
+		cidrs[tenant] = append(cidrs[tenant], subnet)
+	}
+	for _, network := range cluster.Networks {
+		tenant := cluster.TenantIDs[network.Spec.Tenant]
+		if _, cidr, err := net.ParseCIDR(network.Spec.CIDR); err == nil && tenant != "" && haveRouter[tenant] {
+			cidrs[tenant] = append(cidrs[tenant], cidr)
+		}
+	}
+	if err := r.connectTenants(txn, cluster, cidrs); err != nil {
+		return err
+	}
+
+	// Drop the switches of tenants and nodes that are gone, and those left
+	// outside of a changed tenant subnet.
+	for name, sw := range switches {
+		subnet, ok := tenants[sw.externalIDs[tenantKey]]
+		_, nodeOK := cluster.Nodes[sw.externalIDs[nodeKey]]
+		if ok && nodeOK && sw.subnet != nil && subnet.Contains(sw.subnet.IP) || cluster.FrozenTenants[sw.externalIDs[tenantKey]] {
+			continue
+		}
+		txn.Add("--if-exists", "ls-del", name)
+		txn.Add("--if-exists", "lrp-del", "rtos-"+name)
+		delete(switches, name)
+	}
+
+	// The pods with a static address go first, so that the others do not
+	// take it.
+	var pods []*common.Pod
+	for i := range cluster.Pods {
+		if hasStaticAddress(&cluster.Pods[i]) {
+			pods = append(pods, &cluster.Pods[i])
+		}
+	}
+	for i := range cluster.Pods {
+		if !hasStaticAddress(&cluster.Pods[i]) {
+			pods = append(pods, &cluster.Pods[i])
+		}
+	}
+
+	// The switches of the nodes, which ovnctl creates for the default
+	// network, are named after them.  Every port on them takes an address.
+	nodeSwitches, err := listLogicalSwitches("gateway_ip")
+	if err != nil {
+		return err
+	}
+	nodePorts, err := listPortsOn(nodeSwitches)
+	if err != nil {
+		return err
+	}
+
+	addresses := make(map[string]*switchAddresses)
+	annotations := make(map[*common.Pod]*common.PodNetwork)
+	wanted := make(map[string]bool)
+	defaultWanted := make(map[string]bool)
+	rejected := make(map[string]string)
+	for _, pod := range pods {
+		if !podActive(pod) {
+			continue
+		}
+		// Pods on Neutron networks are NeutronReconciler's.
+		if network, _ := podNeutronNetwork(cluster, pod); network != "" {
+			continue
+		}
+		portName := podPortName(pod)
+		tenant := namespaceTenant(cluster, pod.Metadata.Namespace)
+		if tenant == "" {
+			// The default network allocates the addresses of its pods on
+			// the nodes.  A static address is reserved here with a port on
+			// the switch of the pod's node, which the dynamic addresses
+			// stay clear of.
+			defaultWanted[portName] = true
+			if !hasStaticAddress(pod) {
+				continue
+			}
+			requestedIP, requestedMAC, err := staticAddress(pod)
+			if err != nil {
+				r.rejectStaticAddress(rejected, pod, err.Error())
+				continue
+			}
+			sw, ok := nodeSwitches[pod.Spec.NodeName]
+			if !ok || sw.subnet == nil {
+				r.rejectStaticAddress(rejected, pod, fmt.Sprintf("can not assign a static address: node %v has no switch", pod.Spec.NodeName))
+				continue
+			}
+			a, ok := addresses[sw.name]
+			if !ok {
+				gateway, subnet, err := net.ParseCIDR(sw.externalIDs["gateway_ip"])
+				if err != nil {
+					log.Printf("pod %v: switch %v has an invalid gateway_ip: %v", podKey(pod), sw.name, err)
+					continue
+				}
+				if a, err = newSwitchAddresses(sw, nodePorts, &net.IPNet{IP: gateway, Mask: subnet.Mask}); err != nil {
+					log.Printf("pod %v: %v", podKey(pod), err)
+					continue
+				}
+				addresses[sw.name] = a
+			}
+			if _, ok := ports[portName]; ok {
+				// The namespace left its tenant.
+				wanted[portName] = true
+				txn.Add("--if-exists", "lsp-del", portName)
+			}
+			externalIDs := []string{"external_ids:" + staticAddressKey + "=" + sw.name, "external_ids:pod=\"" + podKey(pod) + "\""}
+			if network := r.assignPort(txn, a, pod, requestedIP, requestedMAC, externalIDs, rejected); network != nil {
+				annotations[pod] = network
+			}
+			continue
+		}
+		subnet, ok := tenants[tenant]
+		if !ok {
+			continue
+		}
+		requestedIP, requestedMAC, err := staticAddress(pod)
+		if err != nil {
+			r.rejectStaticAddress(rejected, pod, err.Error())
+			continue
+		}
+		name := tenantSwitchName(tenant, pod.Spec.NodeName)
+		sw, ok := switches[name]
+		if !ok {
+			sw, err = r.addTenantSwitch(txn, switches, tenant, pod.Spec.NodeName, subnet)
+			if err != nil {
+				log.Printf("pod %v: tenant %v: %v", podKey(pod), tenant, err)
+				continue
+			}
+			switches[name] = sw
+		}
+		a, ok := addresses[name]
+		if !ok {
+			if a, err = newSwitchAddresses(sw, ports, gatewayIPNet(sw.subnet)); err != nil {
+				log.Printf("pod %v: %v", podKey(pod), err)
+				continue
+			}
+			// The router's MAC is derived from its address.
+			a.taken[common.IPToMac(a.gateway.IP)] = true
+			addresses[name] = a
+		}
+		wanted[portName] = true
+		externalIDs := []string{"external_ids:" + tenantKey + "=" + tenant, "external_ids:pod=\"" + podKey(pod) + "\""}
+		if network := r.assignPort(txn, a, pod, requestedIP, requestedMAC, externalIDs, rejected); network != nil {
+			annotations[pod] = network
+		}
+	}
+
+	// The static addresses of default network pods that are gone are
+	// released.  Those of pods that no longer request them are kept until
+	// the pods go away, they are in use.
+	for name, port := range nodePorts {
+		if _, ok := port.externalIDs[staticAddressKey]; ok && !defaultWanted[name] && !cluster.frozen(port.externalIDs["pod"]) {
+			txn.Add("--if-exists", "lsp-del", name)
+		}
+	}
+
+	// Remove the ports of pods that are gone or left their tenant.
+	for name, port := range ports {
+		if !wanted[name] && !cluster.frozen(port.externalIDs["pod"]) {
+			txn.Add("--if-exists", "lsp-del", name)
+		}
+	}
+	r.rejected = rejected
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	for pod, network := range annotations {
+		if err := annotatePodNetwork(r.Server, pod, network); err != nil {
+			log.Printf("pod %v: failed to record its network: %v", podKey(pod), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+)
+
+func TestStaticAddress(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		ip          string
+		mac         string
+		fails       bool
+	}{
+		{map[string]string{}, "", "", false},
+		{map[string]string{common.IPAddressAnnotation: "10.0.0.5"}, "10.0.0.5", "", false},
+		{map[string]string{common.MacAddressAnnotation: "0A:00:00:00:00:01"}, "", "0a:00:00:00:00:01", false},
+		{map[string]string{common.IPAddressAnnotation: "10.0.0.5", common.MacAddressAnnotation: "0a:00:00:00:00:01"}, "10.0.0.5", "0a:00:00:00:00:01", false},
+		{map[string]string{common.IPAddressAnnotation: ""}, "", "", true},
+		{map[string]string{common.IPAddressAnnotation: "10.0.0"}, "", "", true},
+		{map[string]string{common.IPAddressAnnotation: "fd00::5"}, "", "", true},
+		{map[string]string{common.MacAddressAnnotation: "0a:00:00:00:01"}, "", "", true},
+		{map[string]string{common.MacAddressAnnotation: "01:00:5e:00:00:01"}, "", "", true},
+		{map[string]string{common.MacAddressAnnotation: "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"}, "", "", true},
+		{map[string]string{common.IPAddressAnnotation: "10.0.0.5", common.MacAddressAnnotation: "x"}, "", "", true},
+	}
+	for _, test := range tests {
+		pod := &common.Pod{}
+		pod.Metadata.Annotations = test.annotations
+		ip, mac, err := staticAddress(pod)
+		if test.fails {
+			if err == nil {
+				t.Errorf("staticAddress(%v) = %v, %q, want an error", test.annotations, ip, mac)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(net.ParseIP(test.ip)) || mac != test.mac {
+			t.Errorf("staticAddress(%v) = %v, %q, %v, want %v, %q", test.annotations, ip, mac, err, test.ip, test.mac)
+		}
+	}
+}
+
+// tenantTables has the switches of the tenants t1 and t2 on node1, with the
+// ports of ns1/p and ns1/q and of ns2/r, and the switch ovnctl created for
+// node1 with its management port.
+func tenantTables() map[string][]map[string]string {
+	return map[string][]map[string]string{
+		"logical_router": {
+			{"name": "tenant_t1", "external_ids": "k8s-tenant=t1"},
+			{"name": "tenant_t2", "external_ids": "k8s-tenant=t2"},
+		},
+		"logical_switch": {
+			{"_uuid": "sw1", "name": "tenant_t1_node1", "other_config": "subnet=10.1.0.0/24", "ports": "lsp1 lsp2", "external_ids": "k8s-node=node1 k8s-tenant=t1"},
+			{"_uuid": "sw2", "name": "tenant_t2_node1", "other_config": "subnet=10.1.1.0/24", "ports": "lsp3", "external_ids": "k8s-node=node1 k8s-tenant=t2"},
+			{"_uuid": "sw3", "name": "node1", "other_config": "subnet=10.244.1.0/24", "ports": "stor1 mgmt1", "external_ids": "gateway_ip=10.244.1.1/24"},
+		},
+		"logical_switch_port": {
+			{"_uuid": "lsp1", "name": "ns1_p", "addresses": "0a:58:0a:01:00:02 10.1.0.2", "external_ids": "k8s-tenant=t1 pod=ns1/p"},
+			{"_uuid": "lsp2", "name": "ns1_q", "addresses": "0a:58:0a:01:00:03 10.1.0.3", "external_ids": "k8s-tenant=t1 pod=ns1/q"},
+			{"_uuid": "lsp3", "name": "ns2_r", "addresses": "0a:58:0a:01:01:02 10.1.1.2", "external_ids": "k8s-tenant=t2 pod=ns2/r"},
+			{"_uuid": "stor1", "name": "stor-node1", "addresses": "0a:58:0a:f4:01:01"},
+			{"_uuid": "mgmt1", "name": "k8s-node1", "addresses": "0a:00:00:00:00:02 10.244.1.2"},
+		},
+	}
+}
+
+// tenantCluster returns a cluster with the pods ns1/p and ns1/q of tenant
+// t1 on node1, ns1/q with annotations, and the default network's namespace
+// ns0.  Tenant t2 of ns2 is known unless frozen.
+func tenantCluster(frozen bool, annotations map[string]string, pods ...common.Pod) *Cluster {
+	cluster := &Cluster{
+		Pods: append([]common.Pod{
+			testPod("ns1", "p", "node1", "10.1.0.2", nil),
+			testPod("ns1", "q", "node1", "10.1.0.3", annotations),
+		}, pods...),
+		Namespaces:       map[string]*common.Namespace{"ns0": testNamespace(false), "ns1": testNamespace(true)},
+		Nodes:            map[string]*common.Node{"node1": testNode(true)},
+		TenantIDs:        map[string]string{"t1": "t1"},
+		FrozenNamespaces: map[string]bool{},
+		FrozenTenants:    map[string]bool{},
+	}
+	if frozen {
+		cluster.FrozenNamespaces["ns2"] = true
+		cluster.FrozenTenants["t2"] = true
+	}
+	return cluster
+}
+
+func TestTenantReconcileFrozen(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	t2 := []string{"--if-exists lr-del tenant_t2", "--if-exists ls-del tenant_t2_node1", "--if-exists lsp-del ns2_r"}
+	tests := []struct {
+		name     string
+		frozen   bool
+		want     []string
+		unwanted []string
+	}{
+		{"tenant gone", false, t2, nil},
+		{"tenant frozen", true, nil, append(t2, "--if-exists lsp-del", "lsp-add")},
+	}
+	for _, test := range tests {
+		f := runFakeNB(tenantTables())
+		r := &TenantReconciler{Subnet: subnet, NodePrefix: 24}
+		err := r.Reconcile(tenantCluster(test.frozen, nil))
+		f.stop()
+		if err != nil {
+			t.Errorf("%v: Reconcile failed: %v", test.name, err)
+			continue
+		}
+		f.expect(t, test.name, test.want, test.unwanted)
+	}
+}
+
+func TestTenantReconcileStaticAddress(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		pods        []common.Pod
+		want        []string
+		unwanted    []string
+		rejected    string
+	}{
+		{
+			name:        "tenant address taken",
+			annotations: map[string]string{common.IPAddressAnnotation: "10.1.0.2"},
+			unwanted:    []string{"--if-exists lsp-del ns1_q", "lsp-add"},
+			rejected:    "ns1-q",
+		},
+		{
+			name:        "tenant address free",
+			annotations: map[string]string{common.IPAddressAnnotation: "10.1.0.9"},
+			want: []string{
+				"--if-exists lsp-del ns1_q",
+				"lsp-add tenant_t1_node1 ns1_q",
+				"lsp-set-addresses ns1_q 0a:58:0a:01:00:09 10.1.0.9",
+			},
+		},
+		{
+			name:        "tenant mac taken",
+			annotations: map[string]string{common.MacAddressAnnotation: "0a:58:0a:01:00:02"},
+			unwanted:    []string{"--if-exists lsp-del ns1_q", "lsp-add"},
+			rejected:    "ns1-q",
+		},
+		{
+			name: "default network address free",
+			pods: []common.Pod{testPod("ns0", "s", "node1", "", map[string]string{common.IPAddressAnnotation: "10.244.1.10"})},
+			want: []string{
+				"lsp-add node1 ns0_s",
+				"lsp-set-addresses ns0_s 0a:58:0a:f4:01:0a 10.244.1.10",
+				`set logical_switch_port ns0_s external_ids:k8s-static-address=node1 external_ids:pod="ns0/s"`,
+			},
+		},
+		{
+			name:     "default network address of the management port",
+			pods:     []common.Pod{testPod("ns0", "s", "node1", "", map[string]string{common.IPAddressAnnotation: "10.244.1.2"})},
+			unwanted: []string{"lsp-add"},
+			rejected: "ns0-s",
+		},
+		{
+			name:     "default network address outside of the node's subnet",
+			pods:     []common.Pod{testPod("ns0", "s", "node1", "", map[string]string{common.IPAddressAnnotation: "10.244.2.10"})},
+			unwanted: []string{"lsp-add"},
+			rejected: "ns0-s",
+		},
+		{
+			name:     "default network mac of the router",
+			pods:     []common.Pod{testPod("ns0", "s", "node1", "", map[string]string{common.MacAddressAnnotation: "0a:58:0a:f4:01:01"})},
+			unwanted: []string{"lsp-add"},
+			rejected: "ns0-s",
+		},
+		{
+			name:     "ipv6 address",
+			pods:     []common.Pod{testPod("ns0", "s", "node1", "", map[string]string{common.IPAddressAnnotation: "fd00::10"})},
+			unwanted: []string{"lsp-add"},
+			rejected: "ns0-s",
+		},
+	}
+	for _, test := range tests {
+		f := runFakeNB(tenantTables())
+		r := &TenantReconciler{Subnet: subnet, NodePrefix: 24}
+		err := r.Reconcile(tenantCluster(true, test.annotations, test.pods...))
+		f.stop()
+		if err != nil {
+			t.Errorf("%v: Reconcile failed: %v", test.name, err)
+			continue
+		}
+		f.expect(t, test.name, test.want, test.unwanted)
+		for uid, message := range r.rejected {
+			if uid != test.rejected {
+				t.Errorf("%v: pod %v rejected: %v", test.name, uid, message)
+			}
+		}
+		if _, ok := r.rejected[test.rejected]; test.rejected != "" && !ok {
+			t.Errorf("%v: pod %v not rejected", test.name, test.rejected)
+		}
+	}
+}
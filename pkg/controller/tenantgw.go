@@ -0,0 +1,322 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// tenantJoinKey marks the static routes and NAT rows that connect a tenant
+// router to the gateway routers.  Its value is the tenant ID.
+const tenantJoinKey = "k8s-tenant-join"
+
+// tenantJoinPort returns the name of the port of tenant's router on the
+// "join" switch.
+func tenantJoinPort(tenant string) string {
+	return "rtoj-" + tenantRouterName(tenant)
+}
+
+// tenantJoinSwitchPort returns the name of the "join" switch's port that
+// peers with tenantJoinPort.
+func tenantJoinSwitchPort(tenant string) string {
+	return "jtor-" + tenantRouterName(tenant)
+}
+
+// tenantNAT is a NAT row wanted by connectTenants.
+type tenantNAT struct {
+	router     string
+	logicalIP  string
+	externalIP string
+	tenant     string
+	gw         *gateway
+}
+
+// tenantRoute is a static route wanted by connectTenants.
+type tenantRoute struct {
+	router   string
+	ipPrefix string
+	nexthop  string
+	tenant   string
+}
+
+// getJoinSubnet returns the subnet recorded on the "join" switch, or nil if
+// the switch does not exist yet.
+func getJoinSubnet() (*net.IPNet, error) {
+	rows, err := ovn.ListRows("logical_switch", []string{"other_config"}, "name=join")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	value, ok := ovn.ParseMap(rows[0]["other_config"])["subnet"]
+	if !ok {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid join subnet %q: %v", value, err)
+	}
+	return subnet, nil
+}
+
+// connectTenants adds the commands that connect the routers of tenants to
+// the "join" switch to txn, the way "ovnctl gateway" connects the gateway
+// routers.  cidrs are the subnets of each tenant's pods and Networks.
+//
+// The port on the "join" switch is a distributed gateway port bound to the
+// chassis of the healthy gateways, so that the tenant router can SNAT all
+// its traffic to the port's address there.  That address is unique in the
+// cluster, unlike the tenant subnets.  Routes on the tenant router send the
+// traffic for the management ports of the nodes to the cluster router and
+// everything else to the gateway holding the cluster's default route, which
+// SNATs it once more to its physical ip.
+func (r *TenantReconciler) connectTenants(txn *ovn.Transaction, cluster *Cluster, cidrs map[string][]*net.IPNet) error {
+	joinSubnet, err := getJoinSubnet()
+	if err != nil {
+		return err
+	}
+	if joinSubnet == nil {
+		log.Printf("join switch not found, tenant routers stay disconnected")
+		return nil
+	}
+	ones, _ := joinSubnet.Mask.Size()
+	clusterJoinIP := common.FirstIP(joinSubnet)
+
+	routerPorts, err := ovn.ListRows("logical_router_port", []string{"name", "mac", "networks", "external_ids"})
+	if err != nil {
+		return err
+	}
+	currentChassis, err := listGatewayChassis()
+	if err != nil {
+		return err
+	}
+	// The addresses and MACs in use on the "join" switch, and the ports of
+	// the tenant routers on it.
+	allocator, err := common.NewIPAllocator(joinSubnet)
+	if err != nil {
+		return err
+	}
+	allocator.AllocateIP(clusterJoinIP)
+	macs := make(map[string]bool)
+	joinIPs := make(map[string]net.IP)
+	for _, port := range routerPorts {
+		externalIDs := ovn.ParseMap(port["external_ids"])
+		if externalIDs["connect_to_join"] != "yes" {
+			continue
+		}
+		macs[port["mac"]] = true
+		for _, network := range ovn.ParseSet(port["networks"]) {
+			if ip, _, err := net.ParseCIDR(network); err == nil {
+				allocator.AllocateIP(ip)
+				if tenant, ok := externalIDs[tenantKey]; ok && port["name"] == tenantJoinPort(tenant) {
+					joinIPs[tenant] = ip
+				}
+			}
+		}
+	}
+
+	gateways, err := listGateways()
+	if err != nil {
+		return err
+	}
+	// The gateways that host the tenant join ports.  The first one takes
+	// the tenants' default route.
+	healthy := chassisGateways(cluster, gateways)
+
+	// The management port addresses of the nodes.
+	switchPorts, err := ovn.ListRows("logical_switch_port", []string{"name", "addresses"})
+	if err != nil {
+		return err
+	}
+	var managementIPs []string
+	for _, port := range switchPorts {
+		if !strings.HasPrefix(port["name"], "k8s-") {
+			continue
+		}
+		if _, ok := cluster.Nodes[strings.TrimPrefix(port["name"], "k8s-")]; !ok {
+			continue
+		}
+		if fields := strings.Fields(port["addresses"]); len(fields) >= 2 && net.ParseIP(fields[1]) != nil {
+			managementIPs = append(managementIPs, fields[1])
+		}
+	}
+
+	var tenants []string
+	for tenant := range cidrs {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var wantNAT []*tenantNAT
+	var wantRoutes []*tenantRoute
+	for _, tenant := range tenants {
+		router := tenantRouterName(tenant)
+		port := tenantJoinPort(tenant)
+		ip, ok := joinIPs[tenant]
+		if !ok {
+			if ip, err = allocator.Allocate(); err != nil {
+				log.Printf("tenant %v: no free address on the join switch: %v", tenant, err)
+				continue
+			}
+			mac := common.IPToMac(ip)
+			for i := 0; macs[mac] && i < 16; i++ {
+				if mac, err = common.GenerateMac(); err != nil {
+					return err
+				}
+			}
+			macs[mac] = true
+			txn.Add("--may-exist", "lrp-add", router, port, mac, fmt.Sprintf("%s/%d", ip, ones))
+			txn.Add("set", "logical_router_port", port, "external_ids:connect_to_join=yes", "external_ids:"+tenantKey+"="+tenant)
+			txn.Add("--may-exist", "lsp-add", "join", tenantJoinSwitchPort(tenant))
+			txn.Add("set", "logical_switch_port", tenantJoinSwitchPort(tenant), "type=router", "options:router-port="+port, "addresses=\""+mac+"\"")
+		}
+
+		setGatewayChassis(txn, port, currentChassis[port], healthy)
+
+		for _, cidr := range cidrs[tenant] {
+			wantNAT = append(wantNAT, &tenantNAT{router: router, logicalIP: cidr.String(), externalIP: ip.String(), tenant: tenant})
+		}
+		for _, gw := range gateways {
+			if gw.external != nil {
+				wantNAT = append(wantNAT, &tenantNAT{router: gw.router, logicalIP: ip.String(), externalIP: gw.external.IP.String(), tenant: tenant, gw: gw})
+			}
+		}
+		if len(healthy) > 0 {
+			wantRoutes = append(wantRoutes, &tenantRoute{router: router, ipPrefix: "0.0.0.0/0", nexthop: healthy[0].joinIP.String(), tenant: tenant})
+		}
+		for _, mgmt := range managementIPs {
+			wantRoutes = append(wantRoutes, &tenantRoute{router: router, ipPrefix: mgmt + "/32", nexthop: clusterJoinIP.String(), tenant: tenant})
+		}
+	}
+
+	if err := reconcileTenantNAT(txn, cluster, gateways, wantNAT); err != nil {
+		return err
+	}
+	return reconcileTenantRoutes(txn, cluster, wantRoutes)
+}
+
+// tenantRouters returns the names of the routers of the tenants by the
+// uuids of their rows in column.
+func tenantRouters(column string) (map[string]string, error) {
+	routers, err := ovn.ListRows("logical_router", []string{"name", column, "external_ids"})
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, router := range routers {
+		if _, ok := ovn.ParseMap(router["external_ids"])[tenantKey]; !ok {
+			continue
+		}
+		for _, uuid := range ovn.ParseSet(router[column]) {
+			owners[uuid] = router["name"]
+		}
+	}
+	return owners, nil
+}
+
+// reconcileTenantNAT adds the commands that bring the NAT rows marked with
+// tenantJoinKey in line with want to txn.  The rows of frozen tenants are
+// kept.
+func reconcileTenantNAT(txn *ovn.Transaction, cluster *Cluster, gateways map[string]*gateway, want []*tenantNAT) error {
+	rules, err := listNATRules(tenantJoinKey)
+	if err != nil {
+		return err
+	}
+	owners, err := tenantRouters("nat")
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]*tenantNAT)
+	for _, nat := range want {
+		wanted[nat.router+" "+nat.logicalIP] = nat
+	}
+	for _, rule := range rules {
+		router := owners[rule.uuid]
+		gw := routerOf(gateways, rule.uuid)
+		if gw != nil {
+			router = gw.router
+		}
+		if router == "" || cluster.FrozenTenants[rule.externalIDs[tenantJoinKey]] {
+			continue
+		}
+		key := router + " " + rule.logicalIP
+		if nat, ok := wanted[key]; ok && rule.natType == "snat" && rule.externalIP == nat.externalIP && rule.externalIDs[tenantJoinKey] == nat.tenant {
+			if gw != nil {
+				exemptNoSNAT(txn, gw, rule)
+			}
+			delete(wanted, key)
+			continue
+		}
+		txn.Add("remove", "logical_router", router, "nat", rule.uuid)
+	}
+	id := 0
+	for _, nat := range want {
+		if _, ok := wanted[nat.router+" "+nat.logicalIP]; !ok {
+			continue
+		}
+		delete(wanted, nat.router+" "+nat.logicalIP)
+		id++
+		ref := fmt.Sprintf("@tenant_nat%d", id)
+		args := []string{"--id=" + ref, "create", "nat", "type=snat", "logical_ip=\"" + nat.logicalIP + "\"", "external_ip=\"" + nat.externalIP + "\"",
+			"external_ids:" + tenantJoinKey + "=" + nat.tenant}
+		if nat.gw != nil {
+			args = append(args, noSNATArgs(nat.gw)...)
+		}
+		txn.Add(args...)
+		txn.Add("add", "logical_router", nat.router, "nat", ref)
+	}
+	return nil
+}
+
+// reconcileTenantRoutes adds the commands that bring the static routes of
+// the tenant routers marked with tenantJoinKey in line with want to txn.
+// The routes of frozen tenants are kept.
+func reconcileTenantRoutes(txn *ovn.Transaction, cluster *Cluster, want []*tenantRoute) error {
+	owners, err := tenantRouters("static_routes")
+	if err != nil {
+		return err
+	}
+	rows, err := ovn.ListRows("logical_router_static_route", []string{"_uuid", "ip_prefix", "nexthop", "external_ids"})
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]*tenantRoute)
+	for _, route := range want {
+		wanted[route.router+" "+route.ipPrefix] = route
+	}
+	for _, row := range rows {
+		tenant, ok := ovn.ParseMap(row["external_ids"])[tenantJoinKey]
+		if !ok || cluster.FrozenTenants[tenant] {
+			continue
+		}
+		router, ok := owners[row["_uuid"]]
+		if !ok {
+			continue
+		}
+		key := router + " " + row["ip_prefix"]
+		if route, ok := wanted[key]; ok && route.nexthop == row["nexthop"] {
+			delete(wanted, key)
+			continue
+		}
+		txn.Add("remove", "logical_router", router, "static_routes", row["_uuid"])
+	}
+	id := 0
+	for _, route := range want {
+		if _, ok := wanted[route.router+" "+route.ipPrefix]; !ok {
+			continue
+		}
+		delete(wanted, route.router+" "+route.ipPrefix)
+		id++
+		ref := fmt.Sprintf("@tenant_route%d", id)
+		txn.Add("--id="+ref, "create", "logical_router_static_route", "ip_prefix=\""+route.ipPrefix+"\"", "nexthop=\""+route.nexthop+"\"",
+			"external_ids:"+tenantJoinKey+"="+route.tenant)
+		txn.Add("add", "logical_router", route.router, "static_routes", ref)
+	}
+	return nil
+}
@@ -1,10 +1,48 @@
 package exec
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
+// DryRun makes RunCommand print mutating commands instead of executing them.
+// Read-only queries are still executed so callers see the real state.  That
+// state does not include the printed changes: a mutating command returns a
+// single empty line, and a later query of what it would have created finds
+// nothing.  The printed plan is therefore that of the first step of a real
+// run; later steps may differ.
+var DryRun bool
+
+// Trace makes RunCommand log every executed command and how long it took.
+var Trace bool
+
+// readOnlyCommands lists the ovn-nbctl/ovs-vsctl commands that never modify
+// the database.
+var readOnlyCommands = map[string]bool{
+	"get":                true,
+	"find":               true,
+	"list":               true,
+	"show":               true,
+	"ls-list":            true,
+	"lsp-list":           true,
+	"lsp-get-addresses":  true,
+	"lr-list":            true,
+	"lrp-list":           true,
+	"lr-route-list":      true,
+	"lr-nat-list":        true,
+	"lb-list":            true,
+	"list-br":            true,
+	"list-ports":         true,
+	"list-ifaces":        true,
+	"br-exists":          true,
+	"br-get-external-id": true,
+	"port-to-br":         true,
+	"iface-to-br":        true,
+}
+
 func absPath(cmd string) (string, error) {
 	cmdAbsPath, err := exec.LookPath(cmd)
 	if err != nil {
@@ -25,15 +63,118 @@ func buildCommand(cmd string, args ...string) (*exec.Cmd, error) {
 	return command, nil
 }
 
-func RunCommand(cmd string, args ...string) ([]string, error) {
+// positionalArgs returns args without the leading options.
+func positionalArgs(args []string) []string {
+	var positional []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		positional = append(positional, arg)
+	}
+	return positional
+}
+
+// isReadOnly reports whether running cmd with args leaves the system unchanged.
+func isReadOnly(cmd string, args []string) bool {
+	switch cmd {
+	case "ovn-nbctl", "ovs-vsctl":
+		// Commands chained with "--" are all run in one transaction, so
+		// every one of them has to be read-only.
+		group := []string{}
+		for i := 0; i <= len(args); i++ {
+			if i < len(args) && args[i] != "--" {
+				group = append(group, args[i])
+				continue
+			}
+			positional := positionalArgs(group)
+			if len(positional) > 0 && !readOnlyCommands[positional[0]] {
+				return false
+			}
+			group = group[:0]
+		}
+		return true
+	case "ip":
+		positional := positionalArgs(args)
+		if len(positional) < 2 {
+			return true
+		}
+		switch positional[1] {
+		case "show", "list", "lst", "get":
+			return true
+		}
+		return false
+	case "systemctl":
+		positional := positionalArgs(args)
+		if len(positional) == 0 {
+			return false
+		}
+		switch positional[0] {
+		case "is-active", "is-enabled", "status", "show":
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// FormatCommand renders cmd and args the way they would be typed in a shell.
+func FormatCommand(cmd string, args ...string) string {
+	words := []string{cmd}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// RunCommand runs cmd with args and returns the lines of its output.  It is
+// a variable so that tests can fake the commands.
+var RunCommand = runCommand
+
+func runCommand(cmd string, args ...string) ([]string, error) {
+	if DryRun && !isReadOnly(cmd, args) {
+		fmt.Printf("[dry-run] %s\n", FormatCommand(cmd, args...))
+		return []string{""}, nil
+	}
+
 	command, err := buildCommand(cmd, args...)
 	if err != nil {
 		return nil, err
 	}
 
+	start := time.Now()
 	output, err := command.CombinedOutput()
+	if Trace {
+		status := "ok"
+		if err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(os.Stderr, "[trace] %s (%v, %s)\n", FormatCommand(cmd, args...), time.Since(start), status)
+	}
 	if err != nil {
 		return []string{string(output)}, err
 	}
 	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
 }
+
+// Apply runs fn, which changes the system in the way described by desc.  In
+// dry-run mode only desc is printed.
+func Apply(desc string, fn func() error) error {
+	if DryRun {
+		fmt.Printf("[dry-run] %s\n", desc)
+		return nil
+	}
+	start := time.Now()
+	err := fn()
+	if Trace {
+		status := "ok"
+		if err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(os.Stderr, "[trace] %s (%v, %s)\n", desc, time.Since(start), status)
+	}
+	return err
+}
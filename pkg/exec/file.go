@@ -0,0 +1,57 @@
+package exec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile atomically replaces the content of path with data, so readers
+// never see a partially written file. In dry-run mode the content is printed
+// instead.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if DryRun {
+		fmt.Printf("[dry-run] write %s:\n%s", path, data)
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// MkdirAll creates path and its parents. In dry-run mode it only prints
+// what would be created.
+func MkdirAll(path string, perm os.FileMode) error {
+	if DryRun {
+		fmt.Printf("[dry-run] mkdir -p %s\n", path)
+		return nil
+	}
+	return os.MkdirAll(path, perm)
+}
+
+// RemoveFile removes path if it exists. In dry-run mode it only prints what
+// would be removed.
+func RemoveFile(path string) error {
+	if DryRun {
+		fmt.Printf("[dry-run] rm -f %s\n", path)
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Package keystone resolves OpenStack tenants, the projects of a Keystone
+// compatible identity service, to their IDs.
+package keystone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for tenants the identity service does not know.
+var ErrNotFound = errors.New("tenant not found")
+
+// Resolver maps a tenant, given by name or ID, to its ID.
+type Resolver interface {
+	TenantID(tenant string) (string, error)
+}
+
+// Client resolves tenants through the Keystone v3 API.  It authenticates
+// with a password and reuses the token until it is about to expire.
+type Client struct {
+	URL      string
+	Username string
+	Password string
+	// Project is the project the token is scoped to.
+	Project string
+	// Domain is the domain of the user and of Project.
+	Domain string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// authRequest is the body of POST /v3/auth/tokens.
+type authRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+					Domain   struct {
+						Name string `json:"name"`
+					} `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope *authScope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+// authScope scopes a token to a project.
+type authScope struct {
+	Project struct {
+		Name   string `json:"name"`
+		Domain struct {
+			Name string `json:"name"`
+		} `json:"domain"`
+	} `json:"project"`
+}
+
+// Token returns a valid token, requesting a new one when needed.  Other
+// OpenStack services accept it too.
+func (c *Client) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.expires) {
+		return c.token, nil
+	}
+
+	req := &authRequest{}
+	identity := &req.Auth.Identity
+	identity.Methods = []string{"password"}
+	identity.Password.User.Name = c.Username
+	identity.Password.User.Password = c.Password
+	identity.Password.User.Domain.Name = c.Domain
+	if c.Project != "" {
+		req.Auth.Scope = &authScope{}
+		req.Auth.Scope.Project.Name = c.Project
+		req.Auth.Scope.Project.Domain.Name = c.Domain
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post(strings.TrimSuffix(c.URL, "/")+"/v3/auth/tokens", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate to keystone: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to authenticate to keystone: %v: %s", resp.Status, data)
+	}
+	var token struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"token"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", fmt.Errorf("failed to parse keystone token: %v", err)
+	}
+	c.token = resp.Header.Get("X-Subject-Token")
+	c.expires = token.Token.ExpiresAt
+	return c.token, nil
+}
+
+// get fetches path from the identity service into v.  It returns
+// ErrNotFound for a 404.
+func (c *Client) get(path string, v interface{}) error {
+	token, err := c.Token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.Unmarshal(data, v)
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized:
+		c.Invalidate()
+	}
+	return fmt.Errorf("GET %v returned %v: %s", path, resp.Status, data)
+}
+
+// Invalidate drops the token, so that the next request authenticates
+// again.
+func (c *Client) Invalidate() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
+
+type project struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// TenantID looks tenant up as a project name first and as a project ID
+// second.  Disabled projects are not found.
+func (c *Client) TenantID(tenant string) (string, error) {
+	var list struct {
+		Projects []project `json:"projects"`
+	}
+	if err := c.get("/v3/projects?name="+url.QueryEscape(tenant), &list); err != nil && err != ErrNotFound {
+		return "", err
+	}
+	for _, p := range list.Projects {
+		if p.Enabled {
+			return p.ID, nil
+		}
+	}
+
+	var byID struct {
+		Project project `json:"project"`
+	}
+	if err := c.get("/v3/projects/"+url.PathEscape(tenant), &byID); err != nil {
+		return "", err
+	}
+	if !byID.Project.Enabled {
+		return "", ErrNotFound
+	}
+	return byID.Project.ID, nil
+}
+
+// Stub resolves tenants from a fixed table of names to IDs.  It stands in
+// for Keystone in tests and small setups.
+type Stub struct {
+	Tenants map[string]string
+}
+
+// NewStub loads the table of a Stub from a JSON object file such as
+// {"tenant-a": "0d7dd5a3b9e94a8f8b4e19e2a1f1b2c3"}.
+func NewStub(path string) (*Stub, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stub := &Stub{}
+	if err := json.Unmarshal(data, &stub.Tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	return stub, nil
+}
+
+// TenantID returns the ID of the tenant named tenant, or tenant itself when
+// it is one of the IDs.
+func (s *Stub) TenantID(tenant string) (string, error) {
+	if id, ok := s.Tenants[tenant]; ok {
+		return id, nil
+	}
+	for _, id := range s.Tenants {
+		if id == tenant {
+			return id, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+type cacheEntry struct {
+	id      string
+	err     error
+	expires time.Time
+}
+
+// Cache remembers the answers of a Resolver for TTL, including unknown
+// tenants.  Other errors are not cached.
+type Cache struct {
+	Resolver Resolver
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewCache returns a cache in front of resolver.
+func NewCache(resolver Resolver, ttl time.Duration) *Cache {
+	return &Cache{Resolver: resolver, TTL: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (c *Cache) TenantID(tenant string) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[tenant]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.id, entry.err
+	}
+
+	id, err := c.Resolver.TenantID(tenant)
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	c.mu.Lock()
+	c.entries[tenant] = cacheEntry{id: id, err: err, expires: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+	return id, err
+}
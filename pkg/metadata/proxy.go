@@ -0,0 +1,140 @@
+// Package metadata proxies the requests pods send to the OpenStack metadata
+// address to a Nova compatible metadata service, adding the identity of the
+// pod the way the Neutron metadata agent does for instances.
+package metadata
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// Instance is the identity of a pod as seen by the metadata service.
+type Instance struct {
+	// ID is the pod's UID.
+	ID string
+	// Tenant is the tenant ID of the pod's switch, "" outside of tenants.
+	Tenant string
+	Pod    string
+}
+
+// Proxy forwards metadata requests to Upstream.
+type Proxy struct {
+	Upstream *url.URL
+	// Secret signs the instance ID like Nova's metadata_proxy_shared_secret.
+	Secret string
+	// Server is the Kubernetes API server the pods are read from.
+	Server string
+}
+
+// Lookup identifies the pod with address ip on logical switch sw.  The pod
+// is found through the logical switch port holding ip: its "pod" external
+// ID, or its <namespace>_<name> name.
+func (p *Proxy) Lookup(sw string, ip net.IP) (*Instance, error) {
+	switches, err := ovn.ListRows("logical_switch", []string{"ports", "external_ids"}, "name="+sw)
+	if err != nil {
+		return nil, err
+	}
+	if len(switches) == 0 {
+		return nil, fmt.Errorf("logical switch %v not found", sw)
+	}
+	onSwitch := make(map[string]bool)
+	for _, uuid := range ovn.ParseSet(switches[0]["ports"]) {
+		onSwitch[uuid] = true
+	}
+	tenant := ovn.ParseMap(switches[0]["external_ids"])["k8s-tenant"]
+
+	ports, err := ovn.ListRows("logical_switch_port", []string{"_uuid", "name", "addresses", "external_ids"})
+	if err != nil {
+		return nil, err
+	}
+	for _, port := range ports {
+		if !onSwitch[port["_uuid"]] || !hasAddress(port["addresses"], ip) {
+			continue
+		}
+		externalIDs := ovn.ParseMap(port["external_ids"])
+		key := externalIDs["pod"]
+		if key == "" {
+			// Kubernetes names have no underscores.
+			key = strings.Replace(port["name"], "_", "/", 1)
+		}
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			break
+		}
+		pod, err := common.GetPod(p.Server, parts[0], parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pod %v: %v", key, err)
+		}
+		if t, ok := externalIDs["k8s-tenant"]; ok {
+			tenant = t
+		}
+		return &Instance{ID: pod.Metadata.UID, Tenant: tenant, Pod: key}, nil
+	}
+	return nil, fmt.Errorf("no pod with address %v on %v", ip, sw)
+}
+
+// hasAddress reports whether the bare addresses column of a switch port
+// holds ip.
+func hasAddress(addresses string, ip net.IP) bool {
+	for _, field := range strings.Fields(addresses) {
+		if other := net.ParseIP(field); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the signature of an instance ID.
+func (p *Proxy) sign(id string) string {
+	mac := hmac.New(sha256.New, []byte(p.Secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler returns the handler of the metadata requests of the pods on
+// logical switch sw.  Requests of unknown addresses are refused.
+func (p *Proxy) Handler(sw string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			http.Error(w, "bad remote address", http.StatusBadRequest)
+			return
+		}
+		instance, err := p.Lookup(sw, ip)
+		if err != nil {
+			log.Printf("metadata request of %v on %v: %v", ip, sw, err)
+			http.Error(w, "instance not found", http.StatusNotFound)
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{Director: func(out *http.Request) {
+			out.URL.Scheme = p.Upstream.Scheme
+			out.URL.Host = p.Upstream.Host
+			out.URL.Path = strings.TrimSuffix(p.Upstream.Path, "/") + req.URL.Path
+			out.Host = p.Upstream.Host
+			// Pods must not choose their identity.
+			for _, header := range []string{"X-Forwarded-For", "X-Instance-Id", "X-Tenant-Id", "X-Instance-Id-Signature"} {
+				out.Header.Del(header)
+			}
+			out.Header.Set("X-Instance-ID", instance.ID)
+			out.Header.Set("X-Instance-ID-Signature", p.sign(instance.ID))
+			if instance.Tenant != "" {
+				out.Header.Set("X-Tenant-ID", instance.Tenant)
+			}
+		}}
+		// ReverseProxy sets X-Forwarded-For to the pod's address.
+		proxy.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,453 @@
+// Package neutron manages the ports of pods on the networks of an OpenStack
+// Networking (Neutron) compatible service.
+package neutron
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// ErrNotFound is returned for networks and ports Neutron does not know.
+var ErrNotFound = errors.New("not found")
+
+// DeviceOwner is the device_owner of the ports created for pods.
+const DeviceOwner = "compute:kubernetes"
+
+// Network is a Neutron network.
+type Network struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Subnets   []string `json:"subnets"`
+	ProjectID string   `json:"project_id,omitempty"`
+	// Shared networks may be used by every project.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// UsableBy reports whether the project may put ports on the network.
+func (n *Network) UsableBy(project string) bool {
+	return n.Shared || project != "" && n.ProjectID == project
+}
+
+// Subnet is a Neutron subnet.
+type Subnet struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	NetworkID string `json:"network_id"`
+	CIDR      string `json:"cidr"`
+	GatewayIP string `json:"gateway_ip"`
+	IPVersion int    `json:"ip_version"`
+}
+
+// FixedIP is an address of a port.
+type FixedIP struct {
+	SubnetID  string `json:"subnet_id"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// Port is a Neutron port.  The Neutron OVN driver creates a logical switch
+// port named after its ID.
+type Port struct {
+	ID          string    `json:"id,omitempty"`
+	Name        string    `json:"name"`
+	NetworkID   string    `json:"network_id"`
+	MacAddress  string    `json:"mac_address,omitempty"`
+	FixedIPs    []FixedIP `json:"fixed_ips,omitempty"`
+	DeviceID    string    `json:"device_id"`
+	DeviceOwner string    `json:"device_owner"`
+	HostID      string    `json:"binding:host_id,omitempty"`
+	ProjectID   string    `json:"project_id,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Status      string    `json:"status,omitempty"`
+}
+
+// ClusterDescription returns the description of the ports created for the
+// pods of cluster.  It tells apart the ports of clusters sharing a Neutron.
+func ClusterDescription(cluster string) string {
+	return "kubernetes-cluster:" + cluster
+}
+
+// IP returns the address of port on subnet, or nil.
+func (p *Port) IP(subnet string) net.IP {
+	for _, fixed := range p.FixedIPs {
+		if fixed.SubnetID == subnet {
+			return net.ParseIP(fixed.IPAddress)
+		}
+	}
+	return nil
+}
+
+// API is the part of the Neutron API used for pods.
+type API interface {
+	// Network looks a network up by ID or by name.  A name is looked up
+	// among the networks of project first and then among the shared ones.
+	Network(network, project string) (*Network, error)
+	// Subnets returns the subnets of a network.
+	Subnets(networkID string) ([]Subnet, error)
+	// Ports returns the ports with the device owner.
+	Ports(deviceOwner string) ([]Port, error)
+	CreatePort(port *Port) (*Port, error)
+	DeletePort(id string) error
+}
+
+// TokenSource provides the tokens Neutron is called with, usually a
+// keystone.Client.
+type TokenSource interface {
+	Token() (string, error)
+	// Invalidate drops a token Neutron rejected.
+	Invalidate()
+}
+
+// Client calls the Neutron v2.0 API.
+type Client struct {
+	URL    string
+	Tokens TokenSource
+}
+
+// do sends a request with in as JSON body to Neutron and decodes the answer
+// into out.  It returns ErrNotFound for a 404.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	token, err := c.Tokens.Token()
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized:
+		c.Tokens.Invalidate()
+	}
+	return fmt.Errorf("%v %v returned %v: %s", method, path, resp.Status, data)
+}
+
+func (c *Client) Network(network, project string) (*Network, error) {
+	var queries []string
+	if project != "" {
+		queries = append(queries, "&project_id="+url.QueryEscape(project))
+	}
+	queries = append(queries, "&shared=true")
+	for _, query := range queries {
+		var list struct {
+			Networks []Network `json:"networks"`
+		}
+		if err := c.do("GET", "/v2.0/networks?name="+url.QueryEscape(network)+query, nil, &list); err != nil {
+			return nil, err
+		}
+		if len(list.Networks) > 1 {
+			return nil, fmt.Errorf("network name %v is ambiguous", network)
+		}
+		if len(list.Networks) == 1 {
+			return &list.Networks[0], nil
+		}
+	}
+	var byID struct {
+		Network Network `json:"network"`
+	}
+	if err := c.do("GET", "/v2.0/networks/"+url.PathEscape(network), nil, &byID); err != nil {
+		return nil, err
+	}
+	return &byID.Network, nil
+}
+
+func (c *Client) Subnets(networkID string) ([]Subnet, error) {
+	var list struct {
+		Subnets []Subnet `json:"subnets"`
+	}
+	if err := c.do("GET", "/v2.0/subnets?network_id="+url.QueryEscape(networkID), nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Subnets, nil
+}
+
+func (c *Client) Ports(deviceOwner string) ([]Port, error) {
+	var list struct {
+		Ports []Port `json:"ports"`
+	}
+	if err := c.do("GET", "/v2.0/ports?device_owner="+url.QueryEscape(deviceOwner), nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Ports, nil
+}
+
+func (c *Client) CreatePort(port *Port) (*Port, error) {
+	var created struct {
+		Port Port `json:"port"`
+	}
+	if err := c.do("POST", "/v2.0/ports", map[string]*Port{"port": port}, &created); err != nil {
+		return nil, err
+	}
+	return &created.Port, nil
+}
+
+func (c *Client) DeletePort(id string) error {
+	err := c.do("DELETE", "/v2.0/ports/"+url.PathEscape(id), nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Stub serves networks and subnets from a file and keeps ports in memory.
+// Like the Neutron OVN driver it creates a logical switch "neutron-<network
+// ID>" per network and a logical switch port per port, so that pods can be
+// attached without an OpenStack deployment in tests and small setups.  The
+// ports are recorded on their logical switch ports, from which they are
+// loaded again when the stub is created.
+type Stub struct {
+	NetworkList []Network `json:"networks"`
+	SubnetList  []Subnet  `json:"subnets"`
+
+	mu    sync.Mutex
+	ports map[string]*Port
+}
+
+// NewStub loads the networks and subnets of a Stub from a JSON file such as
+// {"networks": [{"id": "...", "name": "private", "subnets": ["..."]}],
+// "subnets": [{"id": "...", "network_id": "...", "cidr": "10.0.0.0/24",
+// "gateway_ip": "10.0.0.1", "ip_version": 4}]}.
+func NewStub(path string) (*Stub, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stub := &Stub{ports: make(map[string]*Port)}
+	if err := json.Unmarshal(data, stub); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	if err := stub.loadPorts(); err != nil {
+		return nil, err
+	}
+	return stub, nil
+}
+
+// loadPorts rebuilds the ports from the logical switch ports of the
+// "neutron-<network ID>" switches.
+func (s *Stub) loadPorts() error {
+	switches, err := ovn.ListRows("logical_switch", []string{"name", "ports"})
+	if err != nil {
+		return err
+	}
+	network := make(map[string]string)
+	for _, sw := range switches {
+		if !strings.HasPrefix(sw["name"], "neutron-") {
+			continue
+		}
+		for _, uuid := range ovn.ParseSet(sw["ports"]) {
+			network[uuid] = strings.TrimPrefix(sw["name"], "neutron-")
+		}
+	}
+	rows, err := ovn.ListRows("logical_switch_port", []string{"_uuid", "name", "addresses", "external_ids"})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		networkID, ok := network[row["_uuid"]]
+		fields := strings.Fields(row["addresses"])
+		if !ok || len(fields) < 2 {
+			continue
+		}
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		port := &Port{
+			ID:          row["name"],
+			Name:        externalIDs["neutron:port_name"],
+			NetworkID:   networkID,
+			MacAddress:  fields[0],
+			DeviceID:    externalIDs["neutron:device_id"],
+			DeviceOwner: externalIDs["neutron:device_owner"],
+			HostID:      externalIDs["neutron:host_id"],
+			ProjectID:   externalIDs["neutron:project_id"],
+			Description: externalIDs["neutron:description"],
+			Status:      "DOWN",
+		}
+		ip := net.ParseIP(fields[1])
+		subnets, _ := s.Subnets(networkID)
+		for _, subnet := range subnets {
+			if _, cidr, err := net.ParseCIDR(subnet.CIDR); err == nil && ip != nil && cidr.Contains(ip) {
+				port.FixedIPs = []FixedIP{{SubnetID: subnet.ID, IPAddress: ip.String()}}
+				break
+			}
+		}
+		s.ports[port.ID] = port
+	}
+	return nil
+}
+
+func (s *Stub) Network(network, project string) (*Network, error) {
+	var shared *Network
+	for i := range s.NetworkList {
+		n := &s.NetworkList[i]
+		if n.ID == network {
+			return n, nil
+		}
+		if n.Name != network {
+			continue
+		}
+		if project != "" && n.ProjectID == project {
+			return n, nil
+		}
+		if n.Shared && shared == nil {
+			shared = n
+		}
+	}
+	if shared != nil {
+		return shared, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Stub) Subnets(networkID string) ([]Subnet, error) {
+	var subnets []Subnet
+	for _, subnet := range s.SubnetList {
+		if subnet.NetworkID == networkID {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets, nil
+}
+
+func (s *Stub) Ports(deviceOwner string) ([]Port, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ports []Port
+	for _, port := range s.ports {
+		if port.DeviceOwner == deviceOwner {
+			ports = append(ports, *port)
+		}
+	}
+	return ports, nil
+}
+
+// newUUID returns a random UUID for the ports of the stub.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// CreatePort gives port an address on its first subnet, or on the first
+// subnet of its network, and creates its logical switch port.
+func (s *Stub) CreatePort(port *Port) (*Port, error) {
+	network, err := s.Network(port.NetworkID, "")
+	if err != nil {
+		return nil, err
+	}
+	subnets, err := s.Subnets(network.ID)
+	if err != nil {
+		return nil, err
+	}
+	var subnet *Subnet
+	for i := range subnets {
+		if len(port.FixedIPs) == 0 || subnets[i].ID == port.FixedIPs[0].SubnetID {
+			subnet = &subnets[i]
+			break
+		}
+	}
+	if subnet == nil {
+		return nil, fmt.Errorf("network %v has no such subnet", network.ID)
+	}
+	_, cidr, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("subnet %v: %v", subnet.ID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allocator, err := common.NewIPAllocator(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("subnet %v: %v", subnet.ID, err)
+	}
+	if gw := net.ParseIP(subnet.GatewayIP); gw != nil {
+		allocator.AllocateIP(gw)
+	}
+	for _, other := range s.ports {
+		if ip := other.IP(subnet.ID); ip != nil {
+			allocator.AllocateIP(ip)
+		}
+	}
+	ip, err := allocator.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	created := *port
+	created.ID = id
+	created.NetworkID = network.ID
+	created.FixedIPs = []FixedIP{{SubnetID: subnet.ID, IPAddress: ip.String()}}
+	if ip4 := ip.To4(); ip4 != nil {
+		created.MacAddress = fmt.Sprintf("fa:16:3e:%02x:%02x:%02x", ip4[1], ip4[2], ip4[3])
+	} else {
+		created.MacAddress = fmt.Sprintf("fa:16:3e:%02x:%02x:%02x", ip[13], ip[14], ip[15])
+	}
+	created.Status = "DOWN"
+
+	ls := "neutron-" + network.ID
+	addresses := created.MacAddress + " " + ip.String()
+	_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "ls-add", ls, "--", "lsp-add", ls, id,
+		"--", "lsp-set-addresses", id, addresses, "--", "lsp-set-port-security", id, addresses,
+		"--", "set", "logical_switch_port", id, "external_ids:\"neutron:port_name\"=\""+created.Name+"\"",
+		"external_ids:\"neutron:device_id\"=\""+created.DeviceID+"\"", "external_ids:\"neutron:device_owner\"=\""+created.DeviceOwner+"\"",
+		"external_ids:\"neutron:host_id\"=\""+created.HostID+"\"", "external_ids:\"neutron:project_id\"=\""+created.ProjectID+"\"",
+		"external_ids:\"neutron:description\"=\""+created.Description+"\"")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the switch port of %v: %v", id, err)
+	}
+	s.ports[id] = &created
+	return &created, nil
+}
+
+func (s *Stub) DeletePort(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := exec.RunCommand("ovn-nbctl", "--if-exists", "lsp-del", id); err != nil {
+		return err
+	}
+	delete(s.ports, id)
+	return nil
+}
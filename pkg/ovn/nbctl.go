@@ -0,0 +1,124 @@
+package ovn
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+)
+
+// Transaction collects ovn-nbctl commands so that they can be applied in a
+// single atomic transaction of the northbound database.
+type Transaction struct {
+	args []string
+}
+
+// Add appends one ovn-nbctl command, including its options, to the transaction.
+func (t *Transaction) Add(args ...string) {
+	t.args = append(t.args, "--")
+	t.args = append(t.args, args...)
+}
+
+// Empty reports whether no command has been added since the last commit.
+func (t *Transaction) Empty() bool {
+	return len(t.args) == 0
+}
+
+// Commit runs all the collected commands in one ovn-nbctl invocation.  Either
+// all of them are applied or none is.
+func (t *Transaction) Commit() error {
+	if len(t.args) == 0 {
+		return nil
+	}
+	re, err := exec.RunCommand("ovn-nbctl", t.args...)
+	if err != nil {
+		return fmt.Errorf("failed to commit northbound transaction: %v %v", err, re)
+	}
+	t.args = nil
+	return nil
+}
+
+// ListRows returns the given columns of the rows of table that match the
+// conditions, e.g. "external_ids:k8s-cluster-router=yes".  Without
+// conditions all the rows are returned.  Values are in ovn-nbctl's bare
+// format: sets and maps are space separated.
+func ListRows(table string, columns []string, conditions ...string) ([]map[string]string, error) {
+	args := []string{"--format=csv", "--data=bare", "--no-heading", "--columns=" + strings.Join(columns, ",")}
+	if len(conditions) == 0 {
+		args = append(args, "list", table)
+	} else {
+		args = append(append(args, "find", table), conditions...)
+	}
+	re, err := exec.RunCommand("ovn-nbctl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %v: %v %v", table, err, re)
+	}
+	reader := csv.NewReader(strings.NewReader(strings.Join(re, "\n")))
+	// Rows of an unexpected width are skipped below rather than failing all.
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v rows: %v", table, err)
+	}
+	var rows []map[string]string
+	for _, record := range records {
+		if len(record) != len(columns) {
+			continue
+		}
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+var (
+	columnsLock sync.Mutex
+	// columns caches the answers of HasColumn.
+	columns = make(map[string]bool)
+)
+
+// HasColumn reports whether table of the northbound schema has column, so
+// that features of newer OVN versions can be detected.  The answer is
+// cached, the schema does not change while the process runs.
+func HasColumn(table, column string) (bool, error) {
+	columnsLock.Lock()
+	defer columnsLock.Unlock()
+	key := table + ":" + column
+	if has, ok := columns[key]; ok {
+		return has, nil
+	}
+	re, err := exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns="+column, "list", table)
+	if err != nil {
+		if !strings.Contains(strings.Join(re, " "), "does not contain a column") {
+			return false, fmt.Errorf("failed to look up column %v of %v: %v %v", column, table, err, re)
+		}
+		columns[key] = false
+		return false, nil
+	}
+	columns[key] = true
+	return true, nil
+}
+
+// ParseSet splits a bare set value into its elements.
+func ParseSet(value string) []string {
+	return strings.Fields(value)
+}
+
+// ParseMap splits a bare map value such as "a=b c=d" into its pairs.
+func ParseMap(value string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Fields(value) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		} else {
+			m[kv[0]] = ""
+		}
+	}
+	return m
+}
@@ -0,0 +1,114 @@
+package ovn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{"a b  c", []string{"a", "b", "c"}},
+		{" 10.0.0.1/24 fd00::1/64 ", []string{"10.0.0.1/24", "fd00::1/64"}},
+	}
+	for _, test := range tests {
+		if got := ParseSet(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseSet(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseMap(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]string
+	}{
+		{"", map[string]string{}},
+		{"a=b", map[string]string{"a": "b"}},
+		{"a=b c=d", map[string]string{"a": "b", "c": "d"}},
+		{"url=http://x/?a=b", map[string]string{"url": "http://x/?a=b"}},
+		{"empty= flag", map[string]string{"empty": "", "flag": ""}},
+	}
+	for _, test := range tests {
+		if got := ParseMap(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseMap(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+// fakeNbctl puts an ovn-nbctl on PATH that records its arguments and prints
+// output.  It returns the file the arguments are recorded in.
+func fakeNbctl(t *testing.T, output string) (string, func()) {
+	dir, err := ioutil.TempDir("", "nbctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\ncat <<'EOF'\n" + output + "EOF\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ovn-nbctl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return args, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestListRows(t *testing.T) {
+	args, cleanup := fakeNbctl(t, strings.Join([]string{
+		`sw1,subnet=10.0.0.0/24,p1 p2`,
+		`sw2,"a=b,c",`,
+		`short,row`,
+		`"sw 3",,p3`,
+	}, "\n")+"\n")
+	defer cleanup()
+
+	rows, err := ListRows("logical_switch", []string{"name", "other_config", "ports"}, "external_ids:k8s-node=n1")
+	if err != nil {
+		t.Fatalf("ListRows failed: %v", err)
+	}
+	want := []map[string]string{
+		{"name": "sw1", "other_config": "subnet=10.0.0.0/24", "ports": "p1 p2"},
+		{"name": "sw2", "other_config": "a=b,c", "ports": ""},
+		{"name": "sw 3", "other_config": "", "ports": "p3"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("ListRows = %v, want %v", rows, want)
+	}
+
+	data, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := "--format=csv --data=bare --no-heading --columns=name,other_config,ports find logical_switch external_ids:k8s-node=n1"
+	if got := strings.TrimSpace(string(data)); got != wantArgs {
+		t.Errorf("ovn-nbctl ran with %q, want %q", got, wantArgs)
+	}
+}
+
+func TestListRowsAll(t *testing.T) {
+	args, cleanup := fakeNbctl(t, "")
+	defer cleanup()
+
+	rows, err := ListRows("acl", []string{"_uuid"})
+	if err != nil || len(rows) != 0 {
+		t.Errorf("ListRows = %v, %v, want no rows", rows, err)
+	}
+	data, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); !strings.HasSuffix(got, " list acl") {
+		t.Errorf("ovn-nbctl ran with %q, want a list of acl", got)
+	}
+}
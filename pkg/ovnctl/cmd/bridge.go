@@ -0,0 +1,580 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/spf13/cobra"
+)
+
+var BRIDGE_STATE_DIR = "/var/lib/ovnctl"
+
+// savedAddress is an address of a NIC, saved as the arguments of
+// "ip -f <family> addr add" without the device.
+type savedAddress struct {
+	Family string   `json:"family"`
+	Args   []string `json:"args"`
+}
+
+// savedFile is a network configuration file as it was before "bridge create"
+// rewrote it.
+type savedFile struct {
+	Path    string `json:"path"`
+	Data    string `json:"data"`
+	Existed bool   `json:"existed"`
+}
+
+// bridgeState records how a NIC was configured before it was moved into an
+// OVS bridge, so that "bridge delete" can restore it.  Backend is the tool
+// the bridge's configuration is persisted with (see networkBackend), Files
+// the original content of the files it rewrote and Stanza the original
+// /etc/network/interfaces stanza of the nic.
+type bridgeState struct {
+	Nic       string         `json:"nic"`
+	Bridge    string         `json:"bridge"`
+	Addresses []savedAddress `json:"addresses"`
+	Routes    [][]string     `json:"routes"`
+	Backend   string         `json:"backend,omitempty"`
+	Files     []savedFile    `json:"files,omitempty"`
+	Stanza    string         `json:"stanza,omitempty"`
+}
+
+func InitBridge() *cobra.Command {
+
+	var BridgeCmd = &cobra.Command{
+		Use:   "bridge",
+		Short: "manage OVS bridges for physical nics",
+	}
+
+	var CreateCmd = &cobra.Command{
+		Use:   "create [no options!]",
+		Short: "create an OVS bridge for a nic and move the nic's ip configuration onto it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := createBridge(cmd, args); err != nil {
+				return fmt.Errorf("failed create bridge: %v", err)
+			}
+			return nil
+		},
+	}
+	CreateCmd.Flags().StringP("nic", "", "", "The nic to move into the OVS bridge br<nic>.")
+
+	var DeleteCmd = &cobra.Command{
+		Use:   "delete [no options!]",
+		Short: "delete the OVS bridge of a nic and restore the nic's ip configuration",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := deleteBridge(cmd, args); err != nil {
+				return fmt.Errorf("failed delete bridge: %v", err)
+			}
+			return nil
+		},
+	}
+	DeleteCmd.Flags().StringP("nic", "", "", "The nic whose OVS bridge br<nic> is deleted.")
+
+	BridgeCmd.AddCommand(CreateCmd)
+	BridgeCmd.AddCommand(DeleteCmd)
+	return BridgeCmd
+}
+
+func bridgeStatePath(nic string) string {
+	return BRIDGE_STATE_DIR + "/bridge-" + nic + ".json"
+}
+
+func loadBridgeState(nic string) (*bridgeState, error) {
+	data, err := ioutil.ReadFile(bridgeStatePath(nic))
+	if err != nil {
+		return nil, err
+	}
+	state := &bridgeState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed parse %v: %v", bridgeStatePath(nic), err)
+	}
+	return state, nil
+}
+
+func saveBridgeState(state *bridgeState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := exec.MkdirAll(BRIDGE_STATE_DIR, 0755); err != nil {
+		return err
+	}
+	return exec.WriteFile(bridgeStatePath(state.Nic), data, 0644)
+}
+
+// saveIPAddress returns the addresses of port the way ovs-lib's
+// save_ip_address does: dynamic and link scope addresses are skipped and the
+// device name is dropped.
+func saveIPAddress(port string) ([]savedAddress, error) {
+	re, err := exec.RunCommand("ip", "addr", "show", "dev", port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of %v: %v", port, err)
+	}
+	var addresses []savedAddress
+	for _, line := range re {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || (fields[0] != "inet" && fields[0] != "inet6") {
+			continue
+		}
+		address := savedAddress{Family: fields[0]}
+		skip := false
+		for i := 1; i < len(fields); i++ {
+			field := fields[i]
+			if field == "dynamic" {
+				skip = true
+				break
+			}
+			if field == "scope" && i+1 < len(fields) && fields[i+1] == "link" {
+				skip = true
+				break
+			}
+			if field == port || strings.HasPrefix(field, port+":") {
+				continue
+			}
+			address.Args = append(address.Args, field)
+		}
+		if !skip {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+// saveIPRoute returns the routes of port the way ovs-lib's save_ip_route
+// does: the routes installed by the kernel are skipped.
+func saveIPRoute(port string) ([][]string, error) {
+	re, err := exec.RunCommand("ip", "route", "show", "dev", port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get routes of %v: %v", port, err)
+	}
+	var routes [][]string
+	for _, line := range re {
+		if strings.TrimSpace(line) == "" || strings.Contains(" "+line+" ", " proto kernel ") {
+			continue
+		}
+		routes = append(routes, strings.Fields(line))
+	}
+	return routes, nil
+}
+
+// moveIPConfig flushes the addresses and boot routes of from and installs
+// the saved ones on to.
+func moveIPConfig(from, to string, addresses []savedAddress, routes [][]string) error {
+	if _, err := exec.RunCommand("ip", "addr", "flush", "dev", from); err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		args := append([]string{"-f", address.Family, "addr", "replace"}, address.Args...)
+		if _, err := exec.RunCommand("ip", append(args, "dev", to)...); err != nil {
+			return fmt.Errorf("failed to move address %v to %v: %v", address.Args, to, err)
+		}
+	}
+	if _, err := exec.RunCommand("ip", "link", "set", to, "up"); err != nil {
+		return err
+	}
+	// Nothing may be left to flush, which is fine.
+	exec.RunCommand("ip", "route", "flush", "dev", from, "proto", "boot")
+	for _, route := range routes {
+		args := append([]string{"route", "replace"}, route...)
+		if _, err := exec.RunCommand("ip", append(args, "dev", to)...); err != nil {
+			return fmt.Errorf("failed to move route %v to %v: %v", route, to, err)
+		}
+	}
+	return nil
+}
+
+// createBridge is the Go version of "ovn-k8s-util.sh nics-to-bridge".  The
+// original configuration of the nic is persisted under BRIDGE_STATE_DIR, which
+// makes re-running the command safe and lets "bridge delete" restore it.  The
+// new configuration is written with the same tool as the management port's.
+func createBridge(cmd *cobra.Command, args []string) error {
+	nic := cmd.Flags().Lookup("nic").Value.String()
+	if nic == "" {
+		return fmt.Errorf("failed get nic")
+	}
+	if _, err := os.Stat("/sys/class/net/" + nic); err != nil {
+		return fmt.Errorf("interface %v does not exist", nic)
+	}
+	data, err := ioutil.ReadFile("/sys/class/net/" + nic + "/address")
+	if err != nil {
+		return fmt.Errorf("interface %v does not have a mac address", nic)
+	}
+	macAddress := strings.TrimSpace(string(data))
+	bridge := "br" + nic
+
+	state, err := loadBridgeState(nic)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// Save the current configuration of the nic before touching it.
+		addresses, err := saveIPAddress(nic)
+		if err != nil {
+			return err
+		}
+		routes, err := saveIPRoute(nic)
+		if err != nil {
+			return err
+		}
+		state = &bridgeState{Nic: nic, Bridge: bridge, Addresses: addresses, Routes: routes}
+		if err := saveBridgeState(state); err != nil {
+			return err
+		}
+	}
+
+	_, err = exec.RunCommand("ovs-vsctl", "--timeout=5", "--", "--may-exist", "add-br", bridge,
+		"--", "br-set-external-id", bridge, "bridge-id", bridge,
+		"--", "set", "bridge", bridge, "fail-mode=standalone", "other_config:hwaddr="+macAddress,
+		"--", "--may-exist", "add-port", bridge, nic)
+	if err != nil {
+		return fmt.Errorf("failed to create OVS bridge %v: %v", bridge, err)
+	}
+
+	// Move the ip address and ip route of the added port to the bridge.
+	if err := moveIPConfig(nic, bridge, state.Addresses, state.Routes); err != nil {
+		return fmt.Errorf("failed to transfer IP address or routes from %v to %v: %v", nic, bridge, err)
+	}
+	// Persist the move, so that the addresses are on the bridge after a reboot.
+	if err := persistBridge(state, macAddress); err != nil {
+		return fmt.Errorf("failed to persist the configuration of %v: %v", bridge, err)
+	}
+	fmt.Printf("successfully created OVS bridge %v\n", bridge)
+	return nil
+}
+
+// deleteBridge deletes the bridge created by createBridge and gives the nic
+// its original addresses and routes back.
+func deleteBridge(cmd *cobra.Command, args []string) error {
+	nic := cmd.Flags().Lookup("nic").Value.String()
+	if nic == "" {
+		return fmt.Errorf("failed get nic")
+	}
+	state, err := loadBridgeState(nic)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no saved configuration for %v, was it bridged by ovnctl?", nic)
+		}
+		return err
+	}
+
+	_, err = exec.RunCommand("ovs-vsctl", "--timeout=5", "--if-exists", "del-br", state.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to delete OVS bridge %v: %v", state.Bridge, err)
+	}
+	if err := moveIPConfig(nic, nic, state.Addresses, state.Routes); err != nil {
+		return fmt.Errorf("failed to restore IP address or routes of %v: %v", nic, err)
+	}
+	if err := restoreBridgeConfig(state); err != nil {
+		return fmt.Errorf("failed to restore the persisted configuration of %v: %v", nic, err)
+	}
+	if err := exec.RemoveFile(bridgeStatePath(nic)); err != nil {
+		return err
+	}
+	fmt.Printf("successfully deleted OVS bridge %v\n", state.Bridge)
+	return nil
+}
+
+// persistBridge writes the configuration of the bridge and its nic with the
+// host's network backend.  The original content of every file is recorded in
+// state before the file is changed for the first time.
+func persistBridge(state *bridgeState, macAddress string) error {
+	first := state.Backend == ""
+	if first {
+		state.Backend = networkBackend()
+	}
+	var files map[string]string
+	switch state.Backend {
+	case backendNetworkd:
+		if err := exec.MkdirAll(NETWORKD_CONF_DIR, 0755); err != nil {
+			return err
+		}
+		files = bridgeNetworkdFiles(state)
+	case backendDebian:
+		return persistBridgeDebian(state, macAddress, first)
+	case backendRedhat:
+		files = bridgeRedhatFiles(state, macAddress)
+	default:
+		return saveBridgeState(state)
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if savedFileIndex(state, path) >= 0 {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		state.Files = append(state.Files, savedFile{Path: path, Data: string(data), Existed: err == nil})
+	}
+	if err := saveBridgeState(state); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		// An empty file is not needed any more.
+		if files[path] == "" {
+			if err := exec.RemoveFile(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeFileIfChanged(path, []byte(files[path]), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func savedFileIndex(state *bridgeState, path string) int {
+	for i, file := range state.Files {
+		if file.Path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// restoreBridgeConfig undoes persistBridge.
+func restoreBridgeConfig(state *bridgeState) error {
+	if state.Backend == backendDebian {
+		return restoreBridgeDebian(state)
+	}
+	for _, file := range state.Files {
+		if !file.Existed {
+			if err := exec.RemoveFile(file.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeFileIfChanged(file.Path, []byte(file.Data), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeArgs returns a saved route without its protocol, which belongs to
+// whoever installed the original route.
+func routeArgs(route []string) []string {
+	var args []string
+	for i := 0; i < len(route); i++ {
+		if route[i] == "proto" {
+			i++
+			continue
+		}
+		args = append(args, route[i])
+	}
+	return args
+}
+
+// bridgeNetworkdFiles returns the systemd-networkd units of the bridge and
+// its nic.  They sort before netplan's 10-netplan-* units, so they win the
+// match for both interfaces.
+func bridgeNetworkdFiles(state *bridgeState) map[string]string {
+	nicUnit := "[Match]\nName=" + state.Nic + "\n\n[Network]\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n"
+	bridgeUnit := "[Match]\nName=" + state.Bridge + "\n\n[Network]\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n"
+	for _, address := range state.Addresses {
+		if len(address.Args) > 0 {
+			bridgeUnit += "Address=" + address.Args[0] + "\n"
+		}
+	}
+	for _, route := range state.Routes {
+		args := routeArgs(route)
+		if len(args) == 0 {
+			continue
+		}
+		bridgeUnit += "\n[Route]\n"
+		if args[0] != "default" {
+			bridgeUnit += "Destination=" + args[0] + "\n"
+		}
+		for i := 1; i+1 < len(args); i++ {
+			switch args[i] {
+			case "via":
+				bridgeUnit += "Gateway=" + args[i+1] + "\n"
+			case "metric":
+				bridgeUnit += "Metric=" + args[i+1] + "\n"
+			case "src":
+				bridgeUnit += "PreferredSource=" + args[i+1] + "\n"
+			case "scope":
+				bridgeUnit += "Scope=" + args[i+1] + "\n"
+			default:
+				continue
+			}
+			i++
+		}
+	}
+	return map[string]string{
+		NETWORKD_CONF_DIR + "/05-" + state.Nic + ".network":    nicUnit,
+		NETWORKD_CONF_DIR + "/05-" + state.Bridge + ".network": bridgeUnit,
+	}
+}
+
+// bridgeRedhatFiles returns the network-scripts of the bridge and its nic.
+// The routes of the nic move to the bridge.
+func bridgeRedhatFiles(state *bridgeState, macAddress string) map[string]string {
+	bridgeTemplate := "DEVICE=" + state.Bridge + "\nDEVICETYPE=ovs\nTYPE=OVSBridge\nONBOOT=yes\nBOOTPROTO=static\n"
+	var ipv4, ipv6 []string
+	for _, address := range state.Addresses {
+		if len(address.Args) == 0 {
+			continue
+		}
+		if address.Family == "inet6" {
+			ipv6 = append(ipv6, address.Args[0])
+		} else {
+			ipv4 = append(ipv4, address.Args[0])
+		}
+	}
+	for i, address := range ipv4 {
+		ip, ipNet, err := net.ParseCIDR(address)
+		if err != nil {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		bridgeTemplate += fmt.Sprintf("IPADDR%d=%s\nPREFIX%d=%d\n", i, ip.String(), i, ones)
+	}
+	if len(ipv6) > 0 {
+		bridgeTemplate += "IPV6INIT=yes\nIPV6ADDR=" + ipv6[0] + "\n"
+		if len(ipv6) > 1 {
+			bridgeTemplate += "IPV6ADDR_SECONDARIES=\"" + strings.Join(ipv6[1:], " ") + "\"\n"
+		}
+	}
+	bridgeTemplate += "OVS_EXTRA=\"set bridge " + state.Bridge + " fail-mode=standalone other_config:hwaddr=" + macAddress + "\"\n"
+
+	routeTemplate := ""
+	for _, route := range state.Routes {
+		routeTemplate += strings.Join(append(routeArgs(route), "dev", state.Bridge), " ") + "\n"
+	}
+	nicTemplate := "DEVICE=" + state.Nic + "\nDEVICETYPE=ovs\nTYPE=OVSPort\nOVS_BRIDGE=" + state.Bridge + "\nONBOOT=yes\nBOOTPROTO=none\n"
+
+	return map[string]string{
+		REDHAT_SCRIPTS_DIR + "/ifcfg-" + state.Bridge: bridgeTemplate,
+		REDHAT_SCRIPTS_DIR + "/route-" + state.Bridge: routeTemplate,
+		REDHAT_SCRIPTS_DIR + "/ifcfg-" + state.Nic:    nicTemplate,
+		REDHAT_SCRIPTS_DIR + "/route-" + state.Nic:    "",
+	}
+}
+
+// setIfaceStanza puts stanza in place of the "iface" stanza of the same
+// interface and makes sure the interface is listed in an allow stanza.
+func setIfaceStanza(stanzas []*interfacesStanza, allow string, stanza *interfacesStanza) []*interfacesStanza {
+	iface := stanza.args[0]
+	allowStanza := &interfacesStanza{kind: allow, args: []string{iface}}
+	if i := findStanza(stanzas, "iface", iface); i >= 0 {
+		stanza.options = append(stanza.options, trailingComments(stanzas[i].options)...)
+		stanzas[i] = stanza
+		if findStanza(stanzas, allow, iface) < 0 {
+			stanzas = append(stanzas[:i], append([]*interfacesStanza{allowStanza}, stanzas[i:]...)...)
+		}
+		return stanzas
+	}
+	if findStanza(stanzas, allow, iface) >= 0 {
+		return appendStanzas(stanzas, stanza)
+	}
+	return appendStanzas(stanzas, allowStanza, stanza)
+}
+
+// persistBridgeDebian moves the nic's stanza in /etc/network/interfaces into
+// the bridge.  The original stanza is saved the first time.
+func persistBridgeDebian(state *bridgeState, macAddress string, first bool) error {
+	data, err := ioutil.ReadFile(DEBIAN_INTERFACES_FILE)
+	if err != nil {
+		return fmt.Errorf("failed read file %v: %v", DEBIAN_INTERFACES_FILE, err)
+	}
+	stanzas := parseInterfaces(string(data))
+	if first {
+		if i := findStanza(stanzas, "iface", state.Nic); i >= 0 {
+			stanza := stanzas[i]
+			options := stanza.options[:len(stanza.options)-len(trailingComments(stanza.options))]
+			lines := append([]string{strings.Join(append([]string{stanza.kind}, stanza.args...), " ")}, options...)
+			state.Stanza = strings.Join(lines, "\n")
+		}
+	}
+	if err := saveBridgeState(state); err != nil {
+		return err
+	}
+
+	bridgeStanza := &interfacesStanza{
+		kind: "iface",
+		args: []string{state.Bridge, "inet", "manual"},
+		options: []string{
+			"\tovs_type OVSBridge",
+			"\tovs_ports " + state.Nic,
+			"\tovs_extra set bridge ${IFACE} fail-mode=standalone other_config:hwaddr=" + macAddress,
+		},
+	}
+	for _, address := range state.Addresses {
+		args := append([]string{"ip", "-f", address.Family, "addr", "replace"}, address.Args...)
+		bridgeStanza.options = append(bridgeStanza.options, "\tup "+strings.Join(append(args, "dev", "$IFACE"), " "))
+	}
+	for _, route := range state.Routes {
+		args := append([]string{"ip", "route", "replace"}, routeArgs(route)...)
+		bridgeStanza.options = append(bridgeStanza.options, "\tup "+strings.Join(append(args, "dev", "$IFACE"), " "))
+	}
+	nicStanza := &interfacesStanza{
+		kind:    "iface",
+		args:    []string{state.Nic, "inet", "manual"},
+		options: []string{"\tovs_bridge " + state.Bridge, "\tovs_type OVSPort"},
+	}
+
+	stanzas = setIfaceStanza(stanzas, "allow-ovs", bridgeStanza)
+	stanzas = setIfaceStanza(stanzas, "allow-"+state.Bridge, nicStanza)
+	return writeFileIfChanged(DEBIAN_INTERFACES_FILE, []byte(renderInterfaces(stanzas)), 0644)
+}
+
+// restoreBridgeDebian removes the bridge's stanzas from
+// /etc/network/interfaces and gives the nic its original stanza back.
+func restoreBridgeDebian(state *bridgeState) error {
+	data, err := ioutil.ReadFile(DEBIAN_INTERFACES_FILE)
+	if err != nil {
+		return fmt.Errorf("failed read file %v: %v", DEBIAN_INTERFACES_FILE, err)
+	}
+	stanzas := parseInterfaces(string(data))
+
+	var kept []*interfacesStanza
+	for _, stanza := range stanzas {
+		switch {
+		case stanza.kind == "iface" && len(stanza.args) > 0 && stanza.args[0] == state.Bridge:
+			continue
+		case stanza.kind == "allow-"+state.Bridge:
+			continue
+		case stanza.kind == "allow-ovs":
+			var args []string
+			for _, arg := range stanza.args {
+				if arg != state.Bridge {
+					args = append(args, arg)
+				}
+			}
+			if len(args) == 0 {
+				continue
+			}
+			stanza.args = args
+		case stanza.kind == "iface" && len(stanza.args) > 0 && stanza.args[0] == state.Nic:
+			if state.Stanza == "" {
+				continue
+			}
+			original := parseInterfaces(state.Stanza)[1:]
+			last := original[len(original)-1]
+			last.options = append(last.options, trailingComments(stanza.options)...)
+			kept = append(kept, original...)
+			continue
+		}
+		kept = append(kept, stanza)
+	}
+	// Drop the blank lines left behind by the removed stanzas.
+	last := kept[len(kept)-1]
+	for len(last.options) > 0 && strings.TrimSpace(last.options[len(last.options)-1]) == "" {
+		last.options = last.options[:len(last.options)-1]
+	}
+	return writeFileIfChanged(DEBIAN_INTERFACES_FILE, []byte(renderInterfaces(kept)), 0644)
+}
@@ -1,15 +1,13 @@
 package cmd
 
 import (
-	"bufio"
 	"fmt"
-	"io"
 	"net"
-	"os"
 	"strings"
 
 	"github.com/mozhuli/ovn-stackube/pkg/common"
 	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
 )
 
 var CNI_CONF_PATH = "/etc/cni/net.d"
@@ -23,6 +21,7 @@ var K8S_CLUSTER_LB_UDP string
 var K8S_NS_LB_TCP string
 var K8S_NS_LB_UDP string
 var OVN_MODE string
+var DEFAULT_JOIN_SUBNET = "100.64.1.0/24"
 
 func fetchOVNNB() (string, error) {
 	re, err := exec.RunCommand("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "external_ids:ovn-nb")
@@ -61,132 +60,81 @@ func getLocalSystemID() (string, error) {
 	return strings.Trim(re[0], "\""), nil
 }
 
-func configureManagementPortDebian(nodeName, clusterSubnet, routerIP, interfaceName, interfaceIP string) error {
-	bridgeExists := false
-	interfaceExists := false
-	bridgeTemplate := "allow-ovs br-int\niface br-int inet manual\n\tovs_type OVSBridge\n\tovs_ports " + interfaceName + "\n\tovs_extra set bridge br-int fail_mode=secure\n"
-	ip, interfaceIPNet, _ := net.ParseCIDR(interfaceIP)
-	_, clusterIPNet, _ := net.ParseCIDR(clusterSubnet)
-
-	interfaceTemplate := "allow-br-int " + interfaceName + "\niface " + interfaceName + " inet static\n\taddress " + ip.String() + "\n\tnetmask " +
-		interfaceIPNet.Mask.String() + "\n\tovs_type OVSIntPort\n\tovs_bridge br-int\n\tovs_extra set interface $IFACE external-ids:iface-id=k8s-" +
-		nodeName + "\n\tup route add -net " + clusterIPNet.IP.String() + " netmask " + clusterIPNet.Mask.String() + " gw " + routerIP + "\n\tdown route del -net " +
-		clusterIPNet.IP.String() + " netmask " + clusterIPNet.Mask.String() + " gw " + routerIP + "\n"
-
-	f, err := os.Open("/etc/network/interfaces")
-	if err == nil {
-		return fmt.Errorf("failed open file /etc/network/interfaces: %v", err)
-	}
-	defer f.Close()
-	rd := bufio.NewReader(f)
-	for {
-		line, err := rd.ReadString('\n')
-		if err != nil || io.EOF == err {
-			break
-		}
-		// Look for a line of the form "allow-ovs br-int"
-		if strings.Contains(line, "allow-ovs") && strings.Contains(line, "br-int") {
-			bridgeExists = true
-			break
-		}
-		// Look for a line of the form "allow-br-int $interfaceName"
-		if strings.Contains(line, "allow-br-int") && strings.Contains(line, interfaceName) {
-			interfaceExists = true
-			break
-		}
-	}
-	if !bridgeExists {
-		f, err := os.OpenFile("/etc/network/interfaces", os.O_WRONLY, 0644)
+// findLoadBalancer returns the uuid of the load balancer with the given
+// external_ids key set to "yes", or "" if there is none.
+func findLoadBalancer(key string) (string, error) {
+	re, err := exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=_uuid", "find", "load_balancer", "external_ids:"+key+"=yes")
+	if err != nil || re == nil {
 		if err != nil {
-			return err
-		} else {
-			n, _ := f.Seek(0, os.SEEK_END)
-			_, err = f.WriteAt([]byte(bridgeTemplate), n)
-			if err != nil {
-				return err
-			}
+			return "", err
 		}
-		defer f.Close()
+		return "", fmt.Errorf("failed to find load balancer %v", key)
 	}
-	if !interfaceExists {
-		f, err := os.OpenFile("/etc/network/interfaces", os.O_WRONLY, 0644)
+	return re[0], nil
+}
+
+// usedMacs returns the MAC addresses already assigned to logical router ports
+// and logical switch ports in the northbound database.
+func usedMacs() (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, query := range [][]string{
+		{"--data=bare", "--no-heading", "--columns=mac", "list", "logical_router_port"},
+		{"--data=bare", "--no-heading", "--columns=addresses", "list", "logical_switch_port"},
+	} {
+		re, err := exec.RunCommand("ovn-nbctl", query...)
 		if err != nil {
-			return err
-		} else {
-			n, _ := f.Seek(0, os.SEEK_END)
-			_, err = f.WriteAt([]byte(interfaceTemplate), n)
-			if err != nil {
-				return err
+			return nil, fmt.Errorf("failed to list mac addresses: %v", err)
+		}
+		for _, line := range re {
+			for _, field := range strings.Fields(strings.Trim(line, "\"")) {
+				if mac, err := net.ParseMAC(strings.Trim(field, "\"[]")); err == nil {
+					used[mac.String()] = true
+				}
 			}
 		}
-		defer f.Close()
 	}
-	return nil
+	return used, nil
 }
 
-func configureManagementPortRedhat(nodeName, clusterSubnet, routerIP, interfaceName, interfaceIP string) error {
-	//TODO
-	return nil
-}
-
-func configureManagementPort(nodeName, clusterSubnet, routerIP, interfaceName, interfaceIP string) error {
-	// First, try to configure management ports via platform specific tools.
-	// Identify whether the platform is Debian based.
-	_, err := os.Stat("/etc/network/interfaces")
-	if err == nil {
-		err := configureManagementPortDebian(nodeName, clusterSubnet, routerIP, interfaceName, interfaceIP)
-		if err != nil {
-			return err
+// allocateMac returns a MAC address that is not used in the northbound
+// database.  The MAC is derived from ip when ip is not nil and the derived
+// address is free, so that a port re-created with the same ip keeps its MAC.
+func allocateMac(ip net.IP) (string, error) {
+	used, err := usedMacs()
+	if err != nil {
+		return "", err
+	}
+	if ip != nil {
+		if mac := common.IPToMac(ip); !used[mac] {
+			return mac, nil
 		}
 	}
-	_, err = os.Stat("/etc/sysconfig/network-scripts/ifup-ovs")
-	if err == nil {
-		err := configureManagementPortRedhat(nodeName, clusterSubnet, routerIP, interfaceName, interfaceIP)
+	for i := 0; i < 16; i++ {
+		mac, err := common.GenerateMac()
 		if err != nil {
-			return err
+			return "", err
+		}
+		if !used[mac] {
+			return mac, nil
 		}
 	}
-	// Up the interface.
-	_, err = exec.RunCommand("ip", "link", "set", interfaceName, "up")
-	if err != nil {
-		return err
-	}
-	// The interface may already exist, in which case delete the routes and IP.
-	_, err = exec.RunCommand("ip", "addr", "flush", "dev", interfaceName)
-	if err != nil {
-		return err
-	}
-	// Assign IP address to the internal interface.
-	_, err = exec.RunCommand("ip", "addr", "add", interfaceIP, "dev", interfaceName)
-	if err != nil {
-		return err
-	}
-	// Flush the route for the entire subnet (in case it was added before)
-	_, err = exec.RunCommand("ip", "route", "flush", clusterSubnet)
-	if err != nil {
-		return err
-	}
-	// Create a route for the entire subnet.
-	_, err = exec.RunCommand("ip", "route", "add", clusterSubnet, "via", routerIP)
-	if err != nil {
-		return err
-	}
-	return nil
+	return "", fmt.Errorf("failed to allocate an unused mac address")
 }
 
 // Create a logical switch for the node and connect it to the distributed router.  This switch will start with one logical port (A OVS internal interface).
 // 1.  This logical port is via which a node can access all other nodes and the containers running inside them using the private IP addresses.
 // 2.  When this port is created on the master node, the K8s daemons become reachable from the containers without any NAT.
 // 3.  The nodes can health-check the pod IP addresses.
-func createManagementPort(nodeName, localSubnet, clusterSubnet string) error {
+// All the northbound changes are applied in a single transaction, so a failure leaves the topology untouched.
+func createManagementPort(nodeName, localSubnet, clusterSubnet, serviceSubnet string) error {
 	// Create a router port and provide it the first address in the 'local_subnet'.
 	ip, localSubnetNet, err := net.ParseCIDR(localSubnet)
 	if err != nil {
-		return fmt.Errorf("failed parse localsubnet v% : %v", localSubnetNet, err)
+		return fmt.Errorf("failed parse localsubnet %v : %v", localSubnet, err)
 	}
 	ip = common.NextIP(ip)
 	n, _ := localSubnetNet.Mask.Size()
-	routerIPMask := fmt.Sprintf("%s\\%d", ip.String(), n)
+	routerIPMask := fmt.Sprintf("%s/%d", ip.String(), n)
 	routerIP := ip.String()
 
 	re, err := exec.RunCommand("ovn-nbctl", "--if-exist", "get", "logical_router_port", "rtos-"+nodeName, "mac")
@@ -197,28 +145,20 @@ func createManagementPort(nodeName, localSubnet, clusterSubnet string) error {
 		return fmt.Errorf("failed get routerMac")
 	}
 	routerMac := strings.Trim(re[0], "\"")
-	if routerMac == "" {
-		routerMac = common.GenerateMac()
-		clusterRouter, err := getK8sClusterRouter()
-		if err != nil {
-			return err
-		}
-		_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "lrp-add", clusterRouter, "rtos-"+nodeName, routerMac, routerIPMask)
-		if err != nil {
-			return err
-		}
+	clusterRouter, err := getK8sClusterRouter()
+	if err != nil {
+		return err
 	}
-	// Create a logical switch and set its subnet.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "ls-add", nodeName, "--", "set", "logical_switch", nodeName, "other-config:subnet="+localSubnet, "external-ids:gateway_ip="+routerIPMask)
+	k8sClusterLbTcp, err := findLoadBalancer("k8s-cluster-lb-tcp")
 	if err != nil {
 		return err
 	}
-	// Connect the switch to the router.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lsp-add", nodeName, "stor-"+nodeName, "--", "set", "logical_switch_port", "stor-"+nodeName, "type=router", "options:router-port=rtos-"+nodeName, "addresses="+"\""+routerMac+"\"")
+	k8sClusterLbUdp, err := findLoadBalancer("k8s-cluster-lb-udp")
 	if err != nil {
 		return err
 	}
-	interfaceName := "k8s-" + (nodeName[:11])
+
+	interfaceName := managementPortInterface(nodeName)
 	// Create a OVS internal interface
 	_, err = exec.RunCommand("ovs-vsctl", "--", "--may-exist", "add-port", "br-int", interfaceName, "--", "set", "interface", interfaceName, "type=internal", "mtu_request=1400", "external-ids:iface-id=k8s-"+nodeName)
 	if err != nil {
@@ -232,77 +172,123 @@ func createManagementPort(nodeName, localSubnet, clusterSubnet string) error {
 		return fmt.Errorf("failed to get mac address of ovn-k8s-master")
 	}
 	macAddress := strings.Trim(re[0], "\"")
+
+	txn := &ovn.Transaction{}
+	if routerMac == "" {
+		routerMac, err = allocateMac(net.ParseIP(routerIP))
+		if err != nil {
+			return err
+		}
+		txn.Add("--may-exist", "lrp-add", clusterRouter, "rtos-"+nodeName, routerMac, routerIPMask)
+	}
+	// Create a logical switch and set its subnet.
+	txn.Add("--may-exist", "ls-add", nodeName)
+	txn.Add("set", "logical_switch", nodeName, "other-config:subnet="+localSubnet, "external-ids:gateway_ip="+routerIPMask)
+	// Connect the switch to the router.
+	txn.Add("--may-exist", "lsp-add", nodeName, "stor-"+nodeName)
+	txn.Add("set", "logical_switch_port", "stor-"+nodeName, "type=router", "options:router-port=rtos-"+nodeName, "addresses="+"\""+routerMac+"\"")
 	// Create the OVN logical port.
 	ip = common.NextIP(ip)
 	portIP := ip.String()
-	portIPMask := fmt.Sprintf("%s\\%d", portIP, n)
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lsp-add", nodeName, "k8s-"+nodeName, "--", "lsp-set-addresses", "k8s-"+nodeName, macAddress+" "+portIP)
-	if err != nil {
+	portIPMask := fmt.Sprintf("%s/%d", portIP, n)
+	txn.Add("--may-exist", "lsp-add", nodeName, "k8s-"+nodeName)
+	txn.Add("lsp-set-addresses", "k8s-"+nodeName, macAddress+" "+portIP)
+	// Add the load_balancer to the switch.
+	if k8sClusterLbTcp != "" {
+		txn.Add("add", "logical_switch", nodeName, "load_balancer", k8sClusterLbTcp)
+	}
+	if k8sClusterLbUdp != "" {
+		txn.Add("add", "logical_switch", nodeName, "load_balancer", k8sClusterLbUdp)
+	}
+	if err := txn.Commit(); err != nil {
 		return err
 	}
-	err = configureManagementPort(nodeName, clusterSubnet, routerIP, interfaceName, portIPMask)
+
+	joinSubnet, err := getJoinSubnet()
 	if err != nil {
 		return err
 	}
-	// Add the load_balancer to the switch.
-	re, err = exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=_uuid", "find", "load_balancer", "external_ids:k8s-cluster-lb-tcp=yes")
-	if err != nil || re == nil {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("failed to get k8sClusterLbTcp")
+	joinSubnetString := ""
+	if joinSubnet != nil {
+		joinSubnetString = joinSubnet.String()
 	}
-	k8sClusterLbTcp := re[0]
-	if k8sClusterLbTcp != "" {
-		_, err = exec.RunCommand("ovn-nbctl", "set", "logical_switch", nodeName, "load_balancer="+k8sClusterLbTcp)
-		if err != nil {
-			return err
-		}
+	return configureManagementPort(nodeName, clusterSubnet, serviceSubnet, joinSubnetString, routerIP, interfaceName, portIPMask)
+}
+
+// getJoinSubnet returns the subnet of the "join" switch recorded by the
+// master, or nil if the switch does not exist or has no subnet yet.
+func getJoinSubnet() (*net.IPNet, error) {
+	rows, err := ovn.ListRows("logical_switch", []string{"other_config"}, "name=join")
+	if err != nil {
+		return nil, fmt.Errorf("failed get join subnet: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	value := ovn.ParseMap(rows[0]["other_config"])["subnet"]
+	if value == "" {
+		return nil, nil
 	}
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse join subnet %v: %v", value, err)
+	}
+	return subnet, nil
+}
 
-	re, err = exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=_uuid", "find", "load_balancer", "external_ids:k8s-cluster-lb-udp=yes")
-	if err != nil || re == nil {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("failed to get k8sClusterLbUdp")
+// getJoinRouterIP returns the address of the distributed router on the
+// "join" switch.  Gateway routers use it as the next hop to the cluster.
+func getJoinRouterIP(joinSubnet *net.IPNet) net.IP {
+	return common.FirstIP(joinSubnet)
+}
+
+// getRouterPortIP returns the address of a logical router port, or nil if the
+// port does not exist.
+func getRouterPortIP(port string) (net.IP, error) {
+	re, err := exec.RunCommand("ovn-nbctl", "--if-exists", "get", "logical_router_port", port, "networks")
+	if err != nil {
+		return nil, err
 	}
-	k8sClusterLbUdp := re[0]
-	if k8sClusterLbUdp != "" {
-		_, err = exec.RunCommand("ovn-nbctl", "add", "logical_switch", nodeName, "load_balancer="+k8sClusterLbUdp)
-		if err != nil {
-			return err
+	for _, line := range re {
+		for _, network := range strings.Fields(line) {
+			ip, _, err := net.ParseCIDR(strings.Trim(network, "\"[],"))
+			if err == nil {
+				return ip, nil
+			}
 		}
 	}
-	return nil
+	return nil, nil
 }
 
-func generateGatewayIP() (string, error) {
-	// All the routers connected to "join" switch are in 100.64.1.0/24
-	// network and they have their external_ids:connect_to_join set.
-	re, err := exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=network", "find", "logical_router_port", "external_ids:connect_to_join=yes")
+// generateGatewayIP allocates an address on the "join" switch for a new
+// gateway router.  The addresses in use are those of the router ports with
+// external_ids:connect_to_join set, so deleting a gateway router releases its
+// address.
+func generateGatewayIP(joinSubnet *net.IPNet) (string, error) {
+	re, err := exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=networks", "find", "logical_router_port", "external_ids:connect_to_join=yes")
 	if err != nil {
 		return "", err
 	}
 
-	ipStart, ipStartNet, _ := net.ParseCIDR("100.64.1.0/24")
-	ipMax, _, _ := net.ParseCIDR("100.64.1.255/24")
-	n, _ := ipStartNet.Mask.Size()
-	for !ipStart.Equal(ipMax) {
-		ipStart = common.NextIP(ipStart)
-		used := 0
-		for _, v := range re {
-			if ipStart.String() == v {
-				used = 1
-				break
+	allocator, err := common.NewIPAllocator(joinSubnet)
+	if err != nil {
+		return "", err
+	}
+	// The first address always belongs to the distributed router.
+	allocator.AllocateIP(getJoinRouterIP(joinSubnet))
+	for _, line := range re {
+		for _, network := range strings.Fields(line) {
+			ip, _, err := net.ParseCIDR(strings.Trim(network, "\"[],"))
+			if err != nil {
+				continue
 			}
+			allocator.AllocateIP(ip)
 		}
-		if used == 1 {
-			continue
-		} else {
-			break
-		}
 	}
-	ipMask := fmt.Sprintf("%s\\%d", ipStart.String(), n)
-	return ipMask, nil
+	ip, err := allocator.Allocate()
+	if err != nil {
+		return "", err
+	}
+	n, _ := joinSubnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip.String(), n), nil
 }
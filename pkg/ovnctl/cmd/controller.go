@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/controller"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/keystone"
+	"github.com/mozhuli/ovn-stackube/pkg/neutron"
+	"github.com/spf13/cobra"
+)
+
+func InitController() *cobra.Command {
+
+	var ControllerCmd = &cobra.Command{
+		Use:   "controller [no options!]",
+		Short: "run the ovn controller that reconciles kubernetes objects into OVN",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := runController(cmd, args); err != nil {
+				return fmt.Errorf("failed run controller: %v", err)
+			}
+			return nil
+		},
+	}
+
+	ControllerCmd.Flags().StringP("k8s-api-server", "", "", "The address of the kubernetes API server. Defaults to external_ids:k8s-api-server of the local Open_vSwitch.")
+	ControllerCmd.Flags().DurationP("resync-interval", "", 10*time.Second, "How often the cluster is listed and reconciled.")
+	ControllerCmd.Flags().StringP("floating-ip-pool", "", "", "The subnet floating ips for pods are allocated from. It has to be within the external subnet of the gateways.")
+	ControllerCmd.Flags().StringP("tenant-subnet", "", "", "The subnet of tenants whose namespaces have no ovn.stackube/tenant-subnet annotation. Tenants have their own routers, so they may all use the same subnet.")
+	ControllerCmd.Flags().IntP("tenant-node-prefix", "", 24, "The prefix length of the per-node switch subnets of a tenant.")
+	ControllerCmd.Flags().StringP("cluster-ip-subnet", "", "", "The cluster subnet passed to master-init. Networks on the cluster router may not overlap it.")
+	ControllerCmd.Flags().StringP("physical-network", "", "physnet", "The name of the provider network in ovn-bridge-mappings that Networks with a VLAN are bridged to.")
+	ControllerCmd.Flags().StringP("keystone-url", "", "", "The URL of the Keystone compatible identity service that tenants of namespaces are resolved through, e.g. http://keystone:5000. Tenants are used as their IDs without it.")
+	ControllerCmd.Flags().StringP("keystone-username", "", "", "The user to authenticate to keystone-url as.")
+	ControllerCmd.Flags().StringP("keystone-password", "", "", "The password of keystone-username.")
+	ControllerCmd.Flags().StringP("keystone-project", "", "admin", "The project the keystone token is scoped to.")
+	ControllerCmd.Flags().StringP("keystone-domain", "", "Default", "The domain of keystone-username and keystone-project.")
+	ControllerCmd.Flags().StringP("keystone-stub", "", "", "A JSON file mapping tenant names to IDs that is used instead of keystone-url, for tests.")
+	ControllerCmd.Flags().DurationP("tenant-cache-ttl", "", 5*time.Minute, "How long resolved tenants are cached.")
+	ControllerCmd.Flags().StringP("neutron-url", "", "", "The URL of the Neutron compatible networking service whose networks pods can be attached to through the ovn.stackube/neutron-network annotation, e.g. http://neutron:9696. It is authenticated to through keystone-url.")
+	ControllerCmd.Flags().StringP("neutron-stub", "", "", "A JSON file with the networks and subnets of a stand-in for neutron-url, for tests.")
+	ControllerCmd.Flags().StringP("neutron-cluster", "", "kubernetes", "The name of this cluster, recorded on its neutron ports so that it leaves the ports of other clusters using the same neutron-url alone.")
+	ControllerCmd.Flags().StringP("metadata-mode", "", "", "Make the OpenStack metadata address reachable from pods, through the management port of their node (\"management-port\") or a localport on each tenant switch (\"localport\"). Run ovnctl metadata-proxy on the nodes with the same mode.")
+	ControllerCmd.Flags().BoolP("dhcp", "", false, "Serve the addresses of the pods on the node switches through OVN's native DHCP, and the service names through its DNS, for pods that configure themselves such as hypervisor based ones.")
+	ControllerCmd.Flags().IntP("dhcp-lease-time", "", 3600, "The DHCP lease time in seconds.")
+	ControllerCmd.Flags().IntP("dhcp-mtu", "", 1400, "The MTU advertised through DHCP, none when 0.")
+	ControllerCmd.Flags().StringP("dns-servers", "", "", "A comma separated list of the DNS servers advertised through DHCP.")
+	ControllerCmd.Flags().StringP("cluster-domain", "", "cluster.local", "The domain of the service DNS records.")
+	ControllerCmd.Flags().BoolP("once", "", false, "Reconcile once and exit.")
+
+	return ControllerCmd
+}
+
+// getK8sAPIServer returns the API server recorded in the local Open_vSwitch.
+func getK8sAPIServer() (string, error) {
+	re, err := exec.RunCommand("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "external_ids:k8s-api-server")
+	if err != nil || re == nil {
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("failed get k8sApiServer")
+	}
+	return strings.Trim(re[0], "\""), nil
+}
+
+func runController(cmd *cobra.Command, args []string) error {
+	_, err := fetchOVNNB()
+	if err != nil {
+		return err
+	}
+
+	server := cmd.Flags().Lookup("k8s-api-server").Value.String()
+	if server == "" {
+		server, err = getK8sAPIServer()
+		if err != nil {
+			return err
+		}
+	}
+	if server == "" {
+		return fmt.Errorf("argument --k8s-api-server should be non-null")
+	}
+	if !strings.HasPrefix(server, "http") {
+		server = "http://" + server
+	}
+	interval, err := cmd.Flags().GetDuration("resync-interval")
+	if err != nil {
+		return err
+	}
+	once, err := cmd.Flags().GetBool("once")
+	if err != nil {
+		return err
+	}
+
+	var floatingIPPool *net.IPNet
+	if pool := cmd.Flags().Lookup("floating-ip-pool").Value.String(); pool != "" {
+		_, floatingIPPool, err = net.ParseCIDR(pool)
+		if err != nil {
+			return fmt.Errorf("failed parse floating-ip-pool %v: %v", pool, err)
+		}
+		if _, err := common.NewIPAllocator(floatingIPPool); err != nil {
+			return fmt.Errorf("invalid floating-ip-pool: %v", err)
+		}
+	}
+
+	var tenantSubnet *net.IPNet
+	if subnet := cmd.Flags().Lookup("tenant-subnet").Value.String(); subnet != "" {
+		_, tenantSubnet, err = net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("failed parse tenant-subnet %v: %v", subnet, err)
+		}
+	}
+	tenantNodePrefix, err := cmd.Flags().GetInt("tenant-node-prefix")
+	if err != nil {
+		return err
+	}
+	var clusterSubnet *net.IPNet
+	if subnet := cmd.Flags().Lookup("cluster-ip-subnet").Value.String(); subnet != "" {
+		_, clusterSubnet, err = net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("failed parse cluster-ip-subnet %v: %v", subnet, err)
+		}
+	}
+
+	c := controller.New(server, interval)
+	var resolver keystone.Resolver
+	var keystoneClient *keystone.Client
+	if keystoneURL := cmd.Flags().Lookup("keystone-url").Value.String(); keystoneURL != "" {
+		keystoneClient = &keystone.Client{
+			URL:      keystoneURL,
+			Username: cmd.Flags().Lookup("keystone-username").Value.String(),
+			Password: cmd.Flags().Lookup("keystone-password").Value.String(),
+			Project:  cmd.Flags().Lookup("keystone-project").Value.String(),
+			Domain:   cmd.Flags().Lookup("keystone-domain").Value.String(),
+		}
+	}
+	if stub := cmd.Flags().Lookup("keystone-stub").Value.String(); stub != "" {
+		resolver, err = keystone.NewStub(stub)
+		if err != nil {
+			return fmt.Errorf("failed load keystone-stub %v: %v", stub, err)
+		}
+	} else if keystoneClient != nil {
+		resolver = keystoneClient
+	}
+	if resolver != nil {
+		ttl, err := cmd.Flags().GetDuration("tenant-cache-ttl")
+		if err != nil {
+			return err
+		}
+		c.SetTenantResolver(keystone.NewCache(resolver, ttl))
+	}
+	c.Register(&controller.TenantReconciler{Server: server, Subnet: tenantSubnet, NodePrefix: tenantNodePrefix})
+	c.Register(&controller.NetworkReconciler{Server: server, PhysicalNetwork: cmd.Flags().Lookup("physical-network").Value.String(), ClusterSubnet: clusterSubnet})
+	var neutronAPI neutron.API
+	if stub := cmd.Flags().Lookup("neutron-stub").Value.String(); stub != "" {
+		neutronAPI, err = neutron.NewStub(stub)
+		if err != nil {
+			return fmt.Errorf("failed load neutron-stub %v: %v", stub, err)
+		}
+	} else if neutronURL := cmd.Flags().Lookup("neutron-url").Value.String(); neutronURL != "" {
+		if keystoneClient == nil {
+			return fmt.Errorf("argument --neutron-url needs --keystone-url")
+		}
+		neutronAPI = &neutron.Client{URL: neutronURL, Tokens: keystoneClient}
+	}
+	if neutronAPI != nil {
+		c.Register(&controller.NeutronReconciler{
+			Server:  server,
+			Neutron: neutronAPI,
+			Cluster: cmd.Flags().Lookup("neutron-cluster").Value.String(),
+		})
+	}
+	c.Register(&controller.AttachmentReconciler{Server: server})
+	metadataMode := cmd.Flags().Lookup("metadata-mode").Value.String()
+	if metadataMode != "" && metadataMode != common.MetadataModeManagementPort && metadataMode != common.MetadataModeLocalport {
+		return fmt.Errorf("unknown metadata-mode %q", metadataMode)
+	}
+	c.Register(&controller.MetadataReconciler{Mode: metadataMode})
+	dhcp, err := cmd.Flags().GetBool("dhcp")
+	if err != nil {
+		return err
+	}
+	leaseTime, err := cmd.Flags().GetInt("dhcp-lease-time")
+	if err != nil {
+		return err
+	}
+	dhcpMTU, err := cmd.Flags().GetInt("dhcp-mtu")
+	if err != nil {
+		return err
+	}
+	var dnsServers []string
+	for _, server := range strings.Split(cmd.Flags().Lookup("dns-servers").Value.String(), ",") {
+		if server = strings.TrimSpace(server); server == "" {
+			continue
+		}
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("failed parse dns-servers: invalid address %q", server)
+		}
+		dnsServers = append(dnsServers, server)
+	}
+	c.Register(&controller.DHCPReconciler{
+		Enabled:    dhcp,
+		LeaseTime:  leaseTime,
+		MTU:        dhcpMTU,
+		DNSServers: dnsServers,
+		Domain:     cmd.Flags().Lookup("cluster-domain").Value.String(),
+	})
+	c.Register(&controller.EgressIPReconciler{Server: server})
+	c.Register(&controller.EgressGatewayReconciler{Server: server})
+	c.Register(&controller.FloatingIPReconciler{Server: server, Pool: floatingIPPool})
+
+	if once {
+		return c.RunOnce()
+	}
+	c.Run(make(chan struct{}))
+	return nil
+}
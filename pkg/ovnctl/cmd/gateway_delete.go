@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+	"github.com/spf13/cobra"
+)
+
+func DeleteGateway() *cobra.Command {
+
+	var DeleteGatewayCmd = &cobra.Command{
+		Use:   "delete-gateway [no options!]",
+		Short: "delete ovn gateway",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := deleteGateway(cmd, args); err != nil {
+				return fmt.Errorf("failed delete gateway: %v", err)
+			}
+			return nil
+		},
+	}
+
+	DeleteGatewayCmd.Flags().StringP("node-name", "", "", "The name of the node whose gateway is deleted.")
+
+	return DeleteGatewayCmd
+}
+
+// deleteGateway removes the gateway router of a node together with its
+// external switch, load balancers, no-SNAT address set and the routes
+// pointing to it.  The default routes through the gateway, the cluster's and
+// those of the tenant routers, move to the next remaining gateway router.
+// Removing the router port on the "join" switch releases the gateway's join
+// address.
+func deleteGateway(cmd *cobra.Command, args []string) error {
+	nodeName := cmd.Flags().Lookup("node-name").Value.String()
+	if nodeName == "" {
+		return fmt.Errorf("failed get node-name")
+	}
+
+	_, err := fetchOVNNB()
+	if err != nil {
+		return err
+	}
+
+	k8sClusterRouter, err := getK8sClusterRouter()
+	if err != nil {
+		return err
+	}
+
+	gatewayRouter := "GR_" + nodeName
+	routerIP, err := getRouterPortIP("rtoj-" + gatewayRouter)
+	if err != nil {
+		return err
+	}
+
+	// The cluster's default route is handed over to a remaining gateway
+	// router instead of being removed with the others.
+	successor, successorIP, err := nextGateway(gatewayRouter)
+	if err != nil {
+		return err
+	}
+
+	txn := &ovn.Transaction{}
+	// Remove the routes that use this gateway, from the distributed router
+	// and from the tenant routers, whose default routes point to a gateway
+	// as well.
+	if routerIP != nil {
+		routes, err := ovn.ListRows("logical_router_static_route", []string{"_uuid", "ip_prefix"}, "nexthop=\""+routerIP.String()+"\"")
+		if err != nil {
+			return err
+		}
+		owners, err := routeOwners()
+		if err != nil {
+			return err
+		}
+		handedOver := false
+		for _, route := range routes {
+			if route["ip_prefix"] == "0.0.0.0/0" && successorIP != nil {
+				txn.Add("set", "logical_router_static_route", route["_uuid"], "nexthop=\""+successorIP.String()+"\"")
+				if owners[route["_uuid"]] == k8sClusterRouter && !handedOver {
+					txn.Add("set", "logical_router", successor, "external_ids:first_gateway=yes")
+					handedOver = true
+				}
+				continue
+			}
+			router, ok := owners[route["_uuid"]]
+			if !ok {
+				router = k8sClusterRouter
+			}
+			txn.Add("remove", "logical_router", router, "static_routes", route["_uuid"])
+		}
+	}
+
+	for _, key := range []string{"TCP_lb_gateway_router", "UDP_lb_gateway_router"} {
+		re, err := exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=_uuid", "find", "load_balancer", "external_ids:"+key+"="+gatewayRouter)
+		if err != nil {
+			return err
+		}
+		for _, lb := range re {
+			lb = strings.TrimSpace(lb)
+			if lb == "" {
+				continue
+			}
+			txn.Add("destroy", "load_balancer", lb)
+		}
+	}
+
+	txn.Add("--if-exists", "destroy", "address_set", noSNATAddressSet(gatewayRouter))
+	txn.Add("--if-exists", "lsp-del", "jtor-"+gatewayRouter)
+	txn.Add("--if-exists", "lr-del", gatewayRouter)
+	txn.Add("--if-exists", "ls-del", "ext_"+nodeName)
+	return txn.Commit()
+}
+
+// nextGateway returns the gateway router, other than gatewayRouter, that
+// takes over the cluster's default route, together with its address on the
+// "join" switch.  It returns an empty name if no other gateway is connected.
+func nextGateway(gatewayRouter string) (string, net.IP, error) {
+	rows, err := ovn.ListRows("logical_router", []string{"name"}, "options:chassis!=null")
+	if err != nil {
+		return "", nil, err
+	}
+	var names []string
+	for _, row := range rows {
+		if row["name"] != gatewayRouter {
+			names = append(names, row["name"])
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ip, err := getRouterPortIP("rtoj-" + name)
+		if err != nil {
+			return "", nil, err
+		}
+		if ip != nil {
+			return name, ip, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// routeOwners returns the names of the routers by the uuids of their static
+// routes.
+func routeOwners() (map[string]string, error) {
+	routers, err := ovn.ListRows("logical_router", []string{"name", "static_routes"})
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, router := range routers {
+		for _, uuid := range ovn.ParseSet(router["static_routes"]) {
+			owners[uuid] = router["name"]
+		}
+	}
+	return owners, nil
+}
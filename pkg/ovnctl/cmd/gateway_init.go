@@ -7,9 +7,10 @@ import (
 	"net"
 	"strings"
 
-	"github.com/mozhuli/ovn-stackube/pkg/common"
 	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
 	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
 )
 
 func InitGateway() *cobra.Command {
@@ -37,11 +38,17 @@ func InitGateway() *cobra.Command {
 
 	GatewayCmd.Flags().StringP("cluster-ip-subnet", "", "", "The cluster wide larger subnet of private ip addresses.")
 	GatewayCmd.Flags().StringP("physical-interface", "", "", "The physical interface via which external connectivity is provided.")
-	GatewayCmd.Flags().StringP("bridge-interface", "", "", "The OVS bridge interface via which external connectivity is provided.")
+	GatewayCmd.Flags().StringP("bridge-interface", "", "", "The OVS bridge interface via which external connectivity is provided. It can be created with 'ovnctl bridge create'.")
+	GatewayCmd.Flags().StringP("provider-bridge", "", "", "The existing OVS provider bridge via which external connectivity is provided. The external switch is attached to it through a localnet port and the host's ip configuration is left untouched.")
+	GatewayCmd.Flags().StringP("physical-network", "", "physnet", "The name of the physical network mapped to provider-bridge in ovn-bridge-mappings.")
+	GatewayCmd.Flags().IntP("vlan-id", "", 0, "The VLAN tag of the provider network, 0 for an untagged network. Only used with provider-bridge.")
 	GatewayCmd.Flags().StringP("physical-ip", "", "", "The ip address of the physical interface or bridge interface via which external connectivity is provided. This should be of the form IP/MASK.")
 	GatewayCmd.Flags().StringP("node-name", "", "", "A unique node name.")
 	GatewayCmd.Flags().StringP("default-gw", "", "", "The next hop IP address for your physical interface.")
-	GatewayCmd.Flags().StringP("rampout-ip-subnets", "", "", "Uses this gateway to rampout traffic originating from the specified comma separated ip subnets.  Used to distribute outgoing traffic via multiple gateways.")
+	GatewayCmd.Flags().BoolP("auto-detect", "", false, "Detect physical-ip and default-gw from the interface given as physical-interface or bridge-interface, or else from the OVS bridge carrying the host's default route, which then becomes bridge-interface. With provider-bridge only default-gw is detected, from a default route via the bridge; physical-ip has to be given, as the host keeps its own addresses. Flags given explicitly take precedence.")
+	GatewayCmd.Flags().StringP("snat-ips", "", "", "Comma separated additional ip addresses of the external subnet to SNAT the cluster traffic to. The cluster subnet is spread over these and physical-ip.")
+	GatewayCmd.Flags().StringP("no-snat-destinations", "", "", "Comma separated subnets, e.g. corporate ranges, that see the real pod ips instead of SNATed ones.")
+	GatewayCmd.Flags().StringP("rampout-ip-subnets", "", "", "Uses this gateway to rampout traffic originating from the specified comma separated ip subnets.  Used to distribute outgoing traffic via multiple gateways. To pin the pods of a namespace to gateways, annotate the namespace with ovn.stackube/egress-gateways instead.")
 
 	return GatewayCmd
 }
@@ -57,35 +64,90 @@ func initGateway(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed get node-name")
 	}
 
-	physicalIp := cmd.Flags().Lookup("physical-ip").Value.String()
+	flags := &gatewayFlags{
+		physicalIP:        cmd.Flags().Lookup("physical-ip").Value.String(),
+		defaultGW:         cmd.Flags().Lookup("default-gw").Value.String(),
+		physicalInterface: cmd.Flags().Lookup("physical-interface").Value.String(),
+		bridgeInterface:   cmd.Flags().Lookup("bridge-interface").Value.String(),
+		providerBridge:    cmd.Flags().Lookup("provider-bridge").Value.String(),
+	}
+	detect, err := cmd.Flags().GetBool("auto-detect")
+	if err != nil {
+		return err
+	}
+	if detect {
+		if err := autoDetect(flags, detectGatewayConfig); err != nil {
+			return err
+		}
+	}
+	physicalIp := flags.physicalIP
+	physicalInterface := flags.physicalInterface
+	bridgeInterface := flags.bridgeInterface
+	providerBridge := flags.providerBridge
+	defaultGW := flags.defaultGW
+
 	if physicalIp == "" {
 		return fmt.Errorf("failed get physical-ip")
 	}
 
-	physicalInterface := cmd.Flags().Lookup("physical-interface").Value.String()
-	bridgeInterface := cmd.Flags().Lookup("bridge-interface").Value.String()
-	defaultGW := cmd.Flags().Lookup("default-gw").Value.String()
-	rampoutIPSubnet := cmd.Flags().Lookup("rampout-ip-subnet").Value.String()
-
-	// We want either of args.physical_interface or args.bridge_interface
-	// provided. But not both. (XOR)
-	if (len(physicalInterface) == 0 && len(bridgeInterface) == 0) || (len(physicalInterface) != 0 && len(bridgeInterface) != 0) {
-		return fmt.Errorf("One of physical-interface or bridge-interface has to be specified")
+	physicalNetwork := cmd.Flags().Lookup("physical-network").Value.String()
+	vlanID, err := cmd.Flags().GetInt("vlan-id")
+	if err != nil {
+		return err
+	}
+	rampoutIPSubnet := cmd.Flags().Lookup("rampout-ip-subnets").Value.String()
+
+	// We want exactly one of args.physical_interface, args.bridge_interface
+	// or args.provider_bridge provided.
+	modes := 0
+	for _, v := range []string{physicalInterface, bridgeInterface, providerBridge} {
+		if v != "" {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return fmt.Errorf("One of physical-interface, bridge-interface or provider-bridge has to be specified")
+	}
+	if vlanID < 0 || vlanID > 4094 {
+		return fmt.Errorf("invalid vlan-id %d", vlanID)
+	}
+	if vlanID != 0 && providerBridge == "" {
+		return fmt.Errorf("vlan-id can only be used with provider-bridge")
 	}
 
-	ip, physicalIpNet, _ := net.ParseCIDR(physicalIp)
+	ip, physicalIpNet, err := net.ParseCIDR(physicalIp)
+	if err != nil {
+		return fmt.Errorf("failed parse physical-ip %v: %v", physicalIp, err)
+	}
 	n, _ := physicalIpNet.Mask.Size()
-	physicalIpMask := fmt.Sprintf("%s\\%d", ip.String(), n)
+	physicalIpMask := fmt.Sprintf("%s/%d", ip.String(), n)
 	physicalIp = ip.String()
 
+	snatIPs, err := parseSNATIPs(physicalIp, physicalIpNet, cmd.Flags().Lookup("snat-ips").Value.String())
+	if err != nil {
+		return err
+	}
+	snat, err := snatRules(clusterIpSubnet, snatIPs)
+	if err != nil {
+		return err
+	}
+	noSNAT, err := parseNoSNATDestinations(cmd.Flags().Lookup("no-snat-destinations").Value.String())
+	if err != nil {
+		return err
+	}
+
 	if defaultGW != "" {
 		defaultgwByte := net.ParseIP(defaultGW)
 		defaultGW = defaultgwByte.String()
 	}
-	_, err := fetchOVNNB()
+	_, err = fetchOVNNB()
 	if err != nil {
 		return err
 	}
+	// Fail before the host is touched.
+	if err := checkNoSNATSupport(noSNAT); err != nil {
+		return err
+	}
 
 	k8sClusterRouter, err := getK8sClusterRouter()
 	if err != nil {
@@ -109,14 +171,22 @@ func initGateway(cmd *cobra.Command, args []string) error {
 	if physicalGW == "" {
 		firstGW = "yes"
 	}
-	// Create a gateway router.
 	gatewayRouter := "GR_" + nodeName
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lr-add", gatewayRouter, "--", "set", "logical_router", gatewayRouter, "options:chassis="+systemID, "external_ids:physical_ip="+physicalIp, "external_ids:first_gateway="+firstGW)
+	// A re-run on the first gateway must not lose its role.
+	re, err = exec.RunCommand("ovn-nbctl", "--if-exists", "get", "logical_router", gatewayRouter, "external_ids:first_gateway")
+	if err == nil && re != nil && strings.Trim(re[0], "\"") == "yes" {
+		firstGW = "yes"
+	}
+
+	joinSubnet, err := getJoinSubnet()
 	if err != nil {
 		return err
 	}
+	if joinSubnet == nil {
+		// Masters initialized before the join subnet was recorded use the default.
+		_, joinSubnet, _ = net.ParseCIDR(DEFAULT_JOIN_SUBNET)
+	}
 
-	// Connect gateway router to switch "join".
 	re, err = exec.RunCommand("ovn-nbctl", "--if-exist", "get", "logical_router_port", "rtoj-"+gatewayRouter, "mac")
 	if err != nil || re == nil {
 		if err != nil {
@@ -125,44 +195,7 @@ func initGateway(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to get routerMac")
 	}
 	routerMac := strings.Trim(re[0], "\"")
-	routerIP := ""
-	if routerMac == "" {
-		routerMac = common.GenerateMac()
-		routerIP, err := generateGatewayIP()
-		if err != nil {
-			return err
-		}
 
-		_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lrp-add", gatewayRouter, "rtoj-"+gatewayRouter, routerMac, routerIP, "--", "set", "logical_router_port", "rtoj-"+gatewayRouter, "external_ids:connect_to_join=yes")
-		if err != nil {
-			return err
-		}
-	}
-
-	// Connect the switch "join" to the router.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lsp-add", "join", "jtor-"+gatewayRouter, "--", "set", "logical_switch_port", "jtor-"+gatewayRouter, "type=router", "options:router-port=rtoj-"+gatewayRouter, "addresses="+"\""+routerMac+"\"")
-	if err != nil {
-		return err
-	}
-
-	// Add a static route in GR with distributed router as the nexthop.
-	_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "lr-route-add", gatewayRouter, clusterIpSubnet, "100.64.1.1")
-
-	// Add a static route in GR with physical gateway as the default next hop.
-	if defaultGW != "" {
-		_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "lr-route-add", gatewayRouter, "0.0.0.0/0", defaultGW)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Add a default route in distributed router with first GR as the nexthop.
-	_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "lr-route-add", k8sClusterRouter, "0.0.0.0/0", "100.64.1.2")
-	if err != nil {
-		return err
-	}
-
-	// Create 2 load-balancers for north-south traffic for each gateway router.  One handles UDP and another handles TCP.
 	re, err = exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=_uuid", "find", "load_balancer", "external_ids:TCP_lb_gateway_router="+gatewayRouter)
 	if err != nil || re == nil {
 		if err != nil {
@@ -170,13 +203,7 @@ func initGateway(cmd *cobra.Command, args []string) error {
 		}
 		return fmt.Errorf("failed to get k8sNSLbTcp")
 	}
-	k8sNSLbTcp := strings.Trim(re[0], "'")
-	if k8sNSLbTcp != "" {
-		_, err = exec.RunCommand("ovn-nbctl", "--", "create", "load_balancer", "external_ids:TCP_lb_gateway_router="+gatewayRouter)
-		if err != nil {
-			return err
-		}
-	}
+	k8sNSLbTcp := re[0]
 
 	re, err = exec.RunCommand("ovn-nbctl", "--data=bare", "--no-heading", "--columns=_uuid", "find", "load_balancer", "external_ids:UDP_lb_gateway_router="+gatewayRouter)
 	if err != nil || re == nil {
@@ -185,29 +212,8 @@ func initGateway(cmd *cobra.Command, args []string) error {
 		}
 		return fmt.Errorf("failed to get k8sNSLbUdp")
 	}
-	k8sNSLbUdp := strings.Trim(re[0], "\"")
-	if k8sNSLbUdp != "" {
-		_, err = exec.RunCommand("ovn-nbctl", "--", "create", "load_balancer", "external_ids:UDP_lb_gateway_router="+gatewayRouter, "protocol=udp")
-		if err != nil {
-			return err
-		}
-	}
-	//Add north-south load-balancers to the gateway router.
-	_, err = exec.RunCommand("ovn-nbctl", "set", "logical_router", gatewayRouter, "load_balancer="+k8sNSLbTcp)
-	if err != nil {
-		return err
-	}
-	_, err = exec.RunCommand("ovn-nbctl", "add", "logical_router", gatewayRouter, "load_balancer="+k8sNSLbUdp)
-	if err != nil {
-		return err
-	}
+	k8sNSLbUdp := re[0]
 
-	// Create the external switch for the physical interface to connect to.
-	externalSwitch := "ext_" + nodeName
-	_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "ls-add", externalSwitch)
-	if err != nil {
-		return err
-	}
 	ifaceID := ""
 	macAddress := ""
 	if physicalInterface != "" {
@@ -226,12 +232,31 @@ func initGateway(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("failed to get macAddress")
 		}
 		macAddress = strings.Trim(re[0], "\"")
-
-		// Flush the IP address of the physical interface.
-		_, err = exec.RunCommand("ip", "addr", "flush", "dev", physicalInterface)
+	} else if providerBridge != "" {
+		// The external switch reaches the provider network through a
+		// localnet port, which ovn-controller connects to the bridge
+		// mapped to the physical network.
+		err = setBridgeMapping(physicalNetwork, providerBridge)
 		if err != nil {
 			return err
 		}
+		ifaceID = "localnet_" + nodeName
+		// The router port does not own a host interface, so it gets a MAC of
+		// its own.  Keep the one of an existing port.
+		re, err := exec.RunCommand("ovn-nbctl", "--if-exist", "get", "logical_router_port", "rtoe-"+gatewayRouter, "mac")
+		if err != nil || re == nil {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("failed to get macAddress")
+		}
+		macAddress = strings.Trim(re[0], "\"")
+		if macAddress == "" {
+			macAddress, err = allocateMac(ip)
+			if err != nil {
+				return err
+			}
+		}
 	} else {
 		// A OVS bridge's mac address can change when ports are added to it.
 		// We cannot let that happen, so make the bridge mac address permanent.
@@ -266,59 +291,275 @@ func initGateway(cmd *cobra.Command, args []string) error {
 			return err
 		}
 	}
+
+	// All the northbound changes below are applied in one transaction, so
+	// that a failure does not leave a half-built gateway behind.
+	txn := &ovn.Transaction{}
+
+	// Create a gateway router.
+	txn.Add("--may-exist", "lr-add", gatewayRouter)
+	txn.Add("set", "logical_router", gatewayRouter, "options:chassis="+systemID, "external_ids:physical_ip="+physicalIp, "external_ids:first_gateway="+firstGW)
+
+	// Connect gateway router to switch "join".
+	var routerIP net.IP
+	if routerMac == "" {
+		routerIPMask, err := generateGatewayIP(joinSubnet)
+		if err != nil {
+			return err
+		}
+		routerIP, _, err = net.ParseCIDR(routerIPMask)
+		if err != nil {
+			return err
+		}
+		routerMac, err = allocateMac(routerIP)
+		if err != nil {
+			return err
+		}
+		txn.Add("--may-exist", "lrp-add", gatewayRouter, "rtoj-"+gatewayRouter, routerMac, routerIPMask)
+		txn.Add("set", "logical_router_port", "rtoj-"+gatewayRouter, "external_ids:connect_to_join=yes")
+	} else {
+		routerIP, err = getRouterPortIP("rtoj-" + gatewayRouter)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Connect the switch "join" to the router.
+	txn.Add("--may-exist", "lsp-add", "join", "jtor-"+gatewayRouter)
+	txn.Add("set", "logical_switch_port", "jtor-"+gatewayRouter, "type=router", "options:router-port=rtoj-"+gatewayRouter, "addresses="+"\""+routerMac+"\"")
+
+	// Add a static route in GR with distributed router as the nexthop.
+	txn.Add("--may-exist", "lr-route-add", gatewayRouter, clusterIpSubnet, getJoinRouterIP(joinSubnet).String())
+
+	// Add a static route in GR with physical gateway as the default next hop.
+	if defaultGW != "" {
+		txn.Add("--may-exist", "lr-route-add", gatewayRouter, "0.0.0.0/0", defaultGW)
+	}
+
+	// Add a default route in distributed router with first GR as the nexthop.
+	if firstGW == "yes" && routerIP != nil {
+		txn.Add("--may-exist", "lr-route-add", k8sClusterRouter, "0.0.0.0/0", routerIP.String())
+	}
+
+	// Create 2 load-balancers for north-south traffic for each gateway router.  One handles UDP and another handles TCP.
+	if k8sNSLbTcp == "" {
+		txn.Add("--id=@tcp_lb", "create", "load_balancer", "external_ids:TCP_lb_gateway_router="+gatewayRouter)
+		k8sNSLbTcp = "@tcp_lb"
+	}
+	if k8sNSLbUdp == "" {
+		txn.Add("--id=@udp_lb", "create", "load_balancer", "external_ids:UDP_lb_gateway_router="+gatewayRouter, "protocol=udp")
+		k8sNSLbUdp = "@udp_lb"
+	}
+	//Add north-south load-balancers to the gateway router.
+	txn.Add("add", "logical_router", gatewayRouter, "load_balancer", k8sNSLbTcp)
+	txn.Add("add", "logical_router", gatewayRouter, "load_balancer", k8sNSLbUdp)
+
+	// Create the external switch for the physical interface to connect to.
+	externalSwitch := "ext_" + nodeName
+	txn.Add("--may-exist", "ls-add", externalSwitch)
+
 	// Add external interface as a logical port to external_switch. This is
 	// a learning switch port with "unknown" address.  The external world
 	// is accessed via this port.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lsp-add", externalSwitch, ifaceID, "--", "lsp-set-addresses", ifaceID, "unknown")
-	if err != nil {
-		return err
+	txn.Add("--may-exist", "lsp-add", externalSwitch, ifaceID)
+	txn.Add("lsp-set-addresses", ifaceID, "unknown")
+	if providerBridge != "" {
+		txn.Add("lsp-set-type", ifaceID, "localnet")
+		txn.Add("lsp-set-options", ifaceID, "network_name="+physicalNetwork)
+		if vlanID != 0 {
+			txn.Add("set", "logical_switch_port", ifaceID, fmt.Sprintf("tag=%d", vlanID))
+		} else {
+			txn.Add("clear", "logical_switch_port", ifaceID, "tag")
+		}
 	}
 
 	// Connect GR to external_switch with mac address of external interface
 	// and that IP address.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lrp-add", gatewayRouter, "rtoe-"+gatewayRouter, macAddress, physicalIpMask, "--", "set", "logical_router_port", "rtoe-"+gatewayRouter, "external-ids:gateway-physical-ip=yes")
-	if err != nil {
-		return err
-	}
+	txn.Add("--may-exist", "lrp-add", gatewayRouter, "rtoe-"+gatewayRouter, macAddress, physicalIpMask)
+	txn.Add("set", "logical_router_port", "rtoe-"+gatewayRouter, "external-ids:gateway-physical-ip=yes")
 
 	// Connect the external_switch to the router.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lsp-add", externalSwitch, "etor-"+gatewayRouter, "--", "set", "logical_switch_port", "etor-"+gatewayRouter, "type=router", "options:router-port=rtoe-"+gatewayRouter, "addresses="+"\""+macAddress+"\"")
-	if err != nil {
-		return err
-	}
+	txn.Add("--may-exist", "lsp-add", externalSwitch, "etor-"+gatewayRouter)
+	txn.Add("set", "logical_switch_port", "etor-"+gatewayRouter, "type=router", "options:router-port=rtoe-"+gatewayRouter, "addresses="+"\""+macAddress+"\"")
 
 	// Default SNAT rules.
-	_, err = exec.RunCommand("ovn-nbctl", "--", "--id=@nat", "create", "nat", "type=snat", "logical_ip="+clusterIpSubnet, "external_ip="+physicalIp, "--", "add", "logical_router", gatewayRouter, "nat", "@nat")
+	err = reconcileGatewaySNAT(txn, gatewayRouter, clusterIpSubnet, snat, noSNAT)
 	if err != nil {
 		return err
 	}
+
 	// When there are multiple gateway routers (which would be the likely default for any sane deployment),
 	//we need to SNAT traffic heading to the logical space with the Gateway router's IP so that return traffic comes back to the same gateway router.
-	if routerIP != "" {
-		routerIPByte, _, err := net.ParseCIDR(routerIP)
-		if err != nil {
-			return err
-		}
-		_, err = exec.RunCommand("ovn-nbctl", "set", "logical_router", gatewayRouter, "options:lb_force_snat_ip="+routerIPByte.String())
-		if err != nil {
-			return err
-		}
+	if routerIP != nil {
+		txn.Add("set", "logical_router", gatewayRouter, "options:lb_force_snat_ip="+routerIP.String())
 		if rampoutIPSubnet != "" {
 			rampoutIPSubnets := strings.Split(rampoutIPSubnet, ",")
 			for _, rampoutIPSubnet = range rampoutIPSubnets {
-				_, _, err = net.ParseCIDR(rampoutIPSubnet)
+				_, _, err := net.ParseCIDR(rampoutIPSubnet)
 				if err != nil {
 					continue
 				}
 				// Add source IP address based routes in distributed router
 				// for this gateway router
-				_, err = exec.RunCommand("ovn-vsctl", "--may-exist", "--policy=src-ip", "lr-route-add", k8sClusterRouter, rampoutIPSubnet, routerIPByte.String())
-				if err != nil {
-					return err
-				}
+				txn.Add("--may-exist", "--policy=src-ip", "lr-route-add", k8sClusterRouter, rampoutIPSubnet, routerIP.String())
+			}
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	if physicalInterface != "" {
+		// Flush the IP address of the physical interface, now that the
+		// gateway router owns it.
+		_, err = exec.RunCommand("ip", "addr", "flush", "dev", physicalInterface)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// setBridgeMapping maps physicalNetwork to bridge in the ovn-bridge-mappings
+// of the local Open_vSwitch, keeping the other mappings.
+func setBridgeMapping(physicalNetwork, bridge string) error {
+	re, err := exec.RunCommand("ovs-vsctl", "--if-exists", "get", "Open_vSwitch", ".", "external_ids:ovn-bridge-mappings")
+	if err != nil {
+		return err
+	}
+	mappings := []string{physicalNetwork + ":" + bridge}
+	if re != nil {
+		for _, mapping := range strings.Split(strings.Trim(re[0], "\""), ",") {
+			if mapping == "" || strings.HasPrefix(mapping, physicalNetwork+":") {
+				continue
 			}
+			mappings = append(mappings, mapping)
+		}
+	}
+	_, err = exec.RunCommand("ovs-vsctl", "set", "Open_vSwitch", ".", "external_ids:ovn-bridge-mappings=\""+strings.Join(mappings, ",")+"\"")
+	return err
+}
+
+// gatewayConfig is the external connectivity of a node as found on the host.
+type gatewayConfig struct {
+	iface      string
+	isBridge   bool
+	physicalIP string
+	defaultGW  string
+}
+
+// gatewayFlags are the flags of "ovnctl gateway" that autoDetect fills in.
+type gatewayFlags struct {
+	physicalIP        string
+	defaultGW         string
+	physicalInterface string
+	bridgeInterface   string
+	providerBridge    string
+}
+
+// autoDetect fills in the flags that were not given from the interface in
+// use, as found by detect: the physical-interface or bridge-interface given,
+// or else the OVS bridge carrying the host's default route.  A provider
+// bridge only lends the next hop of its default route.  The host keeps its
+// addresses there, so the gateway router needs one of its own.
+func autoDetect(flags *gatewayFlags, detect func(iface string) (*gatewayConfig, error)) error {
+	if flags.providerBridge != "" {
+		if flags.physicalIP == "" {
+			return fmt.Errorf("provider-bridge %v needs physical-ip, an address of the provider network the host does not use", flags.providerBridge)
+		}
+		if flags.defaultGW != "" {
+			return nil
+		}
+		detected, err := detect(flags.providerBridge)
+		if err != nil {
+			return err
+		}
+		if detected.defaultGW == "" {
+			return fmt.Errorf("no default route via provider-bridge %v found, pass default-gw", flags.providerBridge)
 		}
+		fmt.Printf("detected default gateway %v via %v\n", detected.defaultGW, detected.iface)
+		flags.defaultGW = detected.defaultGW
+		return nil
+	}
+
+	iface := flags.physicalInterface
+	if iface == "" {
+		iface = flags.bridgeInterface
+	}
+	detected, err := detect(iface)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("detected interface %v (ovs bridge: %v), physical ip %v, default gateway %v\n",
+		detected.iface, detected.isBridge, detected.physicalIP, detected.defaultGW)
+	if iface == "" {
+		// Physical interface mode flushes the addresses of the nic
+		// carrying the default route, which cuts the node off.  It is
+		// only used when asked for explicitly.
+		if !detected.isBridge {
+			return fmt.Errorf("the default route of the host uses %v, which is not an OVS bridge; "+
+				"run 'ovnctl bridge create --nic %v' first, or pass --physical-interface %v to move it into the gateway",
+				detected.iface, detected.iface, detected.iface)
+		}
+		flags.bridgeInterface = detected.iface
+	}
+	if flags.physicalIP == "" {
+		if detected.physicalIP == "" {
+			return fmt.Errorf("interface %v has no ipv4 address", detected.iface)
+		}
+		flags.physicalIP = detected.physicalIP
+	}
+	if flags.defaultGW == "" {
+		flags.defaultGW = detected.defaultGW
 	}
 	return nil
 }
+
+// detectGatewayConfig looks up iface, or the interface of the host's IPv4
+// default route if iface is "", with its primary address and the next hop
+// of the default route through it.
+func detectGatewayConfig(iface string) (*gatewayConfig, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	var link netlink.Link
+	if iface != "" {
+		if link, err = netlink.LinkByName(iface); err != nil {
+			return nil, fmt.Errorf("failed to find interface %v: %v", iface, err)
+		}
+	}
+	var defaultRoute *netlink.Route
+	for i, route := range routes {
+		if (route.Dst == nil || route.Dst.String() == "0.0.0.0/0") && (link == nil || route.LinkIndex == link.Attrs().Index) {
+			defaultRoute = &routes[i]
+			break
+		}
+	}
+	if link == nil {
+		if defaultRoute == nil {
+			return nil, fmt.Errorf("no default route found")
+		}
+		if link, err = netlink.LinkByIndex(defaultRoute.LinkIndex); err != nil {
+			return nil, fmt.Errorf("failed to find the interface of the default route: %v", err)
+		}
+	}
+	name := link.Attrs().Name
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %v: %v", name, err)
+	}
+	config := &gatewayConfig{iface: name}
+	if len(addrs) > 0 {
+		config.physicalIP = addrs[0].IPNet.String()
+	}
+	if defaultRoute != nil && defaultRoute.Gw != nil {
+		config.defaultGW = defaultRoute.Gw.String()
+	}
+	// An OVS bridge, e.g. one made by "ovnctl bridge create", is used as
+	// bridge-interface rather than moved into br-int.
+	if _, err := exec.RunCommand("ovs-vsctl", "br-exists", name); err == nil {
+		config.isBridge = true
+	}
+	return config, nil
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAutoDetect(t *testing.T) {
+	// The host's default route uses eth0, 10.0.0.5/24 via 10.0.0.1.  The
+	// provider bridge br-provider carries a host address too and a default
+	// route via 192.168.0.1.  brex has neither.
+	host := map[string]*gatewayConfig{
+		"":            {iface: "eth0", physicalIP: "10.0.0.5/24", defaultGW: "10.0.0.1"},
+		"eth0":        {iface: "eth0", physicalIP: "10.0.0.5/24", defaultGW: "10.0.0.1"},
+		"breth1":      {iface: "breth1", isBridge: true, physicalIP: "172.16.0.5/24", defaultGW: "172.16.0.1"},
+		"br-provider": {iface: "br-provider", isBridge: true, physicalIP: "10.0.0.5/24", defaultGW: "192.168.0.1"},
+		"brex":        {iface: "brex", isBridge: true},
+	}
+	tests := []struct {
+		flags    gatewayFlags
+		want     gatewayFlags
+		detected string
+		fails    bool
+	}{
+		// The default route's interface is used only when it is a bridge.
+		{gatewayFlags{}, gatewayFlags{}, "", true},
+		// An explicit interface is the one looked at.
+		{gatewayFlags{bridgeInterface: "breth1"},
+			gatewayFlags{bridgeInterface: "breth1", physicalIP: "172.16.0.5/24", defaultGW: "172.16.0.1"}, "breth1", false},
+		{gatewayFlags{physicalInterface: "eth0", defaultGW: "10.0.0.254"},
+			gatewayFlags{physicalInterface: "eth0", physicalIP: "10.0.0.5/24", defaultGW: "10.0.0.254"}, "eth0", false},
+		{gatewayFlags{bridgeInterface: "brex"}, gatewayFlags{}, "brex", true},
+		// A provider bridge never lends the host's address.
+		{gatewayFlags{providerBridge: "br-provider"}, gatewayFlags{}, "none", true},
+		{gatewayFlags{providerBridge: "br-provider", physicalIP: "192.168.0.10/24"},
+			gatewayFlags{providerBridge: "br-provider", physicalIP: "192.168.0.10/24", defaultGW: "192.168.0.1"}, "br-provider", false},
+		{gatewayFlags{providerBridge: "br-provider", physicalIP: "192.168.0.10/24", defaultGW: "192.168.0.254"},
+			gatewayFlags{providerBridge: "br-provider", physicalIP: "192.168.0.10/24", defaultGW: "192.168.0.254"}, "none", false},
+		{gatewayFlags{providerBridge: "brex", physicalIP: "192.168.0.10/24"}, gatewayFlags{}, "brex", true},
+	}
+	for _, test := range tests {
+		detected := "none"
+		detect := func(iface string) (*gatewayConfig, error) {
+			detected = iface
+			config, ok := host[iface]
+			if !ok {
+				return nil, fmt.Errorf("no interface %v", iface)
+			}
+			return config, nil
+		}
+		flags := test.flags
+		err := autoDetect(&flags, detect)
+		if detected != test.detected {
+			t.Errorf("autoDetect(%+v) looked at %q, want %q", test.flags, detected, test.detected)
+		}
+		if test.fails {
+			if err == nil {
+				t.Errorf("autoDetect(%+v) = %+v, want an error", test.flags, flags)
+			}
+			continue
+		}
+		if err != nil || flags != test.want {
+			t.Errorf("autoDetect(%+v) = %+v, %v, want %+v", test.flags, flags, err, test.want)
+		}
+	}
+}
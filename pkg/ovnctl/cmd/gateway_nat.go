@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+)
+
+// gatewaySNATKey marks the SNAT rows of a gateway router that "ovnctl
+// gateway" manages.
+const gatewaySNATKey = "k8s-gateway-snat"
+
+// noSNATAddressSet returns the name of the address set holding the
+// destinations that the gateway router does not SNAT.
+func noSNATAddressSet(gatewayRouter string) string {
+	return "no_snat_" + gatewayRouter
+}
+
+// parseSNATIPs parses the comma separated external addresses of the gateway.
+// physicalIp is always the first one.  Every address has to be in the
+// external subnet, where the gateway router answers ARP for it.
+func parseSNATIPs(physicalIp string, external *net.IPNet, snatIPs string) ([]string, error) {
+	ips := []string{physicalIp}
+	seen := map[string]bool{physicalIp: true}
+	for _, s := range strings.Split(snatIPs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid snat ip %q", s)
+		}
+		if !external.Contains(ip) {
+			return nil, fmt.Errorf("snat ip %v is not in the external subnet %v", ip, external)
+		}
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+// parseNoSNATDestinations parses the comma separated destination subnets that
+// must see the real pod ips.
+func parseNoSNATDestinations(destinations string) ([]string, error) {
+	var cidrs []string
+	for _, s := range strings.Split(destinations, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid no-snat destination %q: %v", s, err)
+		}
+		cidrs = append(cidrs, cidr.String())
+	}
+	return cidrs, nil
+}
+
+// checkNoSNATSupport fails if there are no-SNAT destinations but the
+// northbound schema lacks the exempted_ext_ips column of the NAT table that
+// implements them, which was added in OVN 20.12.
+func checkNoSNATSupport(noSNAT []string) error {
+	if len(noSNAT) == 0 {
+		return nil
+	}
+	supported, err := ovn.HasColumn("nat", "exempted_ext_ips")
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return fmt.Errorf("no-snat-destinations needs OVN 20.12 or later: the northbound NAT table has no exempted_ext_ips column")
+	}
+	return nil
+}
+
+// snatSplitBits is how much finer than the number of external addresses the
+// cluster subnet is cut by snatRules.
+const snatSplitBits = 4
+
+// snatRules spreads the cluster subnet over the external addresses in equal
+// shares: the subnet is cut into 2^snatSplitBits times more equal parts than
+// the smallest power of two not less than the number of addresses, each
+// address takes a consecutive run of about as many parts as the others, and
+// each run is written as the fewest subnets.  Shares differ by one part at
+// most.  It returns the external ip for each logical subnet.
+func snatRules(clusterSubnet string, externalIPs []string) (map[string]string, error) {
+	_, subnet, err := net.ParseCIDR(clusterSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cluster-ip-subnet %v: %v", clusterSubnet, err)
+	}
+	if len(externalIPs) == 1 {
+		return map[string]string{subnet.String(): externalIPs[0]}, nil
+	}
+	bits := snatSplitBits
+	for 1<<uint(bits) < len(externalIPs)<<snatSplitBits {
+		bits++
+	}
+	ones, total := subnet.Mask.Size()
+	if ones+bits > total {
+		bits = total - ones
+	}
+	parts, err := common.SplitSubnet(subnet, ones+bits)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) < len(externalIPs) {
+		return nil, fmt.Errorf("cluster-ip-subnet %v is too small for %d snat ips", clusterSubnet, len(externalIPs))
+	}
+	rules := make(map[string]string)
+	for i, ip := range externalIPs {
+		start, end := i*len(parts)/len(externalIPs), (i+1)*len(parts)/len(externalIPs)
+		for start < end {
+			// The largest aligned block of parts that fits the run.
+			size := 1
+			for start%(2*size) == 0 && start+2*size <= end {
+				size *= 2
+			}
+			block := 0
+			for 1<<uint(block) < size {
+				block++
+			}
+			rules[(&net.IPNet{IP: parts[start].IP, Mask: net.CIDRMask(ones+bits-block, total)}).String()] = ip
+			start += size
+		}
+	}
+	return rules, nil
+}
+
+// reconcileGatewaySNAT adds the commands that bring the SNAT rows of the
+// gateway router in line with rules and noSNAT to txn.  Matching rows are
+// kept, so running it again changes nothing.  Rows left over from earlier
+// versions, which created an unmarked SNAT of the whole cluster subnet on
+// every run, are removed as well.
+func reconcileGatewaySNAT(txn *ovn.Transaction, gatewayRouter, clusterSubnet string, rules map[string]string, noSNAT []string) error {
+	routers, err := ovn.ListRows("logical_router", []string{"nat"}, "name="+gatewayRouter)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]bool)
+	for _, router := range routers {
+		for _, uuid := range ovn.ParseSet(router["nat"]) {
+			owned[uuid] = true
+		}
+	}
+	rows, err := ovn.ListRows("nat", []string{"_uuid", "type", "logical_ip", "external_ip", "external_ids"})
+	if err != nil {
+		return err
+	}
+	if err := checkNoSNATSupport(noSNAT); err != nil {
+		return err
+	}
+	// Older schemas can not have exempted destinations to clear.
+	supported, err := ovn.HasColumn("nat", "exempted_ext_ips")
+	if err != nil {
+		return err
+	}
+
+	// The rows to keep, by logical subnet.
+	keep := make(map[string]string)
+	for _, row := range rows {
+		if !owned[row["_uuid"]] || row["type"] != "snat" {
+			continue
+		}
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		_, managed := externalIDs[gatewaySNATKey]
+		legacy := len(externalIDs) == 0 && row["logical_ip"] == clusterSubnet
+		if !managed && !legacy {
+			continue
+		}
+		if _, dup := keep[row["logical_ip"]]; managed && !dup && rules[row["logical_ip"]] == row["external_ip"] {
+			keep[row["logical_ip"]] = row["_uuid"]
+			continue
+		}
+		txn.Add("remove", "logical_router", gatewayRouter, "nat", row["_uuid"])
+	}
+
+	addressSet := noSNATAddressSet(gatewayRouter)
+	sets, err := ovn.ListRows("address_set", []string{"_uuid"}, "name="+addressSet)
+	if err != nil {
+		return err
+	}
+	exempted := ""
+	if len(noSNAT) > 0 {
+		addresses := "addresses=[\"" + strings.Join(noSNAT, "\",\"") + "\"]"
+		if len(sets) > 0 {
+			exempted = sets[0]["_uuid"]
+			txn.Add("set", "address_set", exempted, addresses)
+		} else {
+			exempted = "@no_snat"
+			txn.Add("--id="+exempted, "create", "address_set", "name="+addressSet, addresses)
+		}
+	} else {
+		for _, set := range sets {
+			txn.Add("destroy", "address_set", set["_uuid"])
+		}
+	}
+
+	id := 0
+	for logicalIP, externalIP := range rules {
+		if uuid, ok := keep[logicalIP]; ok {
+			if exempted != "" {
+				txn.Add("set", "nat", uuid, "exempted_ext_ips="+exempted)
+			} else if supported {
+				txn.Add("clear", "nat", uuid, "exempted_ext_ips")
+			}
+			continue
+		}
+		id++
+		ref := fmt.Sprintf("@snat%d", id)
+		args := []string{"--id=" + ref, "create", "nat", "type=snat", "logical_ip=" + logicalIP, "external_ip=" + externalIP,
+			"external_ids:" + gatewaySNATKey + "=yes"}
+		if exempted != "" {
+			args = append(args, "exempted_ext_ips="+exempted)
+		}
+		txn.Add(args...)
+		txn.Add("add", "logical_router", gatewayRouter, "nat", ref)
+	}
+	return nil
+}
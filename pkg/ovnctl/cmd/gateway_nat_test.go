@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseSNATIPs(t *testing.T) {
+	_, external, _ := net.ParseCIDR("172.16.0.0/24")
+	tests := []struct {
+		snatIPs string
+		want    []string
+		fails   bool
+	}{
+		{"", []string{"172.16.0.10"}, false},
+		{"172.16.0.11", []string{"172.16.0.10", "172.16.0.11"}, false},
+		{" 172.16.0.11 , 172.16.0.12,", []string{"172.16.0.10", "172.16.0.11", "172.16.0.12"}, false},
+		{"172.16.0.10,172.16.0.11,172.16.0.11", []string{"172.16.0.10", "172.16.0.11"}, false},
+		{"172.16.1.1", nil, true},
+		{"fd00::1", nil, true},
+		{"172.16.0", nil, true},
+	}
+	for _, test := range tests {
+		ips, err := parseSNATIPs("172.16.0.10", external, test.snatIPs)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseSNATIPs(%q) = %v, want an error", test.snatIPs, ips)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(ips, test.want) {
+			t.Errorf("parseSNATIPs(%q) = %v, %v, want %v", test.snatIPs, ips, err, test.want)
+		}
+	}
+}
+
+func TestParseNoSNATDestinations(t *testing.T) {
+	cidrs, err := parseNoSNATDestinations("10.1.2.3/16, 192.168.0.0/24,")
+	if want := []string{"10.1.0.0/16", "192.168.0.0/24"}; err != nil || !reflect.DeepEqual(cidrs, want) {
+		t.Errorf("parseNoSNATDestinations = %v, %v, want %v", cidrs, err, want)
+	}
+	if _, err := parseNoSNATDestinations("10.1.0.0"); err == nil {
+		t.Errorf("parseNoSNATDestinations(10.1.0.0) succeeded without a prefix length")
+	}
+}
+
+func TestSNATRules(t *testing.T) {
+	tests := []struct {
+		ips  []string
+		want map[string]string
+	}{
+		{[]string{"a"}, map[string]string{"10.0.0.0/16": "a"}},
+		{[]string{"a", "b"}, map[string]string{"10.0.0.0/17": "a", "10.0.128.0/17": "b"}},
+		// 21, 21 and 22 of 64 parts.
+		{[]string{"a", "b", "c"}, map[string]string{
+			"10.0.0.0/18": "a", "10.0.64.0/20": "a", "10.0.80.0/22": "a",
+			"10.0.84.0/22": "b", "10.0.88.0/21": "b", "10.0.96.0/19": "b", "10.0.128.0/19": "b", "10.0.160.0/21": "b",
+			"10.0.168.0/21": "c", "10.0.176.0/20": "c", "10.0.192.0/18": "c",
+		}},
+	}
+	for _, test := range tests {
+		rules, err := snatRules("10.0.0.0/16", test.ips)
+		if err != nil || !reflect.DeepEqual(rules, test.want) {
+			t.Errorf("snatRules(%v) = %v, %v, want %v", test.ips, rules, err, test.want)
+		}
+	}
+
+	// The shares of the addresses differ by one part, 1/16 of an equal
+	// share, at most.
+	for n := 2; n <= 9; n++ {
+		var ips []string
+		for i := 0; i < n; i++ {
+			ips = append(ips, fmt.Sprintf("ip%d", i))
+		}
+		rules, err := snatRules("10.0.0.0/16", ips)
+		if err != nil {
+			t.Errorf("snatRules(%d ips) failed: %v", n, err)
+			continue
+		}
+		shares := make(map[string]int)
+		total := 0
+		for cidr, ip := range rules {
+			_, subnet, _ := net.ParseCIDR(cidr)
+			ones, _ := subnet.Mask.Size()
+			shares[ip] += 1 << uint(32-ones)
+			total += 1 << uint(32-ones)
+		}
+		min, max := total, 0
+		for _, share := range shares {
+			if share < min {
+				min = share
+			}
+			if share > max {
+				max = share
+			}
+		}
+		if total != 1<<16 || len(shares) != n || max-min > total/n/16 {
+			t.Errorf("snatRules(%d ips) gives shares %v of %d addresses", n, shares, total)
+		}
+	}
+
+	if _, err := snatRules("10.0.0.0/31", []string{"a", "b", "c"}); err == nil {
+		t.Errorf("snatRules(10.0.0.0/31, 3 ips) succeeded")
+	}
+}
@@ -0,0 +1,443 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/vishvananda/netlink"
+)
+
+var DEBIAN_INTERFACES_FILE = "/etc/network/interfaces"
+var REDHAT_SCRIPTS_DIR = "/etc/sysconfig/network-scripts"
+var NETWORKD_CONF_DIR = "/etc/systemd/network"
+
+// managementPortInterface returns the name of the management port of
+// nodeName, "k8s-" and at most 11 characters of the node name to stay within
+// the 15 characters of an interface name.
+func managementPortInterface(nodeName string) string {
+	if len(nodeName) > 11 {
+		nodeName = nodeName[:11]
+	}
+	return "k8s-" + nodeName
+}
+
+// managementPortConfig holds what has to be persisted for the management port.
+type managementPortConfig struct {
+	nodeName      string
+	interfaceName string
+	ip            net.IP
+	ipNet         *net.IPNet
+	// routes are the subnets reached via routerIP: the cluster subnet and,
+	// when known, the service subnet and the subnet of the "join" switch.
+	// Tenant routers SNAT the traffic of their pods to addresses of the
+	// latter.
+	routes   []*net.IPNet
+	routerIP string
+}
+
+func newManagementPortConfig(nodeName, clusterSubnet, serviceSubnet, joinSubnet, routerIP, interfaceName, interfaceIP string) (*managementPortConfig, error) {
+	ip, interfaceIPNet, err := net.ParseCIDR(interfaceIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse interface ip %v: %v", interfaceIP, err)
+	}
+	_, clusterIPNet, err := net.ParseCIDR(clusterSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cluster subnet %v: %v", clusterSubnet, err)
+	}
+	routes := []*net.IPNet{clusterIPNet}
+	if serviceSubnet != "" {
+		_, serviceIPNet, err := net.ParseCIDR(serviceSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("failed parse service subnet %v: %v", serviceSubnet, err)
+		}
+		routes = append(routes, serviceIPNet)
+	}
+	if joinSubnet != "" {
+		_, joinIPNet, err := net.ParseCIDR(joinSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("failed parse join subnet %v: %v", joinSubnet, err)
+		}
+		routes = append(routes, joinIPNet)
+	}
+	return &managementPortConfig{
+		nodeName:      nodeName,
+		interfaceName: interfaceName,
+		ip:            ip,
+		ipNet:         interfaceIPNet,
+		routes:        routes,
+		routerIP:      routerIP,
+	}, nil
+}
+
+// writeFileIfChanged writes data to path unless path already holds exactly data.
+func writeFileIfChanged(path string, data []byte, perm os.FileMode) error {
+	old, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	return exec.WriteFile(path, data, perm)
+}
+
+// interfacesStanza is one stanza of /etc/network/interfaces: a header line such
+// as "iface br-int inet manual" or "allow-ovs br-int", followed by its option
+// lines.  Comments and blank lines are kept with the preceding stanza.
+type interfacesStanza struct {
+	kind    string
+	args    []string
+	options []string
+}
+
+func isStanzaHeader(line string) bool {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return false
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "iface", "mapping", "auto", "source", "source-directory", "no-auto-down", "no-scripts", "rename":
+		return true
+	}
+	return strings.HasPrefix(fields[0], "allow-")
+}
+
+// parseInterfaces splits the content of /etc/network/interfaces into stanzas.
+// Lines before the first stanza are kept in a stanza without a kind.
+func parseInterfaces(data string) []*interfacesStanza {
+	stanzas := []*interfacesStanza{{}}
+	for _, line := range strings.Split(strings.TrimRight(data, "\n"), "\n") {
+		if isStanzaHeader(line) {
+			fields := strings.Fields(line)
+			stanzas = append(stanzas, &interfacesStanza{kind: fields[0], args: fields[1:]})
+			continue
+		}
+		current := stanzas[len(stanzas)-1]
+		current.options = append(current.options, line)
+	}
+	return stanzas
+}
+
+func renderInterfaces(stanzas []*interfacesStanza) string {
+	var lines []string
+	for _, stanza := range stanzas {
+		if stanza.kind != "" {
+			lines = append(lines, strings.Join(append([]string{stanza.kind}, stanza.args...), " "))
+		}
+		lines = append(lines, stanza.options...)
+	}
+	return strings.TrimLeft(strings.Join(lines, "\n"), "\n") + "\n"
+}
+
+// findStanza returns the index of the first stanza of the given kind that
+// names iface, or -1.
+func findStanza(stanzas []*interfacesStanza, kind, iface string) int {
+	for i, stanza := range stanzas {
+		if stanza.kind != kind {
+			continue
+		}
+		if kind == "iface" {
+			if len(stanza.args) > 0 && stanza.args[0] == iface {
+				return i
+			}
+			continue
+		}
+		for _, arg := range stanza.args {
+			if arg == iface {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// appendStanzas adds stanzas at the end of the file, separated from the
+// existing content by a blank line.
+func appendStanzas(stanzas []*interfacesStanza, added ...*interfacesStanza) []*interfacesStanza {
+	last := stanzas[len(stanzas)-1]
+	if n := len(last.options); (n > 0 && strings.TrimSpace(last.options[n-1]) != "") || (n == 0 && last.kind != "") {
+		last.options = append(last.options, "")
+	}
+	return append(stanzas, added...)
+}
+
+// trailingComments returns the comment and blank lines at the end of options.
+func trailingComments(options []string) []string {
+	i := len(options)
+	for i > 0 {
+		line := strings.TrimSpace(options[i-1])
+		if line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		i--
+	}
+	return options[i:]
+}
+
+func configureManagementPortDebian(config *managementPortConfig) error {
+	data, err := ioutil.ReadFile(DEBIAN_INTERFACES_FILE)
+	if err != nil {
+		return fmt.Errorf("failed read file %v: %v", DEBIAN_INTERFACES_FILE, err)
+	}
+	stanzas := parseInterfaces(string(data))
+
+	interfaceStanza := &interfacesStanza{
+		kind: "iface",
+		args: []string{config.interfaceName, "inet", "static"},
+		options: []string{
+			"\taddress " + config.ip.String(),
+			"\tnetmask " + net.IP(config.ipNet.Mask).String(),
+			"\tovs_type OVSIntPort",
+			"\tovs_bridge br-int",
+			"\tovs_extra set interface $IFACE external-ids:iface-id=k8s-" + config.nodeName,
+		},
+	}
+	for _, route := range config.routes {
+		network := route.IP.String() + " netmask " + net.IP(route.Mask).String() + " gw " + config.routerIP
+		interfaceStanza.options = append(interfaceStanza.options, "\tup route add -net "+network, "\tdown route del -net "+network)
+	}
+
+	if findStanza(stanzas, "allow-ovs", "br-int") < 0 && findStanza(stanzas, "iface", "br-int") < 0 {
+		stanzas = appendStanzas(stanzas,
+			&interfacesStanza{kind: "allow-ovs", args: []string{"br-int"}},
+			&interfacesStanza{
+				kind: "iface",
+				args: []string{"br-int", "inet", "manual"},
+				options: []string{
+					"\tovs_type OVSBridge",
+					"\tovs_ports " + config.interfaceName,
+					"\tovs_extra set bridge br-int fail_mode=secure",
+				},
+			})
+	} else if i := findStanza(stanzas, "iface", "br-int"); i >= 0 {
+		// Make sure the existing bridge lists the management port.
+		bridge := stanzas[i]
+		found := false
+		for j, option := range bridge.options {
+			fields := strings.Fields(option)
+			if len(fields) == 0 || fields[0] != "ovs_ports" {
+				continue
+			}
+			found = true
+			listed := false
+			for _, port := range fields[1:] {
+				if port == config.interfaceName {
+					listed = true
+				}
+			}
+			if !listed {
+				bridge.options[j] = option + " " + config.interfaceName
+			}
+		}
+		if !found {
+			comments := trailingComments(bridge.options)
+			options := append([]string{}, bridge.options[:len(bridge.options)-len(comments)]...)
+			bridge.options = append(append(options, "\tovs_ports "+config.interfaceName), comments...)
+		}
+	}
+
+	if i := findStanza(stanzas, "iface", config.interfaceName); i >= 0 {
+		// Replace the stanza so that a changed address is picked up.
+		interfaceStanza.options = append(interfaceStanza.options, trailingComments(stanzas[i].options)...)
+		stanzas[i] = interfaceStanza
+	} else {
+		if findStanza(stanzas, "allow-br-int", config.interfaceName) < 0 {
+			stanzas = appendStanzas(stanzas, &interfacesStanza{kind: "allow-br-int", args: []string{config.interfaceName}}, interfaceStanza)
+		} else {
+			stanzas = appendStanzas(stanzas, interfaceStanza)
+		}
+	}
+
+	return writeFileIfChanged(DEBIAN_INTERFACES_FILE, []byte(renderInterfaces(stanzas)), 0644)
+}
+
+func configureManagementPortRedhat(config *managementPortConfig) error {
+	bridgeTemplate := "DEVICE=br-int\nDEVICETYPE=ovs\nTYPE=OVSBridge\nONBOOT=yes\nBOOTPROTO=none\nOVS_EXTRA=\"set bridge br-int fail_mode=secure\"\n"
+	interfaceTemplate := "DEVICE=" + config.interfaceName + "\nDEVICETYPE=ovs\nTYPE=OVSIntPort\nOVS_BRIDGE=br-int\nONBOOT=yes\nBOOTPROTO=static\nIPADDR=" +
+		config.ip.String() + "\nNETMASK=" + net.IP(config.ipNet.Mask).String() + "\nOVS_EXTRA=\"set interface $DEVICE external-ids:iface-id=k8s-" + config.nodeName + "\"\n"
+	routeTemplate := ""
+	for i, route := range config.routes {
+		routeTemplate += fmt.Sprintf("ADDRESS%d=%s\nNETMASK%d=%s\nGATEWAY%d=%s\n", i, route.IP.String(), i, net.IP(route.Mask).String(), i, config.routerIP)
+	}
+
+	// Like on Debian, an existing br-int configuration is left alone.
+	if _, err := os.Stat(REDHAT_SCRIPTS_DIR + "/ifcfg-br-int"); os.IsNotExist(err) {
+		if err := exec.WriteFile(REDHAT_SCRIPTS_DIR+"/ifcfg-br-int", []byte(bridgeTemplate), 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeFileIfChanged(REDHAT_SCRIPTS_DIR+"/ifcfg-"+config.interfaceName, []byte(interfaceTemplate), 0644); err != nil {
+		return err
+	}
+	return writeFileIfChanged(REDHAT_SCRIPTS_DIR+"/route-"+config.interfaceName, []byte(routeTemplate), 0644)
+}
+
+// configureManagementPortNetworkd writes a systemd-networkd unit that assigns
+// the management port its address and the route to the cluster subnet.  The
+// port itself is kept by OVS, so nothing has to be written for br-int.
+func configureManagementPortNetworkd(config *managementPortConfig) error {
+	ones, _ := config.ipNet.Mask.Size()
+	unit := "[Match]\nName=" + config.interfaceName + "\n\n[Network]\nAddress=" + fmt.Sprintf("%s/%d", config.ip.String(), ones) +
+		"\nLinkLocalAddressing=no\n"
+	for _, route := range config.routes {
+		unit += "\n[Route]\nDestination=" + route.String() + "\nGateway=" + config.routerIP + "\n"
+	}
+
+	if _, err := os.Stat(NETWORKD_CONF_DIR); os.IsNotExist(err) {
+		if err := exec.MkdirAll(NETWORKD_CONF_DIR, 0755); err != nil {
+			return err
+		}
+	}
+	return writeFileIfChanged(NETWORKD_CONF_DIR+"/50-"+config.interfaceName+".network", []byte(unit), 0644)
+}
+
+// networkdActive reports whether the host network is managed by
+// systemd-networkd, either directly or through netplan.
+func networkdActive() bool {
+	re, err := exec.RunCommand("systemctl", "is-active", "systemd-networkd")
+	if err != nil || re == nil || strings.TrimSpace(re[0]) != "active" {
+		return false
+	}
+	return true
+}
+
+const (
+	backendNetworkd = "networkd"
+	backendDebian   = "debian"
+	backendRedhat   = "redhat"
+)
+
+// networkBackend returns the tool that persists the host's network
+// configuration, or "" if none is known.  systemd-networkd (also used by
+// netplan) is preferred when it is running, then Debian's ifupdown and
+// finally Red Hat's network-scripts.
+func networkBackend() string {
+	if networkdActive() {
+		return backendNetworkd
+	}
+	if _, err := os.Stat(DEBIAN_INTERFACES_FILE); err == nil {
+		return backendDebian
+	}
+	if _, err := os.Stat(REDHAT_SCRIPTS_DIR + "/ifup-ovs"); err == nil {
+		return backendRedhat
+	}
+	return ""
+}
+
+// ensureLinkUp brings link up unless it already is.
+func ensureLinkUp(link netlink.Link) error {
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		return nil
+	}
+	return exec.Apply("ip link set "+link.Attrs().Name+" up", func() error {
+		return netlink.LinkSetUp(link)
+	})
+}
+
+// ensureAddress makes address the only IPv4 address of link.  Addresses that
+// are already right are left in place, so connectivity is not interrupted.
+func ensureAddress(link netlink.Link, address *net.IPNet) error {
+	name := link.Attrs().Name
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %v: %v", name, err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == address.String() {
+			found = true
+			continue
+		}
+		stale := addr
+		err = exec.Apply("ip addr del "+stale.IPNet.String()+" dev "+name, func() error {
+			return netlink.AddrDel(link, &stale)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if found {
+		return nil
+	}
+	return exec.Apply("ip addr add "+address.String()+" dev "+name, func() error {
+		return netlink.AddrAdd(link, &netlink.Addr{IPNet: address})
+	})
+}
+
+// ensureRoute makes dst reachable via gw on link.  Routes to dst that point
+// elsewhere are replaced, a matching route is left alone.
+func ensureRoute(link netlink.Link, dst *net.IPNet, gw net.IP) error {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.Dst.String() != dst.String() {
+			continue
+		}
+		if route.LinkIndex == link.Attrs().Index && route.Gw.Equal(gw) {
+			return nil
+		}
+		stale := route
+		err = exec.Apply("ip route del "+dst.String()+" via "+stale.Gw.String(), func() error {
+			return netlink.RouteDel(&stale)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return exec.Apply("ip route add "+dst.String()+" via "+gw.String()+" dev "+link.Attrs().Name, func() error {
+		return netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: gw})
+	})
+}
+
+func configureManagementPort(nodeName, clusterSubnet, serviceSubnet, joinSubnet, routerIP, interfaceName, interfaceIP string) error {
+	config, err := newManagementPortConfig(nodeName, clusterSubnet, serviceSubnet, joinSubnet, routerIP, interfaceName, interfaceIP)
+	if err != nil {
+		return err
+	}
+	// First, try to configure management ports via platform specific tools.
+	switch networkBackend() {
+	case backendNetworkd:
+		err = configureManagementPortNetworkd(config)
+	case backendDebian:
+		err = configureManagementPortDebian(config)
+	case backendRedhat:
+		err = configureManagementPortRedhat(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		if exec.DryRun {
+			// The interface is only created when not in dry-run mode.
+			fmt.Printf("[dry-run] configure %v with %v and routes to %v via %v\n", interfaceName, interfaceIP, config.routes, routerIP)
+			return nil
+		}
+		return fmt.Errorf("failed to find interface %v: %v", interfaceName, err)
+	}
+	// Up the interface.
+	if err := ensureLinkUp(link); err != nil {
+		return err
+	}
+	// Assign IP address to the internal interface.
+	address := &net.IPNet{IP: config.ip, Mask: config.ipNet.Mask}
+	if err := ensureAddress(link, address); err != nil {
+		return err
+	}
+	// Create a route for the entire cluster subnet and the service subnet.
+	gw := net.ParseIP(routerIP)
+	for _, route := range config.routes {
+		if err := ensureRoute(link, route, gw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
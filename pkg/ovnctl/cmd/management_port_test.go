@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testInterfaces = `# The loopback network interface
+auto lo
+iface lo inet loopback
+
+allow-ovs br-int
+iface br-int inet manual
+	ovs_type OVSBridge
+	ovs_ports k8s-node1
+# end of br-int
+
+source /etc/network/interfaces.d/*
+`
+
+func TestParseInterfaces(t *testing.T) {
+	stanzas := parseInterfaces(testInterfaces)
+	var headers [][]string
+	for _, stanza := range stanzas {
+		headers = append(headers, append([]string{stanza.kind}, stanza.args...))
+	}
+	want := [][]string{
+		{""},
+		{"auto", "lo"},
+		{"iface", "lo", "inet", "loopback"},
+		{"allow-ovs", "br-int"},
+		{"iface", "br-int", "inet", "manual"},
+		{"source", "/etc/network/interfaces.d/*"},
+	}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("parseInterfaces headers = %q, want %q", headers, want)
+	}
+	if got := stanzas[0].options; !reflect.DeepEqual(got, []string{"# The loopback network interface"}) {
+		t.Errorf("leading lines = %q", got)
+	}
+	bridge := stanzas[4].options
+	if want := []string{"\tovs_type OVSBridge", "\tovs_ports k8s-node1", "# end of br-int", ""}; !reflect.DeepEqual(bridge, want) {
+		t.Errorf("br-int options = %q, want %q", bridge, want)
+	}
+	if got := trailingComments(bridge); !reflect.DeepEqual(got, []string{"# end of br-int", ""}) {
+		t.Errorf("trailingComments = %q", got)
+	}
+
+	if got := renderInterfaces(stanzas); got != testInterfaces {
+		t.Errorf("renderInterfaces does not give back the parsed file:\n%s", got)
+	}
+}
+
+func TestFindStanza(t *testing.T) {
+	stanzas := parseInterfaces(testInterfaces + "allow-br-int k8s-node1 other\n")
+	tests := []struct {
+		kind, iface string
+		want        int
+	}{
+		{"iface", "br-int", 4},
+		{"iface", "inet", -1},
+		{"allow-ovs", "br-int", 3},
+		{"allow-br-int", "other", 6},
+		{"auto", "br-int", -1},
+	}
+	for _, test := range tests {
+		if got := findStanza(stanzas, test.kind, test.iface); got != test.want {
+			t.Errorf("findStanza(%v, %v) = %d, want %d", test.kind, test.iface, got, test.want)
+		}
+	}
+}
+
+func TestConfigureManagementPortDebian(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interfaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "interfaces")
+	if err := ioutil.WriteFile(path, []byte("auto lo\niface lo inet loopback\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { DEBIAN_INTERFACES_FILE = old }(DEBIAN_INTERFACES_FILE)
+	DEBIAN_INTERFACES_FILE = path
+
+	config, err := newManagementPortConfig("node1", "10.1.0.0/16", "", "", "10.1.0.1", "k8s-node1", "10.1.0.2/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configureManagementPortDebian(config); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ioutil.ReadFile(path)
+	want := `auto lo
+iface lo inet loopback
+
+allow-ovs br-int
+iface br-int inet manual
+	ovs_type OVSBridge
+	ovs_ports k8s-node1
+	ovs_extra set bridge br-int fail_mode=secure
+
+allow-br-int k8s-node1
+iface k8s-node1 inet static
+	address 10.1.0.2
+	netmask 255.255.255.0
+	ovs_type OVSIntPort
+	ovs_bridge br-int
+	ovs_extra set interface $IFACE external-ids:iface-id=k8s-node1
+	up route add -net 10.1.0.0 netmask 255.255.0.0 gw 10.1.0.1
+	down route del -net 10.1.0.0 netmask 255.255.0.0 gw 10.1.0.1
+`
+	if string(first) != want {
+		t.Errorf("interfaces =\n%s\nwant\n%s", first, want)
+	}
+
+	// A changed address replaces the stanza instead of adding another.
+	config, err = newManagementPortConfig("node1", "10.1.0.0/16", "", "", "10.1.0.1", "k8s-node1", "10.1.0.3/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configureManagementPortDebian(config); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ioutil.ReadFile(path)
+	stanzas := parseInterfaces(string(second))
+	if i := findStanza(stanzas, "iface", "k8s-node1"); i < 0 || stanzas[i].options[0] != "\taddress 10.1.0.3" {
+		t.Errorf("interfaces after an address change =\n%s", second)
+	}
+	if len(stanzas) != len(parseInterfaces(string(first))) {
+		t.Errorf("interfaces grew after an address change:\n%s", second)
+	}
+}
+
+func TestManagementPortInterface(t *testing.T) {
+	tests := []struct {
+		nodeName string
+		want     string
+	}{
+		{"n1", "k8s-n1"},
+		{"node-name-1", "k8s-node-name-1"},
+		{"node-name-12", "k8s-node-name-1"},
+		{"", "k8s-"},
+	}
+	for _, test := range tests {
+		if got := managementPortInterface(test.nodeName); got != test.want {
+			t.Errorf("managementPortInterface(%q) = %q, want %q", test.nodeName, got, test.want)
+		}
+	}
+}
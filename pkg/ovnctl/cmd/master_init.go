@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/mozhuli/ovn-stackube/pkg/common"
@@ -23,8 +24,10 @@ func InitMaster() *cobra.Command {
 	}
 
 	MasterCmd.Flags().StringP("cluster-ip-subnet", "", "", "The cluster wide larger subnet of private ip addresses.")
+	MasterCmd.Flags().StringP("service-cluster-ip-range", "", "", "The subnet of service cluster ips, routed via the management port when set.")
 	MasterCmd.Flags().StringP("master-switch-subnet", "", "", "The smaller subnet just for master.")
 	MasterCmd.Flags().StringP("node-name", "", "", "A unique node name.")
+	MasterCmd.Flags().StringP("join-subnet", "", DEFAULT_JOIN_SUBNET, "The subnet of the switch connecting the gateway routers to the distributed router.")
 
 	return MasterCmd
 }
@@ -45,11 +48,31 @@ func initMaster(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("argument --cluster-ip-subnet should be non-null")
 	}
 
+	serviceClusterIpRange := cmd.Flags().Lookup("service-cluster-ip-range").Value.String()
+
 	nodeName := cmd.Flags().Lookup("node-name").Value.String()
 	if nodeName == "" {
 		return fmt.Errorf("argument --cluster-ip-subnet should be non-null")
 	}
 
+	joinSubnet := cmd.Flags().Lookup("join-subnet").Value.String()
+	_, joinSubnetNet, err := net.ParseCIDR(joinSubnet)
+	if err != nil {
+		return fmt.Errorf("failed parse join-subnet %v: %v", joinSubnet, err)
+	}
+	// The addresses of the gateways and tenant routers are allocated from
+	// all of it.
+	if _, err := common.NewIPAllocator(joinSubnetNet); err != nil {
+		return fmt.Errorf("invalid join-subnet: %v", err)
+	}
+	existingJoinSubnet, err := getJoinSubnet()
+	if err != nil {
+		return err
+	}
+	if existingJoinSubnet != nil && existingJoinSubnet.String() != joinSubnetNet.String() {
+		return fmt.Errorf("join switch already uses subnet %v, can not change it to %v", existingJoinSubnet, joinSubnetNet)
+	}
+
 	// Create a single common distributed router for the cluster.
 	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lr-add", nodeName, "--", "set", "logical_router", nodeName, "external_ids:k8s-cluster-router=yes")
 	if err != nil {
@@ -88,8 +111,8 @@ func initMaster(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create a logical switch called "join" that will be used to connect gateway routers to the distributed router.
-	// The "join" will be allocated IP addresses in the range 100.64.1.0/24
-	_, err = exec.RunCommand("ovn-nbctl", "--may-exist", "ls-add", "join")
+	// The "join" will be allocated IP addresses in the join subnet, which is recorded on the switch.
+	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "ls-add", "join", "--", "set", "logical_switch", "join", "other-config:subnet="+joinSubnetNet.String())
 	if err != nil {
 		return fmt.Errorf("failed create logical switch called join: %v", err)
 	}
@@ -103,8 +126,14 @@ func initMaster(cmd *cobra.Command, args []string) error {
 	}
 	routerMac := strings.Trim(re[0], "\"")
 	if routerMac == "" {
-		routerMac = common.GenerateMac()
-		_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lrp-add", nodeName, "rtoj-"+nodeName, routerMac, "100.64.1.1/24", "--", "set", "logical_router_port", "rtoj-"+nodeName, "external_ids:connect_to_join=yes")
+		// The distributed router takes the first address of the join subnet.
+		routerIP := common.FirstIP(joinSubnetNet)
+		n, _ := joinSubnetNet.Mask.Size()
+		routerMac, err = allocateMac(routerIP)
+		if err != nil {
+			return err
+		}
+		_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lrp-add", nodeName, "rtoj-"+nodeName, routerMac, fmt.Sprintf("%s/%d", routerIP.String(), n), "--", "set", "logical_router_port", "rtoj-"+nodeName, "external_ids:connect_to_join=yes")
 		if err != nil {
 			return fmt.Errorf("failed add port rtoj-%v : %v", nodeName, err)
 		}
@@ -113,7 +142,7 @@ func initMaster(cmd *cobra.Command, args []string) error {
 	// Connect the switch "join" to the router.
 	_, err = exec.RunCommand("ovn-nbctl", "--", "--may-exist", "lsp-add", "join", "jtor-"+nodeName, "--", "set", "logical_switch_port", "jtor-"+nodeName, "type=router", "options:router-port=rtoj-"+nodeName, "addresses="+"\""+routerMac+"\"")
 
-	err = createManagementPort(nodeName, masterSwitchSubnet, clusterIpSubnet)
+	err = createManagementPort(nodeName, masterSwitchSubnet, clusterIpSubnet, serviceClusterIpRange)
 	if err != nil {
 		return fmt.Errorf("failed create management port: %v", err)
 	}
@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/mozhuli/ovn-stackube/pkg/common"
+	"github.com/mozhuli/ovn-stackube/pkg/exec"
+	"github.com/mozhuli/ovn-stackube/pkg/metadata"
+	"github.com/mozhuli/ovn-stackube/pkg/ovn"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+)
+
+func InitMetadataProxy() *cobra.Command {
+
+	var MetadataProxyCmd = &cobra.Command{
+		Use:   "metadata-proxy [no options!]",
+		Short: "serve the OpenStack metadata address to the pods of this node",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := runMetadataProxy(cmd, args); err != nil {
+				return fmt.Errorf("failed run metadata proxy: %v", err)
+			}
+			return nil
+		},
+	}
+
+	MetadataProxyCmd.Flags().StringP("k8s-api-server", "", "", "The address of the kubernetes API server. Defaults to external_ids:k8s-api-server of the local Open_vSwitch.")
+	MetadataProxyCmd.Flags().StringP("node-name", "", "", "A unique node name.")
+	MetadataProxyCmd.Flags().StringP("metadata-mode", "", common.MetadataModeManagementPort, "How pods reach the proxy, \"management-port\" or \"localport\". It has to match the --metadata-mode of the controller.")
+	MetadataProxyCmd.Flags().StringP("metadata-url", "", "", "The URL of the Nova compatible metadata service, e.g. http://nova:8775.")
+	MetadataProxyCmd.Flags().StringP("metadata-secret", "", "", "The secret shared with the metadata service that signs the instance IDs.")
+	MetadataProxyCmd.Flags().DurationP("resync-interval", "", 10*time.Second, "How often the metadata localports of this node are looked up.")
+
+	return MetadataProxyCmd
+}
+
+// metadataNetnsName returns the network namespace the metadata localport of
+// a switch is bound in.
+func metadataNetnsName(sw string) string {
+	return "ovnmeta-" + sw
+}
+
+// metadataVethName returns the host end of the veth pair of the metadata
+// localport of a switch.  The end in the namespace has "_c" appended.
+func metadataVethName(sw string) string {
+	return fmt.Sprintf("meta%08x", crc32.ChecksumIEEE([]byte(sw)))
+}
+
+// setupMetadataNamespace binds the metadata localport of sw in a network
+// namespace of its own.  The end of the veth pair in there has the MAC of
+// the port and the metadata address, and reaches the pods on subnet
+// on-link.
+func setupMetadataNamespace(sw, mac, subnet string) error {
+	netns := metadataNetnsName(sw)
+	veth := metadataVethName(sw)
+	inner := veth + "_c"
+	if _, err := os.Stat("/var/run/netns/" + netns); os.IsNotExist(err) {
+		if _, err := exec.RunCommand("ip", "netns", "add", netns); err != nil {
+			return err
+		}
+	}
+	var commands [][]string
+	if _, err := netlink.LinkByName(veth); err != nil {
+		commands = append(commands,
+			[]string{"link", "add", veth, "type", "veth", "peer", "name", inner},
+			[]string{"link", "set", inner, "netns", netns})
+	}
+	commands = append(commands,
+		[]string{"-n", netns, "link", "set", inner, "address", mac},
+		[]string{"-n", netns, "addr", "replace", common.MetadataIP + "/32", "dev", inner},
+		[]string{"-n", netns, "link", "set", "lo", "up"},
+		[]string{"-n", netns, "link", "set", inner, "up"},
+		[]string{"-n", netns, "route", "replace", subnet, "dev", inner, "scope", "link"},
+		[]string{"link", "set", veth, "up"})
+	for _, args := range commands {
+		if _, err := exec.RunCommand("ip", args...); err != nil {
+			return err
+		}
+	}
+	_, err := exec.RunCommand("ovs-vsctl", "--may-exist", "add-port", "br-int", veth, "--", "set", "interface", veth,
+		"external_ids:iface-id="+common.MetadataPortName(sw))
+	return err
+}
+
+// teardownMetadataNamespace unbinds the metadata localport of sw.  Deleting
+// the namespace deletes the veth pair.
+func teardownMetadataNamespace(sw string) error {
+	if _, err := exec.RunCommand("ovs-vsctl", "--if-exists", "del-port", "br-int", metadataVethName(sw)); err != nil {
+		return err
+	}
+	_, err := exec.RunCommand("ip", "netns", "del", metadataNetnsName(sw))
+	return err
+}
+
+// listenInNamespace opens the metadata listener in the namespace of sw.
+func listenInNamespace(sw string) (net.Listener, error) {
+	netns, err := ns.GetNS("/var/run/netns/" + metadataNetnsName(sw))
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close()
+	var listener net.Listener
+	err = netns.Do(func(_ ns.NetNS) error {
+		listener, err = net.Listen("tcp", common.MetadataIP+":80")
+		return err
+	})
+	return listener, err
+}
+
+// metadataNamespace is the state of a localport bound on this node.
+type metadataNamespace struct {
+	mac      string
+	subnet   string
+	listener net.Listener
+}
+
+// syncMetadataNamespaces binds the metadata localports of the switches of
+// this node and of the switches that span all nodes, and serves proxy in
+// their namespaces.  served holds what is bound already.
+func syncMetadataNamespaces(proxy *metadata.Proxy, nodeName string, served map[string]*metadataNamespace) error {
+	rows, err := ovn.ListRows("logical_switch_port", []string{"addresses", "external_ids"})
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]*metadataNamespace)
+	for _, row := range rows {
+		externalIDs := ovn.ParseMap(row["external_ids"])
+		sw, ok := externalIDs[common.MetadataKey]
+		fields := strings.Fields(row["addresses"])
+		if !ok || externalIDs["subnet"] == "" || len(fields) < 2 {
+			continue
+		}
+		if node, ok := externalIDs["k8s-node"]; ok && node != nodeName {
+			continue
+		}
+		wanted[sw] = &metadataNamespace{mac: fields[0], subnet: externalIDs["subnet"]}
+	}
+
+	for sw, port := range wanted {
+		current, ok := served[sw]
+		if ok && current.mac == port.mac && current.subnet == port.subnet {
+			continue
+		}
+		if err := setupMetadataNamespace(sw, port.mac, port.subnet); err != nil {
+			log.Printf("failed to bind the metadata port of %v: %v", sw, err)
+			continue
+		}
+		if ok {
+			current.mac, current.subnet = port.mac, port.subnet
+			continue
+		}
+		if exec.DryRun {
+			fmt.Printf("[dry-run] serve %v:80 in %v\n", common.MetadataIP, metadataNetnsName(sw))
+			served[sw] = port
+			continue
+		}
+		port.listener, err = listenInNamespace(sw)
+		if err != nil {
+			// Left out of served, so the next sync tries again.
+			log.Printf("failed to listen in %v: %v", metadataNetnsName(sw), err)
+			continue
+		}
+		served[sw] = port
+		go http.Serve(port.listener, proxy.Handler(sw))
+	}
+
+	for sw, current := range served {
+		if _, ok := wanted[sw]; ok {
+			continue
+		}
+		if current.listener != nil {
+			current.listener.Close()
+		}
+		if err := teardownMetadataNamespace(sw); err != nil {
+			log.Printf("failed to unbind the metadata port of %v: %v", sw, err)
+			continue
+		}
+		delete(served, sw)
+	}
+	return nil
+}
+
+// ensureLoopbackMetadataIP adds the metadata address to the loopback, so
+// that the traffic rerouted to the management port is delivered locally.
+func ensureLoopbackMetadataIP() error {
+	link, err := netlink.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of lo: %v", err)
+	}
+	address := &net.IPNet{IP: net.ParseIP(common.MetadataIP).To4(), Mask: net.CIDRMask(32, 32)}
+	for _, addr := range addrs {
+		if addr.IPNet.String() == address.String() {
+			return nil
+		}
+	}
+	return exec.Apply("ip addr add "+address.String()+" dev lo", func() error {
+		return netlink.AddrAdd(link, &netlink.Addr{IPNet: address})
+	})
+}
+
+func runMetadataProxy(cmd *cobra.Command, args []string) error {
+	_, err := fetchOVNNB()
+	if err != nil {
+		return err
+	}
+
+	server := cmd.Flags().Lookup("k8s-api-server").Value.String()
+	if server == "" {
+		server, err = getK8sAPIServer()
+		if err != nil {
+			return err
+		}
+	}
+	if server == "" {
+		return fmt.Errorf("argument --k8s-api-server should be non-null")
+	}
+	if !strings.HasPrefix(server, "http") {
+		server = "http://" + server
+	}
+	nodeName := cmd.Flags().Lookup("node-name").Value.String()
+	if nodeName == "" {
+		return fmt.Errorf("failed get node-name")
+	}
+	metadataURL := cmd.Flags().Lookup("metadata-url").Value.String()
+	if metadataURL == "" {
+		return fmt.Errorf("argument --metadata-url should be non-null")
+	}
+	upstream, err := url.Parse(metadataURL)
+	if err != nil {
+		return fmt.Errorf("failed parse metadata-url %v: %v", metadataURL, err)
+	}
+	interval, err := cmd.Flags().GetDuration("resync-interval")
+	if err != nil {
+		return err
+	}
+	proxy := &metadata.Proxy{Upstream: upstream, Secret: cmd.Flags().Lookup("metadata-secret").Value.String(), Server: server}
+
+	switch mode := cmd.Flags().Lookup("metadata-mode").Value.String(); mode {
+	case common.MetadataModeManagementPort:
+		if err := ensureLoopbackMetadataIP(); err != nil {
+			return err
+		}
+		if exec.DryRun {
+			fmt.Printf("[dry-run] serve %v:80 for the pods of %v\n", common.MetadataIP, nodeName)
+			return nil
+		}
+		// The node's switch is named after it.
+		return http.ListenAndServe(common.MetadataIP+":80", proxy.Handler(nodeName))
+	case common.MetadataModeLocalport:
+		served := make(map[string]*metadataNamespace)
+		for {
+			if err := syncMetadataNamespaces(proxy, nodeName, served); err != nil {
+				log.Printf("failed to sync metadata ports: %v", err)
+			}
+			if exec.DryRun {
+				return nil
+			}
+			time.Sleep(interval)
+		}
+	default:
+		return fmt.Errorf("unknown metadata-mode %q", mode)
+	}
+}
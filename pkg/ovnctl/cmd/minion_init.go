@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	osExec "os/exec"
@@ -23,12 +24,45 @@ func InitMinion() *cobra.Command {
 	}
 
 	MinionCmd.Flags().StringP("cluster-ip-subnet", "", "", "The cluster wide larger subnet of private ip addresses.")
+	MinionCmd.Flags().StringP("service-cluster-ip-range", "", "", "The subnet of service cluster ips, routed via the management port when set.")
 	MinionCmd.Flags().StringP("minion-switch-subnet", "", "", "The smaller subnet just for this master.")
 	MinionCmd.Flags().StringP("node-name", "", "", "A unique node name.")
+	MinionCmd.Flags().StringP("cni-mode", "", "", "How the CNI plugin attaches pod interfaces, \"veth\" (the default), \"tap\", \"macvtap\" or \"dpdk\". Only used when the CNI config is created.")
+	MinionCmd.Flags().StringP("cni-version", "", "", "The CNI version of the CNI config. Hypervisor based runtimes need 0.3.0 or later. Only used when the CNI config is created.")
 
 	return MinionCmd
 }
 
+// cniConfig is the CNI config of the plugin, the part of its NetConf that
+// ovnctl sets.
+type cniConfig struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Bridge     string `json:"bridge"`
+	IPMasq     bool   `json:"ipMasq"`
+	IsGateway  bool   `json:"isGateway"`
+	Mode       string `json:"mode,omitempty"`
+	IPAM       struct {
+		Type   string `json:"type"`
+		Subnet string `json:"subnet"`
+	} `json:"ipam"`
+}
+
+// cniModes are the modes the CNI plugin knows.
+var cniModes = map[string]bool{"": true, "veth": true, "tap": true, "macvtap": true, "dpdk": true}
+
+// cniConfigData returns the CNI config of a node with the switch subnet.
+func cniConfigData(subnet, mode, version string) ([]byte, error) {
+	if !cniModes[mode] {
+		return nil, fmt.Errorf("unknown cni-mode %q", mode)
+	}
+	config := cniConfig{CNIVersion: version, Name: "net", Type: "ovn_cni", Bridge: "br-int", IsGateway: true, Mode: mode}
+	config.IPAM.Type = "host-local"
+	config.IPAM.Subnet = subnet
+	return json.Marshal(config)
+}
+
 func initMinion(cmd *cobra.Command, args []string) error {
 
 	_, err := fetchOVNNB()
@@ -45,11 +79,18 @@ func initMinion(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed get cluster-ip-subnet")
 	}
 
+	serviceClusterIpRange := cmd.Flags().Lookup("service-cluster-ip-range").Value.String()
+
 	nodeName := cmd.Flags().Lookup("node-name").Value.String()
 	if nodeName == "" {
 		return fmt.Errorf("failed get node-name")
 	}
 
+	data, err := cniConfigData(minionSwitchSubnet, cmd.Flags().Lookup("cni-mode").Value.String(), cmd.Flags().Lookup("cni-version").Value.String())
+	if err != nil {
+		return err
+	}
+
 	cniPluginPath, err := osExec.LookPath(CNI_PLUGIN)
 	if err != nil {
 		return fmt.Errorf("no cni plugin %v found", CNI_PLUGIN)
@@ -57,7 +98,7 @@ func initMinion(cmd *cobra.Command, args []string) error {
 
 	_, err = os.Stat(CNI_LINK_PATH)
 	if err != nil && !os.IsExist(err) {
-		err = os.MkdirAll(CNI_LINK_PATH, os.ModeDir)
+		err = exec.MkdirAll(CNI_LINK_PATH, os.ModeDir)
 		if err != nil {
 			return err
 		}
@@ -73,7 +114,7 @@ func initMinion(cmd *cobra.Command, args []string) error {
 
 	_, err = os.Stat(CNI_CONF_PATH)
 	if err != nil && !os.IsExist(err) {
-		err = os.MkdirAll(CNI_CONF_PATH, os.ModeDir)
+		err = exec.MkdirAll(CNI_CONF_PATH, os.ModeDir)
 		if err != nil {
 			return err
 		}
@@ -84,17 +125,13 @@ func initMinion(cmd *cobra.Command, args []string) error {
 	_, err = os.Stat(cniConf)
 	if err != nil && !os.IsExist(err) {
 		// TODO:verify if it is needed to set config file in 10-net.conf
-		data := "{\"bridge\": \"br-int\", \"ipMasq\": \"false\", \"name\": \"net\", \"ipam\": {\"subnet\": \"" + minionSwitchSubnet + "\", \"type\": \"host-local\"}, \"isGateway\": \"true\", \"type\": \"ovn_cni\"}"
-		f, err := os.OpenFile(cniConf, os.O_CREATE|os.O_WRONLY, 0666)
+		err = exec.WriteFile(cniConf, data, 0666)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(f, data)
-		defer f.Close()
-
 	}
 
-	err = createManagementPort(nodeName, minionSwitchSubnet, clusterIpSubnet)
+	err = createManagementPort(nodeName, minionSwitchSubnet, clusterIpSubnet, serviceClusterIpRange)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// pluginNetConf has the types of the fields of the CNI plugin's NetConf
+// that ovnctl writes.
+type pluginNetConf struct {
+	Bridge string `json:"bridge"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	IPAM   struct {
+		Type   string `json:"type"`
+		Subnet string `json:"subnet"`
+	} `json:"ipam,omitempty"`
+	IPMasq     bool   `json:"ipMasq"`
+	IsGateway  bool   `json:"isGateway"`
+	Mode       string `json:"mode"`
+	CNIVersion string `json:"cniVersion"`
+}
+
+func TestCNIConfigData(t *testing.T) {
+	tests := []struct {
+		mode    string
+		version string
+		fails   bool
+	}{
+		{"", "", false},
+		{"tap", "0.3.0", false},
+		{"dpdk", "0.3.1", false},
+		{"vhost", "", true},
+	}
+	for _, test := range tests {
+		data, err := cniConfigData("10.244.1.0/24", test.mode, test.version)
+		if test.fails {
+			if err == nil {
+				t.Errorf("cniConfigData(%q, %q) = %s, want an error", test.mode, test.version, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cniConfigData(%q, %q) failed: %v", test.mode, test.version, err)
+			continue
+		}
+		var conf pluginNetConf
+		if err := json.Unmarshal(data, &conf); err != nil {
+			t.Errorf("cniConfigData(%q, %q) = %s, not a NetConf: %v", test.mode, test.version, data, err)
+			continue
+		}
+		if conf.Bridge != "br-int" || conf.Type != "ovn_cni" || conf.IPMasq || !conf.IsGateway || conf.Mode != test.mode || conf.CNIVersion != test.version ||
+			conf.IPAM.Type != "host-local" || conf.IPAM.Subnet != "10.244.1.0/24" {
+			t.Errorf("cniConfigData(%q, %q) = %s, got %+v", test.mode, test.version, data, conf)
+		}
+	}
+}